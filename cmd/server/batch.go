@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+//maxBatchSize bounds the number of jobs in a single batch enqueue.
+const maxBatchSize = 1000
+
+var (
+	errBatchSize     = errors.Errorf("A batch holds between 1 and %d jobs", maxBatchSize)
+	errBatchRejected = errors.New("The batch holds invalid jobs, none of them was enqueued")
+	errBatchKey      = errors.Errorf("%s is not supported by batch enqueue", idempotencyKeyHeader)
+	errDequeueMax    = errors.Errorf("max must be between 1 and %d", maxBatchSize)
+)
+
+//enqueued is the outcome of a single job of EnqueueBatch. Err is set for the jobs which made the batch rejected.
+type enqueued struct {
+	Id      int
+	Outcome enqueueOutcome
+	Err     error
+}
+
+//batchResult is the answer for a single job of a batch enqueue. Status is the code POST /jobs/enqueue answers the
+//job with. The valid jobs of a rejected batch have neither a status nor an error.
+type batchResult struct {
+	JobId  int    `json:"jobId,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+//EnqueueBatch enqueues all the jobs, in order, under a single acquisition of the lock, or none of them.
+//The jobs are validated first. If any of them would be refused the batch is rejected with errBatchRejected and the
+//error of every refused job is set in its outcome. A uniqueKey claimed by an earlier job of the batch is taken,
+//returnExisting answers with the id of that job.
+func (q *JobListQueue) EnqueueBatch(items []*job) ([]enqueued, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	results := make([]enqueued, len(items))
+	claimed := make(map[string]bool)
+	rejected := false
+	for i, item := range items {
+		results[i].Err = q.checkEnqueue(item, claimed)
+		if results[i].Err != nil {
+			rejected = true
+		}
+	}
+	if rejected {
+		return results, errBatchRejected
+	}
+
+	for i, item := range items {
+		id, existing, replaced, err := q.claimUniqueKey(item)
+		if err == nil && !existing {
+			id, err = q.enqueueReplacing(item, "", replaced)
+		}
+		if err != nil {
+			//Only a failed write or a generated id which is taken gets here, the jobs before are enqueued.
+			q.log.Log("level", "error", "msg", "batch enqueue stopped", "enqueued", i, "jobs", len(items), "error", err.Error())
+			return results[:i], err
+		}
+		results[i].Id = id
+		if existing {
+			results[i].Outcome = outcomeExisting
+		}
+	}
+	return results, nil
+}
+
+//checkEnqueue tells whether the job would be refused, without changing the queue. claimed holds the uniqueKeys of
+//the jobs checked before in the same batch. Caller must hold q.mutex.
+func (q *JobListQueue) checkEnqueue(item *job, claimed map[string]bool) error {
+	if q.config.MaxPayloadBytes > 0 && len(item.Payload) > q.config.MaxPayloadBytes {
+		return errPayloadTooLarge
+	}
+	if !validUniquePolicy(item.UniquePolicy) {
+		return errInvalidUniquePolicy
+	}
+	if item.UniqueKey == "" {
+		return nil
+	}
+	taken := claimed[item.UniqueKey]
+	claimed[item.UniqueKey] = true
+	if item.UniquePolicy == uniqueReturnExisting {
+		return nil
+	}
+	if taken {
+		return errUniqueKeyTaken
+	}
+	holder, ok := q.uniqueHolder(item.UniqueKey)
+	if !ok {
+		return nil
+	}
+	if item.UniquePolicy == uniqueReplace && holder.Value.Status != "IN_PROGRESS" {
+		return nil
+	}
+	return errUniqueKeyTaken
+}
+
+//DequeueBatch returns up to max jobs in the order Dequeue would hand them out, all leased to the consumer.
+//It fails like Dequeue when no job is available at all.
+func (q *JobListQueue) DequeueBatch(consumerId string, max int) ([]job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.dequeueBatch(consumerId, max)
+}
+
+//dequeueBatch leases up to max jobs to the consumer. Caller must hold q.mutex.
+func (q *JobListQueue) dequeueBatch(consumerId string, max int) ([]job, error) {
+	if q.store.Len() == 0 {
+		return nil, errQueueEmpty
+	}
+
+	//Leases which ran out, and scheduled jobs and retries which became due since the last reaper tick are released before picking a job.
+	q.requeueExpired()
+	q.promoteDue()
+
+	jobs := make([]job, 0, max)
+	for len(jobs) < max {
+		//The queued job with the highest priority is returned, the one enqueued first among jobs of the same priority.
+		next := q.popReady()
+		if next == nil {
+			break
+		}
+
+		//Report the priority the job had aged to when it was picked.
+		effectivePriority := q.snapshot(next).EffectivePriority
+		q.grantLease(next, consumerId)
+		//The jobs leased before a failed write are handed out again once their lease runs out.
+		if err := q.record("dequeue", next); err != nil {
+			return nil, err
+		}
+		dequeued := q.snapshot(next)
+		dequeued.EffectivePriority = effectivePriority
+		jobs = append(jobs, dequeued)
+	}
+	if len(jobs) == 0 {
+		return nil, errNoJobAvailable
+	}
+	return jobs, nil
+}
+
+func (h *handler) enqueueBatch(w http.ResponseWriter, r *http.Request) {
+	var reqs []job
+	err := json.NewDecoder(r.Body).Decode(&reqs)
+	if err != nil {
+		h.logger.Log("level", "error", "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(reqs) == 0 || len(reqs) > maxBatchSize {
+		Respond(w, http.StatusBadRequest, errBatchSize.Error())
+		return
+	}
+	//A retried batch cannot be told apart from a new one by a single key.
+	if r.Header.Get(idempotencyKeyHeader) != "" {
+		Respond(w, http.StatusBadRequest, errBatchKey.Error())
+		return
+	}
+
+	res := batchResponse{Results: make([]batchResult, len(reqs))}
+	items := make([]*job, len(reqs))
+	rejected := false
+	for i := range reqs {
+		items[i] = &reqs[i]
+		if err := resolveDelay(items[i]); err != nil {
+			res.Results[i] = batchResult{Status: http.StatusBadRequest, Error: err.Error()}
+			rejected = true
+		}
+	}
+	if rejected {
+		Respond(w, http.StatusBadRequest, res)
+		return
+	}
+
+	results, err := h.queueFor(r).EnqueueBatch(items)
+	if err == errBatchRejected {
+		for i, result := range results {
+			if result.Err != nil {
+				res.Results[i] = batchResult{Status: enqueueErrorStatus(result.Err), Error: result.Err.Error()}
+			}
+		}
+		Respond(w, http.StatusBadRequest, res)
+		return
+	}
+	if err != nil {
+		h.logger.Log("level", "error", "msg", "Not able to queue jobs", "error", err.Error())
+		Respond(w, enqueueErrorStatus(err), err.Error())
+		return
+	}
+
+	for i, result := range results {
+		res.Results[i] = batchResult{JobId: result.Id, Status: http.StatusCreated}
+		if result.Outcome == outcomeExisting {
+			res.Results[i].Status = http.StatusOK
+		}
+	}
+	Respond(w, http.StatusCreated, res)
+	return
+}
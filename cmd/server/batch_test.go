@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestHandler_EnqueueBatch(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+	h := newHandler(q, log.NewNopLogger())
+
+	existing, _ := q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	rr, _ := do(h, http.MethodPost, "/jobs/enqueue:batch", http.Header{}, []job{
+		{Type: "TIME_CRITICAL"},
+		{Type: "NOT_TIME_CRITICAL", DelaySeconds: 30},
+		{Type: "REINDEX", UniqueKey: "customer-42", UniquePolicy: uniqueReturnExisting},
+		{Type: "REINDEX", UniqueKey: "customer-43"},
+		{Type: "REINDEX", UniqueKey: "customer-43", UniquePolicy: uniqueReturnExisting},
+	})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var res batchResponse
+	json.Unmarshal(rr.Body.Bytes(), &res)
+	assert.Equal(t, 5, len(res.Results))
+	for _, i := range []int{0, 1, 3} {
+		assert.Equal(t, http.StatusCreated, res.Results[i].Status)
+		item, err := q.GetJob(res.Results[i].JobId)
+		assert.Nil(t, err)
+		assert.Equal(t, res.Results[i].JobId, item.Id)
+	}
+	assert.Equal(t, http.StatusOK, res.Results[2].Status)
+	assert.Equal(t, existing, res.Results[2].JobId)
+	assert.Equal(t, res.Results[3].JobId, res.Results[4].JobId)
+	assert.Equal(t, 4, q.Len())
+
+	//The jobs are enqueued in the order of the batch.
+	assert.True(t, res.Results[0].JobId < res.Results[1].JobId)
+	assert.True(t, res.Results[1].JobId < res.Results[3].JobId)
+}
+
+func TestHandler_EnqueueBatchRejected(t *testing.T) {
+	config := testConfig()
+	config.MaxPayloadBytes = 8
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+	h := newHandler(q, log.NewNopLogger())
+
+	rr, _ := do(h, http.MethodPost, "/jobs/enqueue:batch", http.Header{}, []job{
+		{Type: "TIME_CRITICAL"},
+		{Type: "TIME_CRITICAL", Payload: json.RawMessage(`{"much":"too large"}`)},
+		{Type: "REINDEX", UniqueKey: "customer-42"},
+		{Type: "REINDEX", UniqueKey: "customer-42"},
+		{Type: "REINDEX", UniquePolicy: "ignore"},
+	})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var res batchResponse
+	json.Unmarshal(rr.Body.Bytes(), &res)
+	assert.Equal(t, []batchResult{
+		{},
+		{Status: http.StatusRequestEntityTooLarge, Error: errPayloadTooLarge.Error()},
+		{},
+		{Status: http.StatusConflict, Error: errUniqueKeyTaken.Error()},
+		{Status: http.StatusBadRequest, Error: errInvalidUniquePolicy.Error()},
+	}, res.Results)
+	assert.Equal(t, 0, q.Len())
+
+	rr, _ = do(h, http.MethodPost, "/jobs/enqueue:batch", http.Header{}, []job{{Type: "TIME_CRITICAL", DelaySeconds: -1}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &res)
+	assert.Equal(t, errNegativeDelay.Error(), res.Results[0].Error)
+
+	rr, _ = do(h, http.MethodPost, "/jobs/enqueue:batch", http.Header{}, []job{})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr, _ = do(h, http.MethodPost, "/jobs/enqueue:batch", http.Header{}, make([]job, maxBatchSize+1))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	header := http.Header{}
+	header.Set(idempotencyKeyHeader, "batch-1")
+	rr, _ = do(h, http.MethodPost, "/jobs/enqueue:batch", header, []job{{Type: "TIME_CRITICAL"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestQueue_EnqueueBatchReplace(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+
+	old, _ := q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	results, err := q.EnqueueBatch([]*job{{Type: "REINDEX", UniqueKey: "customer-42", UniquePolicy: uniqueReplace}})
+	assert.Nil(t, err)
+	assert.NotEqual(t, old, results[0].Id)
+	_, err = q.GetJob(old)
+	assert.NotNil(t, err)
+
+	//The job in progress is not replaced, so the whole batch is rejected.
+	q.Dequeue("cId1")
+	results, err = q.EnqueueBatch([]*job{
+		{Type: "TIME_CRITICAL"},
+		{Type: "REINDEX", UniqueKey: "customer-42", UniquePolicy: uniqueReplace},
+	})
+	assert.Equal(t, errBatchRejected, err)
+	assert.Nil(t, results[0].Err)
+	assert.Equal(t, errUniqueKeyTaken, results[1].Err)
+	assert.Equal(t, 1, q.Len())
+}
+
+func TestHandler_DequeueMax(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+	h := newHandler(q, log.NewNopLogger())
+
+	low, _ := q.Enqueue(&job{Type: "NOT_TIME_CRITICAL"})
+	high, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	later, _ := q.Enqueue(&job{Type: "NOT_TIME_CRITICAL"})
+	header := http.Header{}
+	header.Set("CONSUMER_ID", "cId1")
+
+	rr, _ := do(h, http.MethodGet, "/jobs/dequeue?max=2", header, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var jobs []job
+	json.Unmarshal(rr.Body.Bytes(), &jobs)
+	assert.Equal(t, 2, len(jobs))
+	assert.Equal(t, high, jobs[0].Id)
+	assert.Equal(t, low, jobs[1].Id)
+	for _, item := range jobs {
+		assert.Equal(t, "IN_PROGRESS", item.Status)
+		assert.Equal(t, "cId1", item.ConsumerId)
+	}
+
+	//Fewer jobs than max are available.
+	rr, _ = do(h, http.MethodGet, "/jobs/dequeue?max=10", header, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &jobs)
+	assert.Equal(t, 1, len(jobs))
+	assert.Equal(t, later, jobs[0].Id)
+
+	rr, _ = do(h, http.MethodGet, "/jobs/dequeue?max=10", header, nil)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	for _, max := range []string{"0", "-1", "many", "1001"} {
+		rr, _ = do(h, http.MethodGet, "/jobs/dequeue?max="+max, header, nil)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, max)
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errLeaseExpired = errors.New("The leader has not heard from a majority of the nodes, try again later")
+var errRaftDirRequired = errors.New("A cluster node needs a raft directory")
+var errNotClusterPeer = errors.New("Only the nodes of the cluster can send Raft requests")
+
+//forwardedHeader marks requests a follower forwarded to the leader, so they are never forwarded twice.
+const forwardedHeader = "X-Queue-Forwarded-By"
+
+//Cluster runs the queues of a registry on a Raft group. The leader executes every request against its own queues
+//and replicates the resulting write-ahead log records, a request is answered once every record in the log of the
+//leader is committed, so no answer shows a change which may still be lost.
+//The queues of the leader hold exactly the records of its log. A change which could not be proposed makes it stop
+//serving and rebuild its queues from the log.
+//Followers apply the committed records and forward every request to the leader.
+//The registry of a cluster node must not run lease reapers, the leader reaps all the queues every reapInterval.
+type Cluster struct {
+	raft         *Raft
+	registry     *Registry
+	peers        map[string]string
+	log          log.Logger
+	reapInterval time.Duration
+	mutex        sync.Mutex
+	applied      uint64
+	leading      bool
+	servingTerm  uint64
+	stale        int32
+	resync       chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+	waitGroup    sync.WaitGroup
+}
+
+//NewCluster ties the registry to the Raft node. peers maps the id of every node, this one included, to the URL of its API.
+func NewCluster(raft *Raft, registry *Registry, peers map[string]string, logger log.Logger, reapInterval time.Duration) *Cluster {
+	c := &Cluster{
+		raft:         raft,
+		registry:     registry,
+		peers:        peers,
+		log:          logger,
+		reapInterval: reapInterval,
+		resync:       make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	registry.mutex.Lock()
+	registry.journal = clusterJournal{cluster: c}
+	for name, q := range registry.queues {
+		q.mutex.Lock()
+		q.journal = queueJournal{journal: registry.journal, name: name}
+		q.mutex.Unlock()
+	}
+	registry.mutex.Unlock()
+	registry.schedules.setJournal(clusterJournal{cluster: c})
+
+	c.waitGroup.Add(1)
+	go c.run()
+	return c
+}
+
+//Serving reports whether this node is the leader, its queues are up to date and it holds the lease of the leader,
+//so it accepts requests.
+func (c *Cluster) Serving() bool {
+	term := atomic.LoadUint64(&c.servingTerm)
+	return term != 0 && c.raft.Lease(term)
+}
+
+func (c *Cluster) run() {
+	defer c.waitGroup.Done()
+
+	var reap <-chan time.Time
+	if c.reapInterval > 0 {
+		ticker := time.NewTicker(c.reapInterval)
+		defer ticker.Stop()
+		reap = ticker.C
+	}
+	var compact <-chan time.Time
+	if c.raft.config.SnapshotEntries > 0 {
+		ticker := time.NewTicker(c.raft.config.ElectionTimeout)
+		defer ticker.Stop()
+		compact = ticker.C
+	}
+	c.sync()
+	for {
+		select {
+		case <-c.raft.Notify():
+			c.sync()
+		case <-c.resync:
+			c.sync()
+		case <-reap:
+			if c.Serving() {
+				c.registry.reapAll()
+			}
+		case <-compact:
+			c.compact()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+//sync brings the queues in line with the role of the node. A follower applies the committed entries.
+//A new leader applies every entry of its log, all of them get committed while it leads, and starts serving.
+//A leader which stepped down may hold changes which never got committed, and stale queues hold a change which is
+//not in the log, so they are rebuilt.
+func (c *Cluster) sync() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stale := atomic.SwapInt32(&c.stale, 0) == 1
+	status := c.raft.Status()
+	if status.Role == raftLeader {
+		if !stale && atomic.LoadUint64(&c.servingTerm) == status.Term {
+			return
+		}
+		if c.leading || stale {
+			atomic.StoreUint64(&c.servingTerm, 0)
+			c.reset()
+		}
+		c.apply(status.LastIndex)
+		c.registry.rebuildIndexes()
+		c.leading = true
+		atomic.StoreUint64(&c.servingTerm, status.Term)
+		c.log.Log("level", "info", "msg", "serving as leader", "term", status.Term, "lastIndex", status.LastIndex)
+		return
+	}
+
+	if c.leading || stale {
+		atomic.StoreUint64(&c.servingTerm, 0)
+		c.leading = false
+		c.reset()
+		c.log.Log("level", "info", "msg", "stopped serving, following", "leader", status.Leader, "term", status.Term)
+	}
+	c.apply(status.CommitIndex)
+}
+
+//invalidate stops serving and has the queues rebuilt from the log, after they were changed by a record which could
+//not be proposed.
+func (c *Cluster) invalidate() {
+	atomic.StoreUint64(&c.servingTerm, 0)
+	atomic.StoreInt32(&c.stale, 1)
+	select {
+	case c.resync <- struct{}{}:
+	default:
+	}
+}
+
+//reset empties the queues so the committed entries can be applied again. Caller must hold c.mutex.
+func (c *Cluster) reset() {
+	if err := c.registry.reset(); err != nil {
+		c.log.Log("level", "error", "msg", "failed to reset queues", "error", err.Error())
+	}
+	c.applied = 0
+}
+
+//apply applies the entries after the last applied one up to index, starting over from the snapshot if some of them
+//were compacted. Caller must hold c.mutex.
+func (c *Cluster) apply(index uint64) {
+	snapshot, entries := c.raft.EntriesAfter(c.applied, index)
+	if snapshot != nil {
+		c.restore(*snapshot)
+	}
+	for _, entry := range entries {
+		c.applied = entry.Index
+		if entry.Data == nil {
+			continue
+		}
+		var record walRecord
+		if err := json.Unmarshal(entry.Data, &record); err != nil {
+			c.log.Log("level", "error", "msg", "failed to decode raft log entry", "index", entry.Index, "error", err.Error())
+			continue
+		}
+		if err := c.registry.replay(record); err != nil {
+			c.log.Log("level", "error", "msg", "failed to apply raft log entry", "index", entry.Index, "op", record.Op, "error", err.Error())
+		}
+	}
+}
+
+//restore replaces the queues by the snapshot of a compacted log. Caller must hold c.mutex.
+func (c *Cluster) restore(raftSnapshot raftSnapshot) {
+	if err := c.registry.reset(); err != nil {
+		c.log.Log("level", "error", "msg", "failed to reset queues", "error", err.Error())
+	}
+	var s snapshot
+	err := json.Unmarshal(raftSnapshot.Data, &s)
+	if err == nil {
+		err = c.registry.restore(&s)
+	}
+	if err != nil {
+		c.log.Log("level", "error", "msg", "failed to restore raft snapshot", "index", raftSnapshot.Index, "error", err.Error())
+	}
+	c.applied = raftSnapshot.Index
+}
+
+//compact replaces the start of the raft log by a snapshot of the queues, once SnapshotEntries entries were added
+//since the last one. A follower snapshots the entries it applied. The queues of the leader hold every entry of its
+//log, so it snapshots them all once they are committed.
+func (c *Cluster) compact() {
+	threshold := uint64(c.raft.config.SnapshotEntries)
+	c.mutex.Lock()
+	leading := c.leading
+	term := atomic.LoadUint64(&c.servingTerm)
+	index := c.applied
+	if leading {
+		index = c.raft.LastIndex()
+	}
+	if (leading && term == 0) || index < c.raft.Status().SnapshotIndex+threshold {
+		c.mutex.Unlock()
+		return
+	}
+	s := c.registry.capture(func(s *snapshot) {
+		if leading {
+			index = c.raft.LastIndex()
+		}
+	})
+	//A change which could not be proposed may be part of the snapshot.
+	stale := leading && atomic.LoadUint64(&c.servingTerm) != term
+	c.mutex.Unlock()
+	if stale {
+		return
+	}
+
+	if leading {
+		if err := c.raft.WaitCommitted(index, term); err != nil {
+			return
+		}
+	}
+	data, err := json.Marshal(s)
+	if err == nil {
+		err = c.raft.Compact(index, data)
+	}
+	if err != nil {
+		c.log.Log("level", "error", "msg", "failed to compact raft log", "index", index, "error", err.Error())
+		return
+	}
+	c.log.Log("level", "info", "msg", "compacted raft log", "index", index)
+}
+
+//clusterJournal proposes the records of the leader to the Raft log. Followers refuse every change.
+//The record describes a change already made to the queues, one which is refused leaves them stale.
+type clusterJournal struct {
+	cluster *Cluster
+}
+
+func (j clusterJournal) Append(record walRecord) error {
+	err := j.propose(record)
+	if err != nil {
+		j.cluster.invalidate()
+	}
+	return err
+}
+
+func (j clusterJournal) propose(record walRecord) error {
+	term := atomic.LoadUint64(&j.cluster.servingTerm)
+	if term == 0 {
+		return errNotLeader
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = j.cluster.raft.Propose(term, data)
+	return err
+}
+
+//Handler serves the Raft RPCs to the other nodes and the cluster status, and puts the API in next behind the leader.
+func (c *Cluster) Handler(next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/vote", c.fromPeer(c.requestVote))
+	mux.HandleFunc("/raft/append", c.fromPeer(c.appendEntries))
+	mux.HandleFunc("/raft/snapshot", c.fromPeer(c.installSnapshot))
+	mux.HandleFunc("/cluster", c.getCluster)
+	mux.Handle("/", c.route(next))
+	return mux
+}
+
+//fromPeer only lets the requests coming from the host of another node of the cluster through, anyone else could
+//depose the leader and overwrite the log.
+func (c *Cluster) fromPeer(next http.HandlerFunc) http.HandlerFunc {
+	urls := make([]string, 0, len(c.peers))
+	for id, target := range c.peers {
+		if id != c.raft.id {
+			urls = append(urls, target)
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !fromHost(r, urls) {
+			Respond(w, http.StatusForbidden, errNotClusterPeer.Error())
+			return
+		}
+		next(w, r)
+	}
+}
+
+//Committed waits until every entry in the log of the leader is committed, so nothing sent afterwards shows a change
+//which may still be lost.
+func (c *Cluster) Committed() error {
+	term := atomic.LoadUint64(&c.servingTerm)
+	if term == 0 {
+		return errNotLeader
+	}
+	if !c.raft.Lease(term) {
+		return errLeaseExpired
+	}
+	return c.raft.WaitCommitted(c.raft.LastIndex(), term)
+}
+
+//route serves the request if this node is the leader, answering once every entry of its log is committed.
+//Otherwise the request is forwarded to the leader, streams included.
+func (c *Cluster) route(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		term := atomic.LoadUint64(&c.servingTerm)
+		if term == 0 {
+			c.forward(w, r)
+			return
+		}
+		//A leader cut off from the majority may have been replaced already, its queues may be out of date.
+		if !c.raft.Lease(term) {
+			w.Header().Set("Retry-After", "1")
+			Respond(w, http.StatusServiceUnavailable, errLeaseExpired.Error())
+			return
+		}
+		//The events change nothing, the leader streams them as its queues change. A stream of jobs waits for its
+		//changes to be committed itself, through the Committed of the handler.
+		if r.URL.Path == "/events" || isWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		//The answer may show changes of other requests which are still being replicated, so every entry in the log
+		//has to be committed before it is sent, not only the ones of this request.
+		buffered := newBufferedResponse()
+		next.ServeHTTP(buffered, r)
+		if atomic.LoadUint64(&c.servingTerm) != term {
+			w.Header().Set("Retry-After", "1")
+			Respond(w, http.StatusServiceUnavailable, errLeadershipLost.Error())
+			return
+		}
+		if err := c.raft.WaitCommitted(c.raft.LastIndex(), term); err != nil {
+			Respond(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		buffered.flush(w)
+		return
+	})
+}
+
+//forward proxies the request to the leader. A leader which is still catching up answers 503 itself.
+func (c *Cluster) forward(w http.ResponseWriter, r *http.Request) {
+	leader := c.raft.Status().Leader
+	target, ok := c.peers[leader]
+	if !ok || leader == c.raft.id || r.Header.Get(forwardedHeader) != "" {
+		w.Header().Set("Retry-After", "1")
+		Respond(w, http.StatusServiceUnavailable, "No leader available, try again later")
+		return
+	}
+	leaderURL, err := url.Parse(target)
+	if err != nil {
+		Respond(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	r.Header.Set(forwardedHeader, c.raft.id)
+	httputil.NewSingleHostReverseProxy(leaderURL).ServeHTTP(w, r)
+}
+
+func (c *Cluster) requestVote(w http.ResponseWriter, r *http.Request) {
+	var req voteRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, c.raft.RequestVote(req))
+	return
+}
+
+func (c *Cluster) appendEntries(w http.ResponseWriter, r *http.Request) {
+	var req appendRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, c.raft.AppendEntries(req))
+	return
+}
+
+func (c *Cluster) installSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req snapshotRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, c.raft.InstallSnapshot(req))
+	return
+}
+
+type clusterInfo struct {
+	raftStatus
+	Serving bool     `json:"serving"`
+	Nodes   []string `json:"nodes"`
+}
+
+func (c *Cluster) getCluster(w http.ResponseWriter, r *http.Request) {
+	nodes := make([]string, 0, len(c.peers))
+	for id := range c.peers {
+		nodes = append(nodes, id)
+	}
+	sort.Strings(nodes)
+	Respond(w, http.StatusOK, clusterInfo{raftStatus: c.raft.Status(), Serving: c.Serving(), Nodes: nodes})
+	return
+}
+
+//Close stops applying entries and reaping. The Raft node and the registry are closed by their owner.
+func (c *Cluster) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	c.waitGroup.Wait()
+}
+
+//bufferedResponse holds a response back until the changes behind it are committed.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) flush(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
+
+//httpRaftTransport sends the RPCs to the /raft routes of the peers.
+type httpRaftTransport struct {
+	peers  map[string]string
+	client *http.Client
+}
+
+func newHTTPRaftTransport(peers map[string]string, timeout time.Duration) *httpRaftTransport {
+	return &httpRaftTransport{peers: peers, client: &http.Client{Timeout: timeout}}
+}
+
+func (t *httpRaftTransport) call(peer string, path string, req interface{}, resp interface{}) error {
+	target, ok := t.peers[peer]
+	if !ok {
+		return errors.Errorf("unknown peer %s", peer)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	res, err := t.client.Post(strings.TrimSuffix(target, "/")+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("peer %s answered %s", peer, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+func (t *httpRaftTransport) RequestVote(peer string, req voteRequest) (voteResponse, error) {
+	var resp voteResponse
+	err := t.call(peer, "/raft/vote", req, &resp)
+	return resp, err
+}
+
+func (t *httpRaftTransport) AppendEntries(peer string, req appendRequest) (appendResponse, error) {
+	var resp appendResponse
+	err := t.call(peer, "/raft/append", req, &resp)
+	return resp, err
+}
+
+func (t *httpRaftTransport) InstallSnapshot(peer string, req snapshotRequest) (snapshotResponse, error) {
+	var resp snapshotResponse
+	err := t.call(peer, "/raft/snapshot", req, &resp)
+	return resp, err
+}
+
+//startClusterNode creates the registry of node id and joins it to the Raft group of members, which maps the id of
+//every node to the URL of its API. The term, the vote and the raft log are kept in raftDir. A node which forgot them
+//could vote twice in a term, or count towards a majority for entries it lost, so there is no in-memory mode.
+func startClusterNode(logger log.Logger, config QueueConfig, id string, members map[string]string, raftDir string, raftConfig RaftConfig) (*Registry, *Raft, *Cluster, error) {
+	if _, ok := members[id]; !ok {
+		return nil, nil, nil, errors.Errorf("node id %q is not in the cluster", id)
+	}
+	if raftDir == "" {
+		return nil, nil, nil, errRaftDirRequired
+	}
+	peers := make([]string, 0, len(members)-1)
+	for member := range members {
+		if member != id {
+			peers = append(peers, member)
+		}
+	}
+	sort.Strings(peers)
+
+	storage, err := OpenFileRaftStorage(raftDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	raft, err := NewRaft(id, peers, newHTTPRaftTransport(members, raftConfig.ElectionTimeout), storage, raftConfig, logger)
+	if err != nil {
+		storage.Close()
+		return nil, nil, nil, err
+	}
+
+	//Only the leader reaps, and its changes are replicated like any other.
+	reapInterval := config.ReapInterval
+	config.ReapInterval = 0
+	registry := NewRegistry(logger, config)
+	cluster := NewCluster(raft, registry, members, logger, reapInterval)
+	return registry, raft, cluster, nil
+}
+
+//parsePeers parses the -cluster flag, a comma separated list of id=url.
+func parsePeers(value string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		pair := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, errors.Errorf("invalid cluster member %q, expected id=url", part)
+		}
+		if _, err := url.Parse(pair[1]); err != nil {
+			return nil, errors.Wrapf(err, "invalid url of cluster member %s", pair[0])
+		}
+		peers[pair[0]] = pair[1]
+	}
+	return peers, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//testNode is a cluster node serving its API on an httptest server.
+type testNode struct {
+	id       string
+	dir      string
+	server   *httptest.Server
+	raft     *Raft
+	registry *Registry
+	cluster  *Cluster
+}
+
+func (n *testNode) close() {
+	n.server.Close()
+	n.cluster.Close()
+	n.raft.Close()
+	n.registry.Close()
+	os.RemoveAll(n.dir)
+}
+
+func startTestCluster(t *testing.T, ids ...string) []*testNode {
+	//The servers have to be up to know their URLs, the handlers are plugged in afterwards.
+	handlers := make(map[string]http.Handler)
+	ready := make(chan struct{})
+	members := make(map[string]string)
+	nodes := make([]*testNode, 0)
+	for _, id := range ids {
+		id := id
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-ready
+			handlers[id].ServeHTTP(w, r)
+		}))
+		members[id] = server.URL
+		dir, err := ioutil.TempDir("", "raft")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, &testNode{id: id, dir: dir, server: server})
+	}
+
+	config := testConfig()
+	config.ReapInterval = 10 * time.Millisecond
+	//Small snapshots, so the tests run on compacted logs.
+	raftConfig := testRaftConfig()
+	raftConfig.SnapshotEntries = 8
+	for _, n := range nodes {
+		var err error
+		n.registry, n.raft, n.cluster, err = startClusterNode(log.NewNopLogger(), config, n.id, members, filepath.Join(n.dir, "raft"), raftConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := newHandler(n.registry.Default(), log.NewNopLogger())
+		h.queues = n.registry
+		h.committed = n.cluster.Committed
+		handlers[n.id] = n.cluster.Handler(newRouter(&h))
+	}
+	close(ready)
+	return nodes
+}
+
+//waitForServing returns the node serving as leader once every node knows it.
+func waitForServing(t *testing.T, nodes []*testNode) *testNode {
+	var leader *testNode
+	waitFor(t, "a serving leader", func() bool {
+		for _, n := range nodes {
+			if n.cluster.Serving() {
+				leader = n
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, n := range nodes {
+			if n.raft.Status().Leader != leader.id {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+func call(t *testing.T, method string, url string, consumerId string, body interface{}) *http.Response {
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("CONSUMER_ID", consumerId)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestCluster_FollowerForwardsToLeader(t *testing.T) {
+	nodes := startTestCluster(t, "a", "b", "c")
+	for _, n := range nodes {
+		defer n.close()
+	}
+	leader := waitForServing(t, nodes)
+	var follower *testNode
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+		}
+	}
+
+	res := call(t, http.MethodPost, follower.server.URL+"/jobs/enqueue", "", job{Type: "TIME_CRITICAL"})
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	var enqueued jobIdResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&enqueued))
+	res.Body.Close()
+
+	//The job is committed, so every node applies it.
+	for _, n := range nodes {
+		q := n.registry.Default()
+		waitFor(t, "the job to be applied on "+n.id, func() bool {
+			_, err := q.GetJob(enqueued.JobId)
+			return err == nil
+		})
+	}
+
+	res = call(t, http.MethodGet, leader.server.URL+"/cluster", "", nil)
+	var info clusterInfo
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&info))
+	res.Body.Close()
+	assert.Equal(t, leader.id, info.Leader)
+	assert.True(t, info.Serving)
+	assert.Equal(t, []string{"a", "b", "c"}, info.Nodes)
+}
+
+func TestCluster_FailoverKeepsAcknowledgedChanges(t *testing.T) {
+	nodes := startTestCluster(t, "a", "b", "c")
+	leader := waitForServing(t, nodes)
+	survivors := make([]*testNode, 0)
+	for _, n := range nodes {
+		if n != leader {
+			survivors = append(survivors, n)
+			defer n.close()
+		}
+	}
+
+	ids := make([]int, 0)
+	for i := 0; i < 3; i++ {
+		res := call(t, http.MethodPost, leader.server.URL+"/jobs/enqueue", "", job{Type: "TIME_CRITICAL"})
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		var enqueued jobIdResponse
+		json.NewDecoder(res.Body).Decode(&enqueued)
+		res.Body.Close()
+		ids = append(ids, enqueued.JobId)
+	}
+	res := call(t, http.MethodGet, leader.server.URL+"/jobs/dequeue", "cId1", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+	res = call(t, http.MethodPost, fmt.Sprintf("%s/jobs/%d/conclude", leader.server.URL, ids[0]), "cId1", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+	res = call(t, http.MethodGet, leader.server.URL+"/jobs/dequeue", "cId2", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+
+	leader.close()
+	newLeader := waitForServing(t, survivors)
+
+	//Every acknowledged change made it to the new leader, and the lease can be concluded there.
+	q := newLeader.registry.Default()
+	item, err := q.GetJob(ids[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "CONCLUDED", item.Status)
+	item, err = q.GetJob(ids[1])
+	assert.Nil(t, err)
+	assert.Equal(t, "IN_PROGRESS", item.Status)
+	assert.Equal(t, "cId2", item.ConsumerId)
+	item, err = q.GetJob(ids[2])
+	assert.Nil(t, err)
+	assert.Equal(t, "QUEUED", item.Status)
+
+	for _, n := range survivors {
+		res = call(t, http.MethodGet, fmt.Sprintf("%s/jobs/%d", n.server.URL, ids[1]), "", nil)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		res.Body.Close()
+	}
+	res = call(t, http.MethodPost, fmt.Sprintf("%s/jobs/%d/conclude", newLeader.server.URL, ids[1]), "cId2", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+	item, _ = q.GetJob(ids[1])
+	assert.Equal(t, "CONCLUDED", item.Status)
+}
+
+func TestCluster_UnproposedChangeIsRolledBack(t *testing.T) {
+	nodes := startTestCluster(t, "a", "b", "c")
+	for _, n := range nodes {
+		defer n.close()
+	}
+	leader := waitForServing(t, nodes)
+	res := call(t, http.MethodPost, leader.server.URL+"/jobs/enqueue", "", job{Type: "TIME_CRITICAL"})
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res.Body.Close()
+
+	//The leader can no longer write its log, the job is enqueued in its queue but cannot be proposed.
+	leader.raft.mutex.Lock()
+	leader.raft.storage.(*fileRaftStorage).file.Close()
+	leader.raft.mutex.Unlock()
+	res = call(t, http.MethodPost, leader.server.URL+"/jobs/enqueue", "", job{Type: "TIME_CRITICAL"})
+	assert.NotEqual(t, http.StatusCreated, res.StatusCode)
+	res.Body.Close()
+
+	waitFor(t, "the leader to rebuild its queues", leader.cluster.Serving)
+	assert.Equal(t, 1, leader.registry.Default().Len())
+}
+
+func TestCluster_CompactsLog(t *testing.T) {
+	nodes := startTestCluster(t, "a", "b", "c")
+	for _, n := range nodes {
+		defer n.close()
+	}
+	leader := waitForServing(t, nodes)
+	for i := 0; i < 20; i++ {
+		res := call(t, http.MethodPost, leader.server.URL+"/queues/reports/jobs/enqueue", "", job{Type: "TIME_CRITICAL"})
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		res.Body.Close()
+	}
+	for _, n := range nodes {
+		waitFor(t, "the raft log of "+n.id+" to be compacted", func() bool {
+			return n.raft.Status().SnapshotIndex >= 8
+		})
+	}
+
+	//Rebuilt from the snapshot and the entries after it, the queues are the same.
+	leader.cluster.invalidate()
+	waitFor(t, "the leader to rebuild its queues", leader.cluster.Serving)
+	q, err := leader.registry.Lookup("reports")
+	assert.Nil(t, err)
+	assert.Equal(t, 20, q.Len())
+}
+
+func TestCluster_FollowerForwardsStream(t *testing.T) {
+	nodes := startTestCluster(t, "a", "b", "c")
+	for _, n := range nodes {
+		defer n.close()
+	}
+	leader := waitForServing(t, nodes)
+	var follower *testNode
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+		}
+	}
+
+	c := dialStream(t, follower.server.URL, "", "cId1")
+	defer c.Close()
+	res := call(t, http.MethodPost, leader.server.URL+"/jobs/enqueue", "", job{Type: "TIME_CRITICAL"})
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	var enqueued jobIdResponse
+	json.NewDecoder(res.Body).Decode(&enqueued)
+	res.Body.Close()
+
+	msg, ok := receiveStream(t, c, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, enqueued.JobId, msg.JobId)
+	sendStream(t, c, streamMessage{Op: "conclude", JobId: enqueued.JobId})
+	msg, ok = receiveStream(t, c, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, streamMessage{Op: "ack", Ack: "conclude", JobId: enqueued.JobId, Status: http.StatusOK}, msg)
+
+	//The ack is only sent once the conclude is committed.
+	for _, n := range nodes {
+		waitFor(t, "the conclude to be applied on "+n.id, func() bool {
+			item, err := n.registry.Default().GetJob(enqueued.JobId)
+			return err == nil && item.Status == "CONCLUDED"
+		})
+	}
+	c.CloseWithStatus(wsCloseNormal, "")
+}
+
+func TestCluster_RaftRequestsOnlyFromPeers(t *testing.T) {
+	nodes := startTestCluster(t, "a")
+	defer nodes[0].close()
+	leader := waitForServing(t, nodes)
+	term := leader.raft.Status().Term
+
+	//The only node has no peer, nobody may depose it.
+	res := call(t, http.MethodPost, leader.server.URL+"/raft/append", "", appendRequest{Term: term + 10, LeaderId: "x"})
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+	res = call(t, http.MethodPost, leader.server.URL+"/raft/vote", "", voteRequest{Term: term + 10, CandidateId: "x"})
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+	assert.Equal(t, term, leader.raft.Status().Term)
+	assert.True(t, leader.cluster.Serving())
+}
+
+func TestStartClusterNode_RequiresRaftDir(t *testing.T) {
+	_, _, _, err := startClusterNode(log.NewNopLogger(), testConfig(), "a", map[string]string{"a": "http://127.0.0.1:1"}, "", testRaftConfig())
+	assert.Equal(t, errRaftDirRequired, err)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//QueueConfig holds the tunables of JobListQueue.
+type QueueConfig struct {
+	//LeaseTimeout is how long a dequeued job stays IN_PROGRESS before it is handed out again.
+	LeaseTimeout time.Duration
+	//ReapInterval is how often the background reaper looks for expired leases. Zero disables the reaper.
+	ReapInterval time.Duration
+	//MaxAttempts is how many times a job may fail or let its lease expire before it is dead-lettered, unless the job or
+	//its type sets its own limit. Zero means no limit.
+	MaxAttempts int
+	//MaxAttemptsByType overrides MaxAttempts for the given job types.
+	MaxAttemptsByType TypeLimits
+	//RetryBackoff is the delay before the first retry. It doubles on every further attempt up to MaxRetryBackoff.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	//MaxPayloadBytes and MaxResultBytes limit the size of the JSON payload of a job and of the result it is concluded with.
+	//Zero means no limit.
+	MaxPayloadBytes int
+	MaxResultBytes  int
+	//AgingInterval is how long a queued job waits to gain one priority level, so low priority jobs are not starved by a
+	//steady stream of higher priority ones. Zero disables aging.
+	AgingInterval time.Duration
+	//IdempotencyWindow is how long an enqueue with an Idempotency-Key returns the job first enqueued with it,
+	//rather than enqueue another one. Zero disables idempotency keys.
+	IdempotencyWindow time.Duration
+	//IDs hands out the ids of new jobs. Queues sharing a generator never hand out the same id.
+	IDs IDGenerator
+}
+
+func DefaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		LeaseTimeout:      30 * time.Second,
+		ReapInterval:      time.Second,
+		MaxAttempts:       3,
+		MaxAttemptsByType: TypeLimits{},
+		RetryBackoff:      time.Second,
+		MaxRetryBackoff:   5 * time.Minute,
+		MaxPayloadBytes:   256 * 1024,
+		MaxResultBytes:    256 * 1024,
+		IdempotencyWindow: 24 * time.Hour,
+		IDs:               defaultIDs,
+	}
+}
+
+//TypeLimits maps a job type to a limit. It implements flag.Value so it can be set as TYPE=N,TYPE=N on the command line.
+type TypeLimits map[string]int
+
+func (l TypeLimits) String() string {
+	pairs := make([]string, 0, len(l))
+	for jobType, limit := range l {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", jobType, limit))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l TypeLimits) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("invalid limit %q, expected TYPE=N", pair)
+		}
+		limit, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return errors.Wrapf(err, "invalid limit for type %s", kv[0])
+		}
+		l[kv[0]] = limit
+	}
+	return nil
+}
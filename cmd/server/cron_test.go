@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseCron_Next(t *testing.T) {
+	from := time.Date(2020, time.October, 8, 10, 7, 30, 0, time.UTC) //Thursday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2020, time.October, 8, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, time.October, 8, 10, 15, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2020, time.October, 9, 2, 0, 0, 0, time.UTC)},
+		{"30 9-17 * * 1-5", time.Date(2020, time.October, 8, 10, 30, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2020, time.October, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, time.October, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2020, time.October, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2020, time.October, 8, 10, 25, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, time.November, 1, 0, 0, 0, 0, time.UTC)},
+		//Both day fields restricted: either one matches
+		{"0 0 13 * 5", time.Date(2020, time.October, 9, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		c, err := parseCron(test.expr)
+		if !assert.Nil(t, err, test.expr) {
+			continue
+		}
+		assert.Equal(t, test.want, c.Next(from), test.expr)
+	}
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := parseCron(expr)
+		assert.NotNil(t, err, expr)
+	}
+
+	//February 30th never happens
+	c, err := parseCron("0 0 30 2 *")
+	assert.Nil(t, err)
+	assert.True(t, c.Next(time.Now()).IsZero())
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+//DeadLetterStore keeps the jobs which failed permanently or ran out of leases, in the order they were dead-lettered.
+//They are kept out of the main list so GetJobs and Dequeue never walk them.
+type DeadLetterStore struct {
+	items []*job
+	m     map[int]*job
+	mutex sync.Mutex
+}
+
+func NewDeadLetterStore() *DeadLetterStore {
+	return &DeadLetterStore{items: make([]*job, 0), m: make(map[int]*job)}
+}
+
+//Add stores a copy of the job.
+func (d *DeadLetterStore) Add(item job) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.items = append(d.items, &item)
+	d.m[item.Id] = &item
+}
+
+//Get returns a copy of the dead-lettered job.
+func (d *DeadLetterStore) Get(jobID int) (*job, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	item, ok := d.m[jobID]
+	if !ok {
+		return nil, errors.New("JobId not present in the dead-letter queue")
+	}
+	details := *item
+	return &details, nil
+}
+
+//List returns copies of all the dead-lettered jobs, oldest first.
+func (d *DeadLetterStore) List() []job {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	arr := make([]job, 0, len(d.items))
+	for _, item := range d.items {
+		arr = append(arr, *item)
+	}
+	return arr
+}
+
+//Take removes the job from the store and returns it.
+func (d *DeadLetterStore) Take(jobID int) (*job, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	item, ok := d.m[jobID]
+	if !ok {
+		return nil, errors.New("JobId not present in the dead-letter queue")
+	}
+	delete(d.m, jobID)
+	for index, other := range d.items {
+		if other == item {
+			d.items = append(d.items[:index], d.items[index+1:]...)
+			break
+		}
+	}
+	return item, nil
+}
+
+//Len returns the number of dead-lettered jobs.
+func (d *DeadLetterStore) Len() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return len(d.items)
+}
+
+//Purge drops every dead-lettered job and returns how many were dropped.
+func (d *DeadLetterStore) Purge() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	purged := len(d.items)
+	d.items = make([]*job, 0)
+	d.m = make(map[int]*job)
+	return purged
+}
+
+//recordAttempt appends the outcome of the current lease to the job history. Caller must hold q.mutex.
+func (q *JobListQueue) recordAttempt(e *Element, outcome string, reason string) {
+	e.Value.Attempts++
+	e.Value.LastError = reason
+	e.Value.History = append(e.Value.History, attempt{
+		ConsumerId: e.Value.ConsumerId,
+		StartedAt:  e.Value.leasedAt,
+		EndedAt:    q.now(),
+		Outcome:    outcome,
+		Error:      reason,
+	})
+}
+
+//deadLetter moves the job from the main list to the dead-letter store. Caller must hold q.mutex.
+func (q *JobListQueue) deadLetter(e *Element, status string) error {
+	if err := q.unlink(e); err != nil {
+		return err
+	}
+	deadLetteredAt := q.now()
+	e.Value.Status = status
+	e.Value.DeadLetteredAt = &deadLetteredAt
+	q.deadLetters.Add(e.Value)
+	q.log.Log("level", "info", "msg", "job dead-lettered", "jobId", e.Value.Id, "status", status, "attempts", e.Value.Attempts)
+	return q.record("deadletter", e)
+}
+
+//ListDeadLetters returns all the dead-lettered jobs, oldest first.
+func (q *JobListQueue) ListDeadLetters() []job {
+	return q.deadLetters.List()
+}
+
+//GetDeadLetter returns the dead-lettered job with its last error and attempt history.
+func (q *JobListQueue) GetDeadLetter(jobID int) (*job, error) {
+	return q.deadLetters.Get(jobID)
+}
+
+//Redrive moves a dead-lettered job back to the end of the queue as QUEUED with a fresh set of attempts.
+//The attempt history is kept.
+func (q *JobListQueue) Redrive(jobID int) (*job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	//The job cannot come back while another job holds its uniqueKey.
+	if dead, err := q.deadLetters.Get(jobID); err == nil && dead.UniqueKey != "" {
+		if _, taken := q.uniqueHolder(dead.UniqueKey); taken {
+			return nil, errUniqueKeyTaken
+		}
+	}
+	item, err := q.deadLetters.Take(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	item.Attempts = 0
+	item.RetryAt = nil
+	item.DeadLetteredAt = nil
+	e := &Element{Value: *item}
+	if err := q.pushBack(e); err != nil {
+		q.deadLetters.Add(*item)
+		return nil, err
+	}
+	q.markReady(e)
+	q.rememberUniqueKey(e)
+	if err := q.record("redrive", e); err != nil {
+		return nil, err
+	}
+
+	details := q.snapshot(e)
+	return &details, nil
+}
+
+//PurgeDeadLetters drops every dead-lettered job and returns how many were dropped.
+func (q *JobListQueue) PurgeDeadLetters() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	purged := q.deadLetters.Purge()
+	q.writeRecord(walRecord{Op: "purge"})
+	return purged
+}
+
+//PurgeDeadLetter drops a single dead-lettered job.
+func (q *JobListQueue) PurgeDeadLetter(jobID int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	_, err := q.deadLetters.Take(jobID)
+	if err != nil {
+		return err
+	}
+	return q.writeRecord(walRecord{Op: "purge", JobId: jobID})
+}
+
+type purgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+func (h *handler) getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	Respond(w, http.StatusOK, h.queueFor(r).ListDeadLetters())
+	return
+}
+
+func (h *handler) getDeadLetter(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["job_id"]
+	if !ok {
+		h.logger.Log("level", "error", "msg", "could not get JobId from the request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	jobID, _ := strconv.Atoi(id)
+	jobDetails, err := h.queueFor(r).GetDeadLetter(jobID)
+	if err != nil {
+		Respond(w, http.StatusNotFound, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, jobDetails)
+	return
+}
+
+func (h *handler) redrive(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["job_id"]
+	if !ok {
+		h.logger.Log("level", "error", "msg", "could not get JobId from the request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	jobID, _ := strconv.Atoi(id)
+	jobDetails, err := h.queueFor(r).Redrive(jobID)
+	if err == errUniqueKeyTaken {
+		Respond(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		Respond(w, http.StatusNotFound, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, jobDetails)
+	return
+}
+
+func (h *handler) purgeDeadLetter(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["job_id"]
+	if !ok {
+		h.logger.Log("level", "error", "msg", "could not get JobId from the request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	jobID, _ := strconv.Atoi(id)
+	err := h.queueFor(r).PurgeDeadLetter(jobID)
+	if err != nil {
+		Respond(w, http.StatusNotFound, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, jobIdResponse{JobId: jobID})
+	return
+}
+
+func (h *handler) purgeDeadLetters(w http.ResponseWriter, r *http.Request) {
+	Respond(w, http.StatusOK, purgeResponse{Purged: h.queueFor(r).PurgeDeadLetters()})
+	return
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestJobListQueue_DeadLetterOnFail(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+
+	item1 := job{Type: "TIME_CRITICAL", MaxAttempts: 1}
+	id1, _ := q.Enqueue(&item1)
+	q.Dequeue("cId1")
+	q.Fail(id1, "cId1", "boom")
+
+	//The job left the main list
+	_, err := q.GetJobs()
+	assert.NotNil(t, err)
+
+	deadLetters := q.ListDeadLetters()
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, id1, deadLetters[0].Id)
+	assert.Equal(t, "FAILED", deadLetters[0].Status)
+	assert.Equal(t, "boom", deadLetters[0].LastError)
+	assert.Equal(t, 1, len(deadLetters[0].History))
+	assert.Equal(t, "cId1", deadLetters[0].History[0].ConsumerId)
+
+	//GetJob still finds the job
+	item, err := q.GetJob(id1)
+	assert.Nil(t, err)
+	assert.Equal(t, "FAILED", item.Status)
+}
+
+func TestJobListQueue_DeadLetterOnLeaseExpiry(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	config.MaxAttempts = 2
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	item1 := job{Type: "NOT_TIME_CRITICAL"}
+	id1, _ := q.Enqueue(&item1)
+
+	q.Dequeue("cId1")
+	now = now.Add(config.LeaseTimeout)
+	q.Dequeue("cId2")
+	now = now.Add(config.LeaseTimeout)
+	_, err := q.Dequeue("cId3")
+	assert.NotNil(t, err)
+
+	item, err := q.GetDeadLetter(id1)
+	assert.Nil(t, err)
+	assert.Equal(t, "EXPIRED", item.Status)
+	assert.Equal(t, 2, item.Attempts)
+	assert.Equal(t, "LEASE_EXPIRED", item.History[1].Outcome)
+	assert.Equal(t, "cId2", item.History[1].ConsumerId)
+}
+
+func TestJobListQueue_Redrive(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+
+	item1 := job{Type: "TIME_CRITICAL", MaxAttempts: 1}
+	id1, _ := q.Enqueue(&item1)
+	q.Dequeue("cId1")
+	q.Fail(id1, "cId1", "boom")
+
+	item, err := q.Redrive(id1)
+	assert.Nil(t, err)
+	assert.Equal(t, "QUEUED", item.Status)
+	assert.Equal(t, 0, item.Attempts)
+	assert.Equal(t, 0, len(q.ListDeadLetters()))
+
+	item, err = q.Dequeue("cId2")
+	assert.Nil(t, err)
+	assert.Equal(t, id1, item.Id)
+	assert.Equal(t, 1, len(item.History))
+
+	_, err = q.Redrive(id1)
+	assert.NotNil(t, err)
+}
+
+func TestJobListQueue_PurgeDeadLetters(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+
+	for i := 0; i < 3; i++ {
+		item := job{Type: "TIME_CRITICAL", MaxAttempts: 1}
+		id, _ := q.Enqueue(&item)
+		q.Dequeue("cId1")
+		q.Fail(id, "cId1", "boom")
+	}
+	deadLetters := q.ListDeadLetters()
+	assert.Nil(t, q.PurgeDeadLetter(deadLetters[0].Id))
+	assert.NotNil(t, q.PurgeDeadLetter(deadLetters[0].Id))
+	assert.Equal(t, 2, q.PurgeDeadLetters())
+	assert.Equal(t, 0, len(q.ListDeadLetters()))
+}
+
+func TestDeadLetterHandlers(t *testing.T) {
+	q := NewLinkedListQueue(log.NewNopLogger())
+	item1 := job{Type: "TIME_CRITICAL", MaxAttempts: 1}
+	id1, _ := q.Enqueue(&item1)
+	q.Dequeue("cId1")
+	q.Fail(id1, "cId1", "boom")
+
+	h := newHandler(q, log.NewNopLogger())
+
+	rr, _ := do(h, http.MethodGet, "/deadletters", http.Header{}, nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	var deadLetters []job
+	err := json.Unmarshal(rr.Body.Bytes(), &deadLetters)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if len(deadLetters) != 1 || deadLetters[0].Id != id1 {
+		t.Errorf("got %v want job %v", deadLetters, id1)
+	}
+
+	url := fmt.Sprintf("/deadletters/%s/redrive", strconv.Itoa(id1))
+	rr, _ = do(h, http.MethodPost, url, http.Header{}, nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	//Already redriven
+	rr, _ = do(h, http.MethodPost, url, http.Header{}, nil)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+//delayedJob is an entry of the delay heap. The job becomes QUEUED once due has passed.
+type delayedJob struct {
+	due     time.Time
+	element *Element
+}
+
+//delayHeap is a min-heap on the due time of SCHEDULED and RETRY_PENDING jobs, so the reaper only looks at the
+//jobs which are due instead of walking the whole list.
+//Entries are not removed when their job leaves the queue, promoteDue skips them instead.
+type delayHeap []delayedJob
+
+func (d delayHeap) Len() int            { return len(d) }
+func (d delayHeap) Less(i, j int) bool  { return d[i].due.Before(d[j].due) }
+func (d delayHeap) Swap(i, j int)       { d[i], d[j] = d[j], d[i] }
+func (d *delayHeap) Push(x interface{}) { *d = append(*d, x.(delayedJob)) }
+func (d *delayHeap) Pop() interface{} {
+	old := *d
+	n := len(old)
+	item := old[n-1]
+	*d = old[:n-1]
+	return item
+}
+
+//delay keeps the job invisible to Dequeue until due. Caller must hold q.mutex.
+func (q *JobListQueue) delay(e *Element, status string, due time.Time) {
+	e.Value.Status = status
+	heap.Push(&q.delayed, delayedJob{due: due, element: e})
+}
+
+//stillDelayed reports whether the job of a delay heap entry is still in the queue and waiting, jobs which were removed,
+//dead-lettered or promoted since they were delayed are skipped. Caller must hold q.mutex.
+func (q *JobListQueue) stillDelayed(e *Element) bool {
+	if current, ok := q.store.Get(e.Value.Id); !ok || current != e {
+		return false
+	}
+	return e.Value.Status == "SCHEDULED" || e.Value.Status == "RETRY_PENDING"
+}
+
+//nextDue returns when the first delayed job becomes due, dropping the stale entries in front of it.
+//Caller must hold q.mutex.
+func (q *JobListQueue) nextDue() (time.Time, bool) {
+	for q.delayed.Len() > 0 {
+		if q.stillDelayed(q.delayed[0].element) {
+			return q.delayed[0].due, true
+		}
+		heap.Pop(&q.delayed)
+	}
+	return time.Time{}, false
+}
+
+//promoteDue moves SCHEDULED and RETRY_PENDING jobs which are due to QUEUED. Caller must hold q.mutex.
+func (q *JobListQueue) promoteDue() {
+	now := q.now()
+	for q.delayed.Len() > 0 && !now.Before(q.delayed[0].due) {
+		entry := heap.Pop(&q.delayed).(delayedJob)
+		e := entry.element
+		if !q.stillDelayed(e) {
+			continue
+		}
+		e.Value.RetryAt = nil
+		q.markReady(e)
+		q.record("promote", e)
+	}
+}
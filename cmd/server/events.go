@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//eventBacklog is the number of recent events kept for the subscribers resuming with Last-Event-ID.
+const eventBacklog = 10000
+
+//subscriberBuffer is the number of events a subscriber can fall behind by before it is disconnected.
+//It resumes from the backlog when it reconnects.
+const subscriberBuffer = 256
+
+//eventKeepAlive is how often a comment is sent on an idle feed, so proxies do not close it.
+const eventKeepAlive = 15 * time.Second
+
+//jobEvent is a change to a job, named after the op of the write-ahead log record it caused. Status is the status of
+//the job after the change, CANCELLED or REMOVED for the jobs which were taken out of the queue.
+type jobEvent struct {
+	Id         uint64    `json:"id"`
+	Event      string    `json:"event"`
+	Queue      string    `json:"queue"`
+	JobId      int       `json:"jobId"`
+	Type       string    `json:"type"`
+	Status     string    `json:"status"`
+	ConsumerId string    `json:"consumerId,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+//eventFilter selects the events a subscriber gets. An empty set lets everything through.
+type eventFilter struct {
+	queues   map[string]bool
+	types    map[string]bool
+	statuses map[string]bool
+}
+
+func (f eventFilter) matches(event jobEvent) bool {
+	return matchesSet(f.queues, event.Queue) && matchesSet(f.types, event.Type) && matchesSet(f.statuses, event.Status)
+}
+
+func matchesSet(set map[string]bool, value string) bool {
+	return len(set) == 0 || set[value]
+}
+
+//EventHub hands the job events of all the queues of a registry to the subscribers of GET /events.
+//Event ids start from the clock in microseconds, so an id of an earlier run of the server is older than every event
+//of this one, and they stay exact as JSON numbers in JavaScript.
+type EventHub struct {
+	mutex       sync.Mutex
+	lastId      uint64
+	backlog     []jobEvent
+	next        int
+	subscribers map[*eventSubscriber]bool
+}
+
+type eventSubscriber struct {
+	events chan jobEvent
+	filter eventFilter
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		lastId:      uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+		backlog:     make([]jobEvent, 0, eventBacklog),
+		subscribers: make(map[*eventSubscriber]bool),
+	}
+}
+
+//Publish numbers the event, keeps it in the backlog and hands it to the subscribers. A subscriber which fell too
+//far behind is disconnected instead of holding up the queues.
+func (h *EventHub) Publish(event jobEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.lastId++
+	event.Id = h.lastId
+	if len(h.backlog) < eventBacklog {
+		h.backlog = append(h.backlog, event)
+	} else {
+		h.backlog[h.next] = event
+		h.next = (h.next + 1) % eventBacklog
+	}
+	for s := range h.subscribers {
+		if !s.filter.matches(event) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			delete(h.subscribers, s)
+			close(s.events)
+		}
+	}
+}
+
+//Subscribe returns the events of the backlog after lastId which match the filter, and the subscriber getting the
+//events published from now on. A lastId of 0 replays nothing.
+func (h *EventHub) Subscribe(filter eventFilter, lastId uint64) ([]jobEvent, *eventSubscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var missed []jobEvent
+	if lastId > 0 {
+		for i := range h.backlog {
+			event := h.backlog[(h.next+i)%len(h.backlog)]
+			if event.Id > lastId && filter.matches(event) {
+				missed = append(missed, event)
+			}
+		}
+	}
+	s := &eventSubscriber{events: make(chan jobEvent, subscriberBuffer), filter: filter}
+	h.subscribers[s] = true
+	return missed, s
+}
+
+//Unsubscribe stops handing events to the subscriber.
+func (h *EventHub) Unsubscribe(s *eventSubscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.subscribers[s] {
+		delete(h.subscribers, s)
+		close(s.events)
+	}
+}
+
+//queueEvents publishes the events of a single queue to the hub of its registry.
+type queueEvents struct {
+	hub  *EventHub
+	name string
+}
+
+//publish turns the change recorded as op into an event. Heartbeats only extend leases and are left out.
+func (e queueEvents) publish(op string, item job, at time.Time) {
+	if e.hub == nil || op == "heartbeat" {
+		return
+	}
+	status := item.Status
+	consumerId := item.ConsumerId
+	switch op {
+	case "conclude", "fail", "expire", "deadletter":
+		consumerId = item.releasedBy
+	//The job is gone, it keeps the status it had.
+	case "cancel":
+		status = "CANCELLED"
+	case "remove":
+		status = "REMOVED"
+	}
+	e.hub.Publish(jobEvent{
+		Event:      op,
+		Queue:      e.name,
+		JobId:      item.Id,
+		Type:       item.Type,
+		Status:     status,
+		ConsumerId: consumerId,
+		Time:       at,
+	})
+}
+
+func (h *handler) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		Respond(w, http.StatusNotImplemented, "Streaming the events is not supported by this node")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := eventFilter{
+		queues:   setOf(query.Get("queue")),
+		types:    setOf(query.Get("type")),
+		statuses: setOf(query.Get("status")),
+	}
+	var lastId uint64
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			Respond(w, http.StatusBadRequest, "Last-Event-ID must be the id of an event")
+			return
+		}
+		lastId = id
+	}
+
+	missed, subscriber := h.queues.Events().Subscribe(filter, lastId)
+	defer h.queues.Events().Unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range missed {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-subscriber.events:
+			//The subscriber fell behind, the client reconnects and resumes from the backlog.
+			if !ok {
+				return
+			}
+			writeEvent(w, event)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+//writeEvent writes the event in the text/event-stream format, named after its op.
+func writeEvent(w http.ResponseWriter, event jobEvent) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Event, data)
+}
+
+//setOf splits a comma separated filter.
+func setOf(value string) map[string]bool {
+	if value == "" {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		set[strings.TrimSpace(item)] = true
+	}
+	return set
+}
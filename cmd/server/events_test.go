@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//readEvents reads n events of the text/event-stream.
+func readEvents(t *testing.T, reader *bufio.Reader, n int) []jobEvent {
+	var events []jobEvent
+	var id, name string
+	for len(events) < n {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var event jobEvent
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+			assert.Equal(t, strconv.FormatUint(event.Id, 10), id)
+			assert.Equal(t, event.Event, name)
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func openEvents(t *testing.T, url string, lastEventId string) *http.Response {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	return res
+}
+
+func TestHandler_Events(t *testing.T) {
+	h, registry := newTestRegistryHandler()
+	defer registry.Close()
+	server := httptest.NewServer(newRouter(&h))
+	defer server.Close()
+
+	res := openEvents(t, server.URL+"/events?queue=default&type=TIME_CRITICAL,REINDEX", "")
+	defer res.Body.Close()
+	reader := bufio.NewReader(res.Body)
+
+	q := registry.Default()
+	q.Enqueue(&job{Type: "NOT_TIME_CRITICAL"})
+	emails, _ := registry.Get("emails")
+	emails.Enqueue(&job{Type: "TIME_CRITICAL"})
+	id, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	q.Dequeue("cId1")
+	q.Conclude(id, "cId1")
+	cancelled, _ := q.Enqueue(&job{Type: "REINDEX"})
+	q.Cancel(cancelled)
+
+	events := readEvents(t, reader, 5)
+	assert.Equal(t, []string{"enqueue", "dequeue", "conclude", "enqueue", "cancel"}, []string{
+		events[0].Event, events[1].Event, events[2].Event, events[3].Event, events[4].Event,
+	})
+	for i, event := range events[:3] {
+		assert.Equal(t, "default", event.Queue)
+		assert.Equal(t, id, event.JobId)
+		assert.Equal(t, "TIME_CRITICAL", event.Type)
+		if i > 0 {
+			assert.True(t, event.Id > events[i-1].Id)
+		}
+	}
+	assert.Equal(t, "QUEUED", events[0].Status)
+	assert.Equal(t, "", events[0].ConsumerId)
+	assert.Equal(t, "IN_PROGRESS", events[1].Status)
+	assert.Equal(t, "cId1", events[1].ConsumerId)
+	assert.Equal(t, "CONCLUDED", events[2].Status)
+	assert.Equal(t, "cId1", events[2].ConsumerId)
+	assert.Equal(t, cancelled, events[4].JobId)
+
+	//A client which reconnects gets the events it missed.
+	resumed := openEvents(t, server.URL+"/events?status=CONCLUDED,CANCELLED", strconv.FormatUint(events[0].Id, 10))
+	defer resumed.Body.Close()
+	missed := readEvents(t, bufio.NewReader(resumed.Body), 2)
+	assert.Equal(t, events[2].Id, missed[0].Id)
+	assert.Equal(t, events[4].Id, missed[1].Id)
+}
+
+func TestEventHub_SlowSubscriber(t *testing.T) {
+	hub := NewEventHub()
+	_, slow := hub.Subscribe(eventFilter{}, 0)
+	_, filtered := hub.Subscribe(eventFilter{queues: setOf("emails")}, 0)
+	for i := 0; i <= subscriberBuffer; i++ {
+		hub.Publish(jobEvent{Event: "enqueue", Queue: "default", JobId: i})
+	}
+
+	//The subscriber which fell behind is disconnected, the one whose filter let nothing through is not.
+	received := 0
+	for range slow.events {
+		received++
+	}
+	assert.Equal(t, subscriberBuffer, received)
+	hub.Publish(jobEvent{Event: "enqueue", Queue: "emails", JobId: 1})
+	event := <-filtered.events
+	assert.Equal(t, "emails", event.Queue)
+	hub.Unsubscribe(filtered)
+	hub.Unsubscribe(slow)
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+//A fileStore is compacted once it holds more than compactMinGarbage stale records, and more stale than live ones.
+const compactMinGarbage = 1000
+
+//fileRecord is a single line of a fileStore: the state of a job after a change, or its removal. The settings,
+//dead letters, idempotency keys and schedules of the queue are kept the same way.
+type fileRecord struct {
+	Op         string          `json:"op"`
+	JobId      int             `json:"jobId"`
+	Job        *jobSnapshot    `json:"job,omitempty"`
+	Config     *queueSettings  `json:"config,omitempty"`
+	Key        *idempotencyKey `json:"key,omitempty"`
+	ScheduleId int             `json:"scheduleId,omitempty"`
+	Schedule   *schedule       `json:"schedule,omitempty"`
+}
+
+//fileStore keeps the jobs of a queue in memory like a listStore, and every change to them in an append-only file.
+//Each line is a put of the whole job or a delete, so loading the file replays them and the first put of a job
+//decides its position. Stale records are dropped by rewriting the file once they outnumber the live ones.
+//Every change is synced to disk before it returns.
+type fileStore struct {
+	list        *listStore
+	config      *queueSettings
+	deadLetters *DeadLetterStore
+	keys        map[string]idempotencyKey
+	schedules   map[int]schedule
+	file        *os.File
+	path        string
+	records     int
+}
+
+//OpenFileStore opens or creates the store at path and loads the jobs in it. A record torn by a crash at the end
+//of the file is cut off, a corrupt record anywhere else is an error.
+func OpenFileStore(path string) (*fileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open store")
+	}
+	s := &fileStore{
+		list:        newListStore(),
+		deadLetters: NewDeadLetterStore(),
+		keys:        make(map[string]idempotencyKey),
+		schedules:   make(map[int]schedule),
+		file:        file,
+		path:        path,
+	}
+	err = s.load()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileStore) load() error {
+	reader := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return s.truncate(offset)
+			}
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read store")
+		}
+
+		var record fileRecord
+		if decodeErr := decodeLine(line, &record); decodeErr != nil {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				return s.truncate(offset)
+			}
+			return errors.Wrapf(decodeErr, "corrupt store record at offset %d", offset)
+		}
+		s.apply(record)
+		s.records++
+		offset += int64(len(line))
+	}
+
+	_, err := s.file.Seek(0, io.SeekEnd)
+	return err
+}
+
+//apply loads a record into the list, or into the state of the queue.
+func (s *fileStore) apply(record fileRecord) {
+	switch record.Op {
+	case "configure":
+		s.config = record.Config
+		return
+	case "deadletter":
+		if record.Job != nil {
+			s.deadLetters.Take(record.JobId)
+			s.deadLetters.Add(record.Job.Job)
+		}
+		return
+	case "purge":
+		if record.JobId == 0 {
+			s.deadLetters.Purge()
+		} else {
+			s.deadLetters.Take(record.JobId)
+		}
+		return
+	case "idempotencyKey":
+		if record.Key != nil {
+			s.keys[record.Key.Key] = *record.Key
+		}
+		return
+	case "saveSchedule":
+		if record.Schedule != nil {
+			s.schedules[record.ScheduleId] = *record.Schedule
+		}
+		return
+	case "deleteSchedule":
+		delete(s.schedules, record.ScheduleId)
+		return
+	}
+
+	e, ok := s.list.Get(record.JobId)
+	if record.Op == "delete" {
+		if ok {
+			s.list.Remove(e)
+		}
+		return
+	}
+	if record.Job == nil {
+		return
+	}
+
+	if !ok {
+		e = &Element{Value: record.Job.Job}
+		s.list.Append(e)
+	}
+	e.Value = record.Job.Job
+	e.readyAt = time.Time{}
+	if record.Job.ReadyAt != nil {
+		e.readyAt = *record.Job.ReadyAt
+	}
+	if record.Job.LeasedAt != nil {
+		e.Value.leasedAt = *record.Job.LeasedAt
+	}
+}
+
+func (s *fileStore) truncate(offset int64) error {
+	err := s.file.Truncate(offset)
+	if err != nil {
+		return errors.Wrap(err, "failed to cut off torn store record")
+	}
+	_, err = s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+//write appends the record and syncs it, then compacts the file if it is mostly stale records.
+func (s *fileStore) write(record fileRecord) error {
+	line, err := encodeLine(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode store record")
+	}
+	_, err = s.file.Write(line)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write store record")
+	}
+	s.records++
+
+	live := s.live()
+	garbage := s.records - live
+	if garbage > compactMinGarbage && garbage > live {
+		return s.compact()
+	}
+	return nil
+}
+
+//live returns the number of records a compacted file holds.
+func (s *fileStore) live() int {
+	n := s.list.Len() + s.deadLetters.Len() + len(s.keys) + len(s.schedules)
+	if s.config != nil {
+		n++
+	}
+	return n
+}
+
+//liveRecords returns the records of a compacted file: the settings, a single put per job in list order, the dead
+//letters, the unexpired idempotency keys and the schedules.
+func (s *fileStore) liveRecords() []fileRecord {
+
+	records := make([]fileRecord, 0, s.live())
+	if s.config != nil {
+		records = append(records, fileRecord{Op: "configure", Config: s.config})
+	}
+	s.list.Each(func(e *Element) bool {
+		js := snapshotOf(e)
+		records = append(records, fileRecord{Op: "put", JobId: e.Value.Id, Job: &js})
+		return true
+	})
+	for _, item := range s.deadLetters.List() {
+		records = append(records, fileRecord{Op: "deadletter", JobId: item.Id, Job: &jobSnapshot{Job: item}})
+	}
+	for _, entry := range s.unexpiredKeys() {
+		entry := entry
+		records = append(records, fileRecord{Op: "idempotencyKey", Key: &entry})
+	}
+	for _, sc := range s.sortedSchedules() {
+		sc := sc
+		records = append(records, fileRecord{Op: "saveSchedule", ScheduleId: sc.Id, Schedule: &sc})
+	}
+	return records
+}
+
+//compact rewrites the file with the live records and atomically replaces the old file. The expired idempotency keys
+//are dropped.
+func (s *fileStore) compact() error {
+	now := time.Now()
+	for key, entry := range s.keys {
+		if !now.Before(entry.Expires) {
+			delete(s.keys, key)
+		}
+	}
+
+	compactPath := s.path + ".compact"
+	file, err := os.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to compact store")
+	}
+	writer := bufio.NewWriter(file)
+	records := s.liveRecords()
+	for _, record := range records {
+		var line []byte
+		line, err = encodeLine(record)
+		if err == nil {
+			_, err = writer.Write(line)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(compactPath, s.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(compactPath)
+		return errors.Wrap(err, "failed to compact store")
+	}
+	syncDir(s.path)
+
+	s.file.Close()
+	s.file = file
+	s.records = len(records)
+	return nil
+}
+
+func (s *fileStore) put(e *Element) error {
+	js := snapshotOf(e)
+	return s.write(fileRecord{Op: "put", JobId: e.Value.Id, Job: &js})
+}
+
+func (s *fileStore) Append(e *Element) error {
+	if err := s.list.Append(e); err != nil {
+		return err
+	}
+	err := s.put(e)
+	if err != nil {
+		s.list.Remove(e)
+	}
+	return err
+}
+
+func (s *fileStore) Save(e *Element) error {
+	if current, ok := s.list.Get(e.Value.Id); !ok || current != e {
+		return nil
+	}
+	return s.put(e)
+}
+
+func (s *fileStore) Remove(e *Element) error {
+	if current, ok := s.list.Get(e.Value.Id); !ok || current != e {
+		return nil
+	}
+	s.list.Remove(e)
+	return s.write(fileRecord{Op: "delete", JobId: e.Value.Id})
+}
+
+func (s *fileStore) Get(jobID int) (*Element, bool) {
+	return s.list.Get(jobID)
+}
+
+func (s *fileStore) First() *Element {
+	return s.list.First()
+}
+
+func (s *fileStore) Each(fn func(e *Element) bool) {
+	s.list.Each(fn)
+}
+
+func (s *fileStore) Len() int {
+	return s.list.Len()
+}
+
+func (s *fileStore) SaveConfig(settings queueSettings) error {
+	if err := s.write(fileRecord{Op: "configure", Config: &settings}); err != nil {
+		return err
+	}
+	s.config = &settings
+	return nil
+}
+
+func (s *fileStore) SaveDeadLetter(item job) error {
+	if err := s.write(fileRecord{Op: "deadletter", JobId: item.Id, Job: &jobSnapshot{Job: item}}); err != nil {
+		return err
+	}
+	s.deadLetters.Take(item.Id)
+	s.deadLetters.Add(item)
+	return nil
+}
+
+func (s *fileStore) RemoveDeadLetter(jobID int) error {
+	if err := s.write(fileRecord{Op: "purge", JobId: jobID}); err != nil {
+		return err
+	}
+	if jobID == 0 {
+		s.deadLetters.Purge()
+	} else {
+		s.deadLetters.Take(jobID)
+	}
+	return nil
+}
+
+func (s *fileStore) SaveSchedule(sc schedule) error {
+	if err := s.write(fileRecord{Op: "saveSchedule", ScheduleId: sc.Id, Schedule: &sc}); err != nil {
+		return err
+	}
+	s.schedules[sc.Id] = sc
+	return nil
+}
+
+func (s *fileStore) RemoveSchedule(id int) error {
+	if err := s.write(fileRecord{Op: "deleteSchedule", ScheduleId: id}); err != nil {
+		return err
+	}
+	delete(s.schedules, id)
+	return nil
+}
+
+func (s *fileStore) SaveIdempotencyKey(entry idempotencyKey) error {
+	if err := s.write(fileRecord{Op: "idempotencyKey", Key: &entry}); err != nil {
+		return err
+	}
+	s.keys[entry.Key] = entry
+	return nil
+}
+
+func (s *fileStore) State() queueState {
+	return queueState{
+		Config:          s.config,
+		DeadLetters:     s.deadLetters.List(),
+		Schedules:       s.sortedSchedules(),
+		IdempotencyKeys: s.unexpiredKeys(),
+	}
+}
+
+//unexpiredKeys returns the idempotency keys which did not expire yet, ordered by key.
+func (s *fileStore) unexpiredKeys() []idempotencyKey {
+	now := time.Now()
+	keys := make([]idempotencyKey, 0, len(s.keys))
+	for _, entry := range s.keys {
+		if now.Before(entry.Expires) {
+			keys = append(keys, entry)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	return keys
+}
+
+//sortedSchedules returns the schedules ordered by id.
+func (s *fileStore) sortedSchedules() []schedule {
+	schedules := make([]schedule, 0, len(s.schedules))
+	for _, sc := range s.schedules {
+		schedules = append(schedules, sc)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Id < schedules[j].Id })
+	return schedules
+}
+
+func (s *fileStore) Close() error {
+	return s.file.Close()
+}
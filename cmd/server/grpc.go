@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//grpcService prefixes the paths of the methods of the Queue service of api/queue.proto.
+const grpcService = "/queue.v1.Queue/"
+
+//maxGRPCMessage bounds a request message, as the default of the gRPC libraries does.
+const maxGRPCMessage = 4 << 20
+
+//grpcShutdownTimeout is how long the gRPC server waits for its calls, streams mostly, before it drops them.
+const grpcShutdownTimeout = 5 * time.Second
+
+//Status codes of gRPC.
+const (
+	grpcOK                = 0
+	grpcCanceled          = 1
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcNotFound          = 5
+	grpcAlreadyExists     = 6
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+)
+
+var (
+	errInvalidPayload = errors.New("payload must be a JSON document")
+	errInvalidResult  = errors.New("result must be a JSON document")
+	errStreamMax      = errors.New("max cannot be negative")
+)
+
+//grpcError is an error answered with its own gRPC status code.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+//GRPCServer serves the queues of a registry with the Queue service of api/queue.proto. It implements the gRPC
+//protocol over the HTTP/2 of net/http, so it has to be served with unencrypted HTTP/2 enabled. Messages are not
+//compressed.
+type GRPCServer struct {
+	queues *Registry
+	log    log.Logger
+}
+
+func NewGRPCServer(queues *Registry, logger log.Logger) *GRPCServer {
+	return &GRPCServer{queues: queues, log: logger}
+}
+
+//dequeueRequest is the DequeueRequest of both Dequeue and DequeueStream.
+type dequeueRequest struct {
+	queue      string
+	consumerId string
+	max        int
+	wait       time.Duration
+}
+
+func (s *GRPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if r.ProtoMajor != 2 || r.Method != http.MethodPost || (contentType != "application/grpc" && contentType != "application/grpc+proto") {
+		Respond(w, http.StatusUnsupportedMediaType, "gRPC calls are HTTP/2 POST requests of application/grpc")
+		return
+	}
+
+	//The status is sent in the trailers, after the messages.
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	code, message := grpcOK, ""
+	if err := s.call(w, r); err != nil {
+		code, message = grpcStatus(err)
+		if code == grpcInternal {
+			s.log.Log("level", "error", "msg", "gRPC call failed", "method", r.URL.Path, "error", message)
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", grpcPercentEncode(message))
+	}
+}
+
+//call reads the request message and runs the method named by the path.
+func (s *GRPCServer) call(w http.ResponseWriter, r *http.Request) error {
+	request, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	ctx := r.Context()
+	switch strings.TrimPrefix(r.URL.Path, grpcService) {
+	case "Enqueue":
+		return s.unary(ctx, w, request, s.enqueue)
+	case "Dequeue":
+		return s.unary(ctx, w, request, s.dequeue)
+	case "DequeueStream":
+		return s.dequeueStream(ctx, w, request)
+	case "Conclude":
+		return s.unary(ctx, w, request, s.conclude)
+	case "GetJob":
+		return s.unary(ctx, w, request, s.getJob)
+	case "ListJobs":
+		return s.unary(ctx, w, request, s.listJobs)
+	case "Remove":
+		return s.unary(ctx, w, request, s.remove)
+	}
+	return &grpcError{code: grpcUnimplemented, message: "unknown method " + r.URL.Path}
+}
+
+//unary answers the request with the single message returned by the method.
+func (s *GRPCServer) unary(ctx context.Context, w http.ResponseWriter, request []byte, method func(context.Context, []byte) ([]byte, error)) error {
+	response, err := method(ctx, request)
+	if err != nil {
+		return err
+	}
+	return writeGRPCMessage(w, response)
+}
+
+//queue returns the named queue, the default one when the name is empty.
+func (s *GRPCServer) queue(name string) (*JobListQueue, error) {
+	if name == "" {
+		return s.queues.Default(), nil
+	}
+	return s.queues.Get(name)
+}
+
+func (s *GRPCServer) enqueue(ctx context.Context, request []byte) ([]byte, error) {
+	var queueName, key string
+	var item job
+	err := readMessage(request, func(r *protoReader, field int) (err error) {
+		switch field {
+		case 1:
+			queueName, err = r.string()
+		case 2:
+			err = r.message(item.readProto)
+		case 3:
+			key, err = r.string()
+		default:
+			err = r.skip()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(item.Payload) > 0 && !json.Valid(item.Payload) {
+		return nil, errInvalidPayload
+	}
+	if err := resolveDelay(&item); err != nil {
+		return nil, err
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, errIdempotencyKeyTooLong
+	}
+	q, err := s.queue(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	jobId, outcome, err := q.EnqueueWithKey(&item, key)
+	if err != nil {
+		return nil, err
+	}
+	var w protoWriter
+	w.int(1, int64(jobId))
+	w.bool(2, outcome == outcomeReplayed)
+	w.bool(3, outcome == outcomeExisting)
+	return w.buf, nil
+}
+
+func (s *GRPCServer) dequeue(ctx context.Context, request []byte) ([]byte, error) {
+	req, err := readDequeueRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if req.max == 0 {
+		req.max = 1
+	}
+	if req.max < 1 || req.max > maxBatchSize {
+		return nil, errDequeueMax
+	}
+	q, err := s.queue(req.queue)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []job
+	if req.wait > 0 {
+		jobs, err = q.DequeueWait(ctx, req.consumerId, req.max, req.wait)
+	} else {
+		jobs, err = q.DequeueBatch(req.consumerId, req.max)
+	}
+	//No job is not an error here, the response lists none.
+	switch err {
+	case errWaitElapsed, errQueueEmpty, errNoJobAvailable:
+		jobs, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return writeJobs(jobs), nil
+}
+
+//dequeueStream sends the jobs one by one as they are leased to the consumer.
+func (s *GRPCServer) dequeueStream(ctx context.Context, w http.ResponseWriter, request []byte) error {
+	req, err := readDequeueRequest(request)
+	if err != nil {
+		return err
+	}
+	if req.max < 0 {
+		return errStreamMax
+	}
+	q, err := s.queue(req.queue)
+	if err != nil {
+		return err
+	}
+
+	wait := req.wait
+	if wait == 0 {
+		wait = maxDequeueWait
+	}
+	for sent := 0; req.max == 0 || sent < req.max; {
+		jobs, err := q.DequeueWait(ctx, req.consumerId, 1, wait)
+		if err == errWaitElapsed {
+			//Without a wait of its own the stream keeps waiting.
+			if req.wait == 0 {
+				continue
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeGRPCMessage(w, writeJob(&jobs[0])); err != nil {
+			return err
+		}
+		sent++
+	}
+	return nil
+}
+
+func (s *GRPCServer) conclude(ctx context.Context, request []byte) ([]byte, error) {
+	var queueName, consumerId string
+	var jobId int64
+	var result []byte
+	err := readMessage(request, func(r *protoReader, field int) (err error) {
+		switch field {
+		case 1:
+			queueName, err = r.string()
+		case 2:
+			jobId, err = r.int()
+		case 3:
+			consumerId, err = r.string()
+		case 4:
+			result, err = r.bytes()
+		default:
+			err = r.skip()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result) > 0 && !json.Valid(result) {
+		return nil, errInvalidResult
+	}
+	q, err := s.queue(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := q.ConcludeWithResult(int(jobId), consumerId, result); err != nil {
+		return nil, err
+	}
+	var w protoWriter
+	w.int(1, jobId)
+	return w.buf, nil
+}
+
+func (s *GRPCServer) getJob(ctx context.Context, request []byte) ([]byte, error) {
+	var queueName string
+	var jobId int64
+	err := readMessage(request, func(r *protoReader, field int) (err error) {
+		switch field {
+		case 1:
+			queueName, err = r.string()
+		case 2:
+			jobId, err = r.int()
+		default:
+			err = r.skip()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	q, err := s.queue(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := q.GetJob(int(jobId))
+	if err != nil {
+		return nil, &grpcError{code: grpcNotFound, message: err.Error()}
+	}
+	return writeJob(item), nil
+}
+
+func (s *GRPCServer) listJobs(ctx context.Context, request []byte) ([]byte, error) {
+	queueName, err := readQueueName(request)
+	if err != nil {
+		return nil, err
+	}
+	q, err := s.queue(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	//GetJobs fails on an empty queue, which lists no jobs here.
+	jobs, err := q.GetJobs()
+	if err != nil {
+		return writeJobs(nil), nil
+	}
+	return writeJobs(*jobs), nil
+}
+
+func (s *GRPCServer) remove(ctx context.Context, request []byte) ([]byte, error) {
+	queueName, err := readQueueName(request)
+	if err != nil {
+		return nil, err
+	}
+	q, err := s.queue(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	jobId, err := q.Remove()
+	if err != nil {
+		if q.Len() == 0 {
+			return nil, &grpcError{code: grpcNotFound, message: err.Error()}
+		}
+		return nil, err
+	}
+	var w protoWriter
+	w.int(1, int64(jobId))
+	return w.buf, nil
+}
+
+func readDequeueRequest(request []byte) (dequeueRequest, error) {
+	var req dequeueRequest
+	err := readMessage(request, func(r *protoReader, field int) (err error) {
+		var v int64
+		switch field {
+		case 1:
+			req.queue, err = r.string()
+		case 2:
+			req.consumerId, err = r.string()
+		case 3:
+			v, err = r.int()
+			req.max = int(int32(v))
+		case 4:
+			req.wait, err = r.duration()
+		default:
+			err = r.skip()
+		}
+		return err
+	})
+	if err == nil && (req.wait < 0 || req.wait > maxDequeueWait) {
+		err = errDequeueWait
+	}
+	return req, err
+}
+
+//readQueueName reads the requests only naming a queue.
+func readQueueName(request []byte) (string, error) {
+	var queueName string
+	err := readMessage(request, func(r *protoReader, field int) (err error) {
+		if field == 1 {
+			queueName, err = r.string()
+			return err
+		}
+		return r.skip()
+	})
+	return queueName, err
+}
+
+//writeJobs encodes the DequeueResponse and ListJobsResponse, which share their layout.
+func writeJobs(jobs []job) []byte {
+	var w protoWriter
+	for i := range jobs {
+		w.message(1, writeJob(&jobs[i]))
+	}
+	return w.buf
+}
+
+func writeJob(item *job) []byte {
+	var w protoWriter
+	w.int(1, int64(item.Id))
+	w.string(2, item.Type)
+	w.string(3, item.Status)
+	if item.Priority != nil {
+		w.presentInt(4, int64(*item.Priority))
+	}
+	w.int(5, int64(item.EffectivePriority))
+	w.string(6, item.ConsumerId)
+	w.timestamp(7, item.LeaseDeadline)
+	w.int(8, int64(item.Progress))
+	w.int(9, int64(item.MaxAttempts))
+	w.int(10, int64(item.Attempts))
+	w.string(11, item.LastError)
+	w.timestamp(12, item.RetryAt)
+	w.timestamp(13, item.DeadLetteredAt)
+	w.string(14, item.UniqueKey)
+	w.string(15, item.UniquePolicy)
+	w.timestamp(16, item.RunAt)
+	w.timestamp(17, item.EnqueuedAt)
+	w.string(18, item.IdempotencyKey)
+	w.int(19, int64(item.DelaySeconds))
+	w.bytes(20, item.Payload)
+	w.bytes(21, item.Result)
+	return w.buf
+}
+
+//readProto reads a field of the Job message into the job.
+func (item *job) readProto(r *protoReader, field int) (err error) {
+	var v int64
+	var data []byte
+	switch field {
+	case 1:
+		v, err = r.int()
+		item.Id = int(v)
+	case 2:
+		item.Type, err = r.string()
+	case 3:
+		item.Status, err = r.string()
+	case 4:
+		v, err = r.int()
+		item.Priority = newPriority(jobPriority(int32(v)))
+	case 5:
+		v, err = r.int()
+		item.EffectivePriority = jobPriority(int32(v))
+	case 6:
+		item.ConsumerId, err = r.string()
+	case 7:
+		item.LeaseDeadline, err = r.timestamp()
+	case 8:
+		v, err = r.int()
+		item.Progress = int(int32(v))
+	case 9:
+		v, err = r.int()
+		item.MaxAttempts = int(int32(v))
+	case 10:
+		v, err = r.int()
+		item.Attempts = int(int32(v))
+	case 11:
+		item.LastError, err = r.string()
+	case 12:
+		item.RetryAt, err = r.timestamp()
+	case 13:
+		item.DeadLetteredAt, err = r.timestamp()
+	case 14:
+		item.UniqueKey, err = r.string()
+	case 15:
+		item.UniquePolicy, err = r.string()
+	case 16:
+		item.RunAt, err = r.timestamp()
+	case 17:
+		item.EnqueuedAt, err = r.timestamp()
+	case 18:
+		item.IdempotencyKey, err = r.string()
+	case 19:
+		v, err = r.int()
+		item.DelaySeconds = int(int32(v))
+	case 20:
+		data, err = r.bytes()
+		item.Payload = json.RawMessage(data)
+	case 21:
+		data, err = r.bytes()
+		item.Result = json.RawMessage(data)
+	default:
+		err = r.skip()
+	}
+	return err
+}
+
+//readGRPCMessage reads a length-prefixed message of the request body.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, &grpcError{code: grpcInternal, message: "missing request message"}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{code: grpcUnimplemented, message: "compressed messages are not supported"}
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxGRPCMessage {
+		return nil, &grpcError{code: grpcResourceExhausted, message: fmt.Sprintf("request message exceeds %d bytes", maxGRPCMessage)}
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, &grpcError{code: grpcInternal, message: "truncated request message"}
+	}
+	return message, nil
+}
+
+//writeGRPCMessage sends an uncompressed length-prefixed message.
+func writeGRPCMessage(w http.ResponseWriter, message []byte) error {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	frame = append(frame, message...)
+	if _, err := w.Write(frame); err != nil {
+		return err
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+//grpcStatus maps an error of a call to the gRPC status answering it, as the HTTP routes map it to a status code.
+func grpcStatus(err error) (int, string) {
+	if e, ok := err.(*grpcError); ok {
+		return e.code, e.message
+	}
+	code := grpcInternal
+	switch err {
+	case context.Canceled:
+		code = grpcCanceled
+	case context.DeadlineExceeded:
+		code = grpcDeadlineExceeded
+	case errProtobuf, errInvalidQueueName, errInvalidUniquePolicy, errRunAtAndDelay, errNegativeDelay, errDequeueMax,
+		errDequeueWait, errStreamMax, errIdempotencyKeyTooLong, errInvalidPayload, errInvalidResult:
+		code = grpcInvalidArgument
+	case errPayloadTooLarge, errResultTooLarge:
+		code = grpcResourceExhausted
+	case errJobIdTaken, errUniqueKeyTaken:
+		code = grpcAlreadyExists
+	case errNotLeaseHolder:
+		code = grpcPermissionDenied
+	}
+	return code, err.Error()
+}
+
+//grpcPercentEncode encodes the Grpc-Message trailer, which is percent-encoded outside of printable ASCII.
+func grpcPercentEncode(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//newTestGRPCServer serves the gRPC API of a registry over unencrypted HTTP/2, and returns a client speaking it.
+func newTestGRPCServer() (*httptest.Server, *http.Client, *Registry) {
+	_, registry := newTestRegistryHandler()
+	server := httptest.NewUnstartedServer(NewGRPCServer(registry, log.NewNopLogger()))
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server.Config.Protocols = &protocols
+	server.Start()
+	return server, &http.Client{Transport: &http.Transport{Protocols: &protocols}}, registry
+}
+
+func openGRPC(t *testing.T, client *http.Client, serverURL string, method string, request []byte) *http.Response {
+	body := make([]byte, 5, 5+len(request))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(request)))
+	body = append(body, request...)
+	req, _ := http.NewRequest(http.MethodPost, serverURL+grpcService+method, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	return res
+}
+
+//callGRPC returns the response messages of the call, and the status code and message of its trailers.
+func callGRPC(t *testing.T, client *http.Client, serverURL string, method string, request []byte) ([][]byte, string, string) {
+	res := openGRPC(t, client, serverURL, method, request)
+	defer res.Body.Close()
+	var messages [][]byte
+	for {
+		message, err := readGRPCMessage(res.Body)
+		if err != nil {
+			break
+		}
+		messages = append(messages, message)
+	}
+	return messages, res.Trailer.Get("Grpc-Status"), res.Trailer.Get("Grpc-Message")
+}
+
+func readTestJob(t *testing.T, message []byte) job {
+	var item job
+	if err := readMessage(message, item.readProto); err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+func readTestJobs(t *testing.T, message []byte) []job {
+	var jobs []job
+	err := readMessage(message, func(r *protoReader, field int) error {
+		var item job
+		err := r.message(item.readProto)
+		jobs = append(jobs, item)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func TestGRPC_Calls(t *testing.T) {
+	server, client, registry := newTestGRPCServer()
+	defer server.Close()
+	defer registry.Close()
+
+	var req protoWriter
+	req.string(1, "emails")
+	req.message(2, writeJob(&job{Type: "TIME_CRITICAL", Payload: json.RawMessage(`{"to":"a@b.c"}`)}))
+	messages, status, _ := callGRPC(t, client, server.URL, "Enqueue", req.buf)
+	assert.Equal(t, "0", status)
+	var jobId int64
+	readMessage(messages[0], func(r *protoReader, field int) (err error) {
+		jobId, err = r.int()
+		return err
+	})
+	emails, _ := registry.Lookup("emails")
+	assert.Equal(t, 1, emails.Len())
+
+	//The default queue is empty.
+	messages, status, _ = callGRPC(t, client, server.URL, "ListJobs", nil)
+	assert.Equal(t, "0", status)
+	assert.Len(t, messages, 1)
+	assert.Empty(t, readTestJobs(t, messages[0]))
+	messages, status, _ = callGRPC(t, client, server.URL, "Dequeue", nil)
+	assert.Equal(t, "0", status)
+	assert.Empty(t, readTestJobs(t, messages[0]))
+
+	req = protoWriter{}
+	req.string(1, "emails")
+	req.string(2, "cId1")
+	messages, status, _ = callGRPC(t, client, server.URL, "Dequeue", req.buf)
+	assert.Equal(t, "0", status)
+	jobs := readTestJobs(t, messages[0])
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, int(jobId), jobs[0].Id)
+	assert.Equal(t, "IN_PROGRESS", jobs[0].Status)
+	assert.Equal(t, "cId1", jobs[0].ConsumerId)
+	assert.NotNil(t, jobs[0].LeaseDeadline)
+	assert.JSONEq(t, `{"to":"a@b.c"}`, string(jobs[0].Payload))
+
+	req = protoWriter{}
+	req.string(1, "emails")
+	req.int(2, jobId)
+	req.string(3, "cId2")
+	_, status, _ = callGRPC(t, client, server.URL, "Conclude", req.buf)
+	assert.Equal(t, "13", status)
+	req = protoWriter{}
+	req.string(1, "emails")
+	req.int(2, jobId)
+	req.string(3, "cId1")
+	req.bytes(4, []byte(`{"sent":true}`))
+	_, status, _ = callGRPC(t, client, server.URL, "Conclude", req.buf)
+	assert.Equal(t, "0", status)
+
+	req = protoWriter{}
+	req.string(1, "emails")
+	req.int(2, jobId)
+	messages, status, _ = callGRPC(t, client, server.URL, "GetJob", req.buf)
+	assert.Equal(t, "0", status)
+	item := readTestJob(t, messages[0])
+	assert.Equal(t, "CONCLUDED", item.Status)
+	assert.JSONEq(t, `{"sent":true}`, string(item.Result))
+
+	req = protoWriter{}
+	req.string(1, "emails")
+	messages, status, _ = callGRPC(t, client, server.URL, "Remove", req.buf)
+	assert.Equal(t, "0", status)
+	assert.Len(t, messages, 1)
+	_, status, _ = callGRPC(t, client, server.URL, "Remove", req.buf)
+	assert.Equal(t, "5", status)
+}
+
+func TestGRPC_Errors(t *testing.T) {
+	server, client, registry := newTestGRPCServer()
+	defer server.Close()
+	defer registry.Close()
+
+	var req protoWriter
+	req.message(2, writeJob(&job{Type: "TIME_CRITICAL", Payload: json.RawMessage(`{"to":`)}))
+	_, status, message := callGRPC(t, client, server.URL, "Enqueue", req.buf)
+	assert.Equal(t, "3", status)
+	assert.Equal(t, errInvalidPayload.Error(), message)
+
+	req = protoWriter{}
+	req.message(2, writeJob(&job{Type: "TIME_CRITICAL", UniqueKey: "k"}))
+	_, status, _ = callGRPC(t, client, server.URL, "Enqueue", req.buf)
+	assert.Equal(t, "0", status)
+	_, status, _ = callGRPC(t, client, server.URL, "Enqueue", req.buf)
+	assert.Equal(t, "6", status)
+
+	req = protoWriter{}
+	req.string(1, "not a queue")
+	_, status, _ = callGRPC(t, client, server.URL, "ListJobs", req.buf)
+	assert.Equal(t, "3", status)
+
+	req = protoWriter{}
+	req.int(2, 42)
+	_, status, message = callGRPC(t, client, server.URL, "GetJob", req.buf)
+	assert.Equal(t, "5", status)
+	assert.Equal(t, "JobId not present in the Queue", message)
+
+	req = protoWriter{}
+	req.int(3, -1)
+	_, status, message = callGRPC(t, client, server.URL, "Dequeue", req.buf)
+	assert.Equal(t, "3", status)
+	assert.Equal(t, "max must be between 1 and 1000", message)
+	_, status, _ = callGRPC(t, client, server.URL, "Enqueue", []byte{0x0A, 0x05})
+	assert.Equal(t, "3", status)
+	_, status, message = callGRPC(t, client, server.URL, "Purge", nil)
+	assert.Equal(t, "12", status)
+	assert.Equal(t, "unknown method /queue.v1.Queue/Purge", message)
+
+	//The message is percent-encoded outside of printable ASCII.
+	assert.Equal(t, "job %C3%A9t%25", grpcPercentEncode("job ét%"))
+}
+
+func TestGRPC_DequeueStream(t *testing.T) {
+	server, client, registry := newTestGRPCServer()
+	defer server.Close()
+	defer registry.Close()
+
+	q := registry.Default()
+	first, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	second, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+
+	var req protoWriter
+	req.string(2, "cId1")
+	req.int(3, 3)
+	res := openGRPC(t, client, server.URL, "DequeueStream", req.buf)
+	defer res.Body.Close()
+	for _, id := range []int{first, second} {
+		message, err := readGRPCMessage(res.Body)
+		assert.NoError(t, err)
+		item := readTestJob(t, message)
+		assert.Equal(t, id, item.Id)
+		assert.Equal(t, "cId1", item.ConsumerId)
+	}
+
+	//A job enqueued while the stream is open is sent right away, and ends the stream at max.
+	third, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	message, err := readGRPCMessage(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, third, readTestJob(t, message).Id)
+	_, err = readGRPCMessage(res.Body)
+	assert.Error(t, err)
+	assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+
+	//With wait the stream ends once no job came.
+	var wait protoWriter
+	wait.int(2, int64(50*time.Millisecond))
+	req = protoWriter{}
+	req.string(2, "cId1")
+	req.message(4, wait.buf)
+	start := time.Now()
+	messages, status, _ := callGRPC(t, client, server.URL, "DequeueStream", req.buf)
+	assert.Equal(t, "0", status)
+	assert.Empty(t, messages)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestProtobuf_Job(t *testing.T) {
+	deadline := time.Date(2020, 5, 1, 10, 0, 0, 123, time.UTC)
+	item := job{
+		Id:            7,
+		Type:          "TIME_CRITICAL",
+		Priority:      newPriority(-3),
+		LeaseDeadline: &deadline,
+		Attempts:      2,
+		Payload:       json.RawMessage(`[1,2]`),
+	}
+	//Fields of a newer version of the message are skipped.
+	data := writeJob(&item)
+	var unknown protoWriter
+	unknown.string(99, "later")
+	unknown.int(98, 1)
+	data = append(data, unknown.buf...)
+
+	assert.Equal(t, item, readTestJob(t, data))
+	var decoded job
+	assert.Equal(t, errProtobuf, readMessage(data[:len(data)-1], decoded.readProto))
+}
@@ -4,11 +4,17 @@ import (
 	"github.com/go-kit/kit/log"
 )
 
+//handler serves the REST API. queue backs the /jobs routes, queues the named queues under /queues when it is set.
 type handler struct {
-	queue  Queue
-	logger log.Logger
+	queue     Queue
+	logger    log.Logger
+	schedules *Scheduler
+	queues    *Registry
+	shards    *Shards
+	//committed waits until the changes made so far are committed, it is set on the nodes of a cluster.
+	committed func() error
 }
 
 func newHandler(queue Queue, log log.Logger) handler {
-	return handler{queue, log}
+	return handler{queue: queue, logger: log}
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"container/heap"
+	"github.com/pkg/errors"
+	"sort"
+	"time"
+)
+
+//idempotencyKeyHeader carries a key chosen by the producer, so a retried enqueue does not create a second job.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+//maxIdempotencyKeyLength bounds the keys kept in memory and in every job.
+const maxIdempotencyKeyLength = 255
+
+var errIdempotencyKeyTooLong = errors.Errorf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+
+//idempotencyKey ties a key to the job first enqueued with it, until the idempotency window after the enqueue passed.
+type idempotencyKey struct {
+	Key     string    `json:"key"`
+	JobId   int       `json:"jobId"`
+	Expires time.Time `json:"expires"`
+}
+
+//keyExpiryHeap is a min-heap on the expiry of the keys, so pruning only looks at the keys which expired.
+//Entries are not removed when their key is taken by a later job, prune skips them instead.
+type keyExpiryHeap []idempotencyKey
+
+func (h keyExpiryHeap) Len() int            { return len(h) }
+func (h keyExpiryHeap) Less(i, j int) bool  { return h[i].Expires.Before(h[j].Expires) }
+func (h keyExpiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyExpiryHeap) Push(x interface{}) { *h = append(*h, x.(idempotencyKey)) }
+func (h *keyExpiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+//idempotencyTable holds the keys apart from the jobs, so a key outlives a job which is removed or dead-lettered
+//within the window. Keys are dropped once they expired.
+type idempotencyTable struct {
+	keys   map[string]idempotencyKey
+	expiry keyExpiryHeap
+}
+
+func newIdempotencyTable() *idempotencyTable {
+	return &idempotencyTable{keys: make(map[string]idempotencyKey)}
+}
+
+//get returns the unexpired entry of the key.
+func (t *idempotencyTable) get(key string, now time.Time) (idempotencyKey, bool) {
+	entry, ok := t.keys[key]
+	if !ok || !now.Before(entry.Expires) {
+		return idempotencyKey{}, false
+	}
+	return entry, true
+}
+
+//put adds the entry unless the key is held until later already, and drops the keys which expired.
+func (t *idempotencyTable) put(entry idempotencyKey, now time.Time) {
+	t.prune(now)
+	if !now.Before(entry.Expires) {
+		return
+	}
+	if existing, ok := t.keys[entry.Key]; ok && !existing.Expires.Before(entry.Expires) {
+		return
+	}
+	t.keys[entry.Key] = entry
+	heap.Push(&t.expiry, entry)
+}
+
+//prune drops the keys which expired by now.
+func (t *idempotencyTable) prune(now time.Time) {
+	for t.expiry.Len() > 0 && !now.Before(t.expiry[0].Expires) {
+		entry := heap.Pop(&t.expiry).(idempotencyKey)
+		if current, ok := t.keys[entry.Key]; ok && current == entry {
+			delete(t.keys, entry.Key)
+		}
+	}
+}
+
+//list returns the unexpired keys ordered by key.
+func (t *idempotencyTable) list(now time.Time) []idempotencyKey {
+	arr := make([]idempotencyKey, 0, len(t.keys))
+	for _, entry := range t.keys {
+		if now.Before(entry.Expires) {
+			arr = append(arr, entry)
+		}
+	}
+	sort.Slice(arr, func(i, j int) bool { return arr[i].Key < arr[j].Key })
+	return arr
+}
+
+//idempotentJob returns the job enqueued with the key within the idempotency window, even if it left the queue since.
+//Caller must hold q.mutex.
+func (q *JobListQueue) idempotentJob(key string) (int, bool) {
+	if key == "" || q.config.IdempotencyWindow <= 0 {
+		return 0, false
+	}
+	entry, ok := q.idempotencyKeys.get(key, q.now())
+	return entry.JobId, ok
+}
+
+//rememberKey indexes the idempotency key of the job until the window after its enqueue passed. The key is stored
+//in the job as well, so it is persisted and replicated together with the enqueue. Caller must hold q.mutex.
+func (q *JobListQueue) rememberKey(e *Element) {
+	if e.Value.IdempotencyKey == "" || e.Value.EnqueuedAt == nil {
+		return
+	}
+	q.idempotencyKeys.put(idempotencyKey{
+		Key:     e.Value.IdempotencyKey,
+		JobId:   e.Value.Id,
+		Expires: e.Value.EnqueuedAt.Add(q.config.IdempotencyWindow),
+	}, q.now())
+}
+
+//keepKey hands the idempotency key of a job leaving the queue to a store which keeps state, so the key outlives
+//the job after a restart too. Caller must hold q.mutex.
+func (q *JobListQueue) keepKey(e *Element) error {
+	if e.Value.IdempotencyKey == "" {
+		return nil
+	}
+	entry, ok := q.idempotencyKeys.get(e.Value.IdempotencyKey, q.now())
+	if !ok || entry.JobId != e.Value.Id {
+		return nil
+	}
+	return q.saveKey(entry)
+}
+
+//saveKey persists the key in a store which keeps state. Caller must hold q.mutex.
+func (q *JobListQueue) saveKey(entry idempotencyKey) error {
+	s, ok := q.store.(StateStore)
+	if !ok {
+		return nil
+	}
+	err := s.SaveIdempotencyKey(entry)
+	if err != nil {
+		q.log.Log("level", "error", "msg", "failed to save idempotency key", "jobId", entry.JobId, "error", err.Error())
+	}
+	return err
+}
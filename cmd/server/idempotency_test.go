@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler_EnqueueIdempotencyKey(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+	now := time.Now()
+	q.now = func() time.Time { return now }
+	h := newHandler(q, log.NewNopLogger())
+
+	enqueue := func(key string) (int, int, string) {
+		header := http.Header{}
+		if key != "" {
+			header.Set(idempotencyKeyHeader, key)
+		}
+		rr, _ := do(h, http.MethodPost, "/jobs/enqueue", header, job{Type: "TIME_CRITICAL"})
+		var res jobIdResponse
+		json.Unmarshal(rr.Body.Bytes(), &res)
+		return rr.Code, res.JobId, rr.Header().Get("Idempotent-Replayed")
+	}
+
+	code, first, replayed := enqueue("order-1")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "", replayed)
+	code, id, replayed := enqueue("order-1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, first, id)
+	assert.Equal(t, "true", replayed)
+	assert.Equal(t, 1, q.Len())
+
+	_, other, _ := enqueue("order-2")
+	assert.NotEqual(t, first, other)
+	_, a, _ := enqueue("")
+	_, b, _ := enqueue("")
+	assert.NotEqual(t, a, b)
+
+	//Once the window passed the key enqueues a new job.
+	now = now.Add(q.Config().IdempotencyWindow)
+	code, id, _ = enqueue("order-1")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.NotEqual(t, first, id)
+
+	code, _, _ = enqueue(strings.Repeat("k", maxIdempotencyKeyLength+1))
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestQueue_IdempotencyKeyOutlivesJob(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	id, _, err := q.EnqueueWithKey(&job{Type: "TIME_CRITICAL"}, "order-1")
+	assert.Nil(t, err)
+	assert.Nil(t, q.Cancel(id))
+	again, outcome, err := q.EnqueueWithKey(&job{Type: "TIME_CRITICAL"}, "order-1")
+	assert.Nil(t, err)
+	assert.Equal(t, outcomeReplayed, outcome)
+	assert.Equal(t, id, again)
+	assert.Equal(t, 0, q.Len())
+
+	//The reaper drops the key once it expired.
+	now = now.Add(q.Config().IdempotencyWindow)
+	q.reapDue()
+	assert.Equal(t, 0, len(q.idempotencyKeys.keys))
+	again, outcome, _ = q.EnqueueWithKey(&job{Type: "TIME_CRITICAL"}, "order-1")
+	assert.Equal(t, outcomeEnqueued, outcome)
+	assert.NotEqual(t, id, again)
+
+	//A disabled window ignores keys.
+	config := q.Config()
+	config.IdempotencyWindow = 0
+	q.Configure(config)
+	_, outcome, _ = q.EnqueueWithKey(&job{Type: "TIME_CRITICAL"}, "order-1")
+	assert.Equal(t, outcomeEnqueued, outcome)
+}
+
+func TestQueue_IdempotencyKeySurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idempotency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.wal")
+
+	wal, registry := openTestWAL(t, path)
+	id, _, err := registry.Default().EnqueueWithKey(&job{Type: "TIME_CRITICAL"}, "order-1")
+	assert.Nil(t, err)
+	removed, _, _ := registry.Default().EnqueueWithKey(&job{Type: "TIME_CRITICAL"}, "order-2")
+	assert.Nil(t, registry.Default().Cancel(removed))
+	registry.Close()
+	wal.Close()
+
+	//From the log, then from a snapshot
+	for i := 0; i < 2; i++ {
+		wal, registry = openTestWAL(t, path)
+		for key, want := range map[string]int{"order-1": id, "order-2": removed} {
+			again, outcome, err := registry.Default().EnqueueWithKey(&job{Type: "TIME_CRITICAL"}, key)
+			assert.Nil(t, err)
+			assert.Equal(t, outcomeReplayed, outcome)
+			assert.Equal(t, want, again)
+		}
+		assert.Nil(t, registry.Snapshot())
+		registry.Close()
+		wal.Close()
+	}
+
+	//The file store keeps the key in the job, and in a record of its own once the job is removed.
+	store, err := OpenFileStore(filepath.Join(dir, "default.jobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewQueueWithStore(log.NewNopLogger(), testConfig(), store)
+	id, _, _ = q.EnqueueWithKey(&job{Type: "TIME_CRITICAL"}, "order-3")
+	removed, _, _ = q.EnqueueWithKey(&job{Type: "TIME_CRITICAL"}, "order-4")
+	assert.Nil(t, q.Cancel(removed))
+	q.mutex.Lock()
+	assert.Nil(t, q.store.(*fileStore).compact())
+	q.mutex.Unlock()
+	q.Close()
+	store, err = OpenFileStore(filepath.Join(dir, "default.jobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = NewQueueWithStore(log.NewNopLogger(), testConfig(), store)
+	defer q.Close()
+	for key, want := range map[string]int{"order-3": id, "order-4": removed} {
+		again, outcome, _ := q.EnqueueWithKey(&job{Type: "TIME_CRITICAL"}, key)
+		assert.Equal(t, outcomeReplayed, outcome)
+		assert.Equal(t, want, again)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+var errJobIdTaken = errors.New("JobId already taken")
+
+//IDGenerator hands out the ids of new jobs. Ids are unique and grow with time, so sorting jobs by id sorts them
+//by enqueue time.
+type IDGenerator interface {
+	//NextID returns a new id, larger than every id returned or observed before.
+	NextID() int
+	//Observe tells the generator about an id handed out elsewhere, by an earlier run or by another node.
+	Observe(id int)
+}
+
+//defaultIDs is shared by the queues whose config does not set a generator, so they never hand out the same id.
+var defaultIDs IDGenerator = mustSnowflake(0)
+
+//Snowflake ids are made of the milliseconds since snowflakeEpoch, the number of the node and a sequence number
+//within the millisecond: 41, 6 and 6 bits, 53 in all. Ids stay below 2^53, so JavaScript clients read the JSON
+//numbers without rounding them.
+const (
+	snowflakeNodeBits     = 6
+	snowflakeSequenceBits = 6
+	snowflakeMaxNode      = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSequence  = 1<<snowflakeSequenceBits - 1
+)
+
+var snowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+//snowflakeGenerator generates Snowflake ids. Nodes with different numbers never generate the same id.
+//If the clock goes back, or more than 64 ids are needed within a millisecond, the generator runs ahead of the
+//clock rather than wait for it.
+type snowflakeGenerator struct {
+	node     int64
+	mutex    sync.Mutex
+	last     int64
+	sequence int64
+	now      func() time.Time
+}
+
+//NewSnowflakeGenerator creates the generator of node, between 0 and 63.
+func NewSnowflakeGenerator(node int) (*snowflakeGenerator, error) {
+	if node < 0 || node > snowflakeMaxNode {
+		return nil, errors.Errorf("the node number of snowflake ids must be between 0 and %d", snowflakeMaxNode)
+	}
+	return &snowflakeGenerator{node: int64(node), now: time.Now}, nil
+}
+
+func mustSnowflake(node int) *snowflakeGenerator {
+	g, err := NewSnowflakeGenerator(node)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func (g *snowflakeGenerator) NextID() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	ms := int64(g.now().Sub(snowflakeEpoch) / time.Millisecond)
+	if ms > g.last {
+		g.last = ms
+		g.sequence = 0
+	} else if g.sequence < snowflakeMaxSequence {
+		g.sequence++
+	} else {
+		g.last++
+		g.sequence = 0
+	}
+	return int(g.last<<(snowflakeNodeBits+snowflakeSequenceBits) | g.node<<snowflakeSequenceBits | g.sequence)
+}
+
+func (g *snowflakeGenerator) Observe(id int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	ms := int64(id) >> (snowflakeNodeBits + snowflakeSequenceBits)
+	sequence := int64(id) & snowflakeMaxSequence
+	if ms > g.last || (ms == g.last && sequence > g.sequence) {
+		g.last = ms
+		g.sequence = sequence
+	}
+}
+
+//sequenceGenerator counts up from 1. The ids are small, but only unique within a single server.
+type sequenceGenerator struct {
+	mutex sync.Mutex
+	last  int
+}
+
+func NewSequenceGenerator() *sequenceGenerator {
+	return &sequenceGenerator{}
+}
+
+func (g *sequenceGenerator) NextID() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.last++
+	return g.last
+}
+
+func (g *sequenceGenerator) Observe(id int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if id > g.last {
+		g.last = id
+	}
+}
+
+//NewIDGenerator creates the generator selected with -id-generator: snowflake, with the number of the node, or sequence.
+func NewIDGenerator(kind string, node int) (IDGenerator, error) {
+	switch kind {
+	case "snowflake":
+		return NewSnowflakeGenerator(node)
+	case "sequence":
+		return NewSequenceGenerator(), nil
+	}
+	return nil, errors.Errorf("unknown id generator %q, expected snowflake or sequence", kind)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSnowflakeGenerator_UniqueAndOrdered(t *testing.T) {
+	g, err := NewSnowflakeGenerator(7)
+	assert.Nil(t, err)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	g.now = func() time.Time { return now }
+
+	//More ids than fit in a millisecond, then the clock goes back.
+	last := 0
+	for i := 0; i < 3*snowflakeMaxSequence; i++ {
+		if i == 2*snowflakeMaxSequence {
+			now = now.Add(-time.Second)
+		}
+		id := g.NextID()
+		assert.True(t, id > last, "id %d after %d", id, last)
+		last = id
+	}
+
+	//Ids sort by time.
+	now = now.Add(time.Hour)
+	later := g.NextID()
+	assert.True(t, later > last)
+	assert.Equal(t, 7, later>>snowflakeSequenceBits&snowflakeMaxNode)
+	assert.Equal(t, now.Sub(snowflakeEpoch)/time.Millisecond, time.Duration(later>>(snowflakeNodeBits+snowflakeSequenceBits)))
+
+	_, err = NewSnowflakeGenerator(snowflakeMaxNode + 1)
+	assert.NotNil(t, err)
+
+	//Up to the last millisecond of the 41 bits, ids are exact as JSON numbers read into a float64.
+	g, _ = NewSnowflakeGenerator(snowflakeMaxNode)
+	g.now = func() time.Time { return snowflakeEpoch.Add((1<<41 - 1) * time.Millisecond) }
+	id := g.NextID()
+	assert.True(t, id < 1<<53, "id %d", id)
+	assert.Equal(t, id, int(float64(id)))
+}
+
+func TestSnowflakeGenerator_Observe(t *testing.T) {
+	a, _ := NewSnowflakeGenerator(1)
+	b, _ := NewSnowflakeGenerator(2)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now.Add(time.Minute) }
+	b.now = func() time.Time { return now }
+
+	//b's clock is behind, it still hands out ids after the ones it saw.
+	id := a.NextID()
+	b.Observe(id)
+	assert.True(t, b.NextID() > id)
+}
+
+func TestSequenceGenerator(t *testing.T) {
+	g := NewSequenceGenerator()
+	assert.Equal(t, 1, g.NextID())
+	assert.Equal(t, 2, g.NextID())
+	g.Observe(10)
+	g.Observe(5)
+	assert.Equal(t, 11, g.NextID())
+
+	_, err := NewIDGenerator("ulid", 0)
+	assert.NotNil(t, err)
+}
+
+//fixedIDs always hands out the same id.
+type fixedIDs struct {
+	id int
+}
+
+func (g fixedIDs) NextID() int {
+	return g.id
+}
+
+func (g fixedIDs) Observe(id int) {
+}
+
+func TestQueue_RefusesTakenId(t *testing.T) {
+	config := testConfig()
+	config.IDs = fixedIDs{id: 42}
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+
+	id, err := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	assert.Nil(t, err)
+	assert.Equal(t, 42, id)
+	_, err = q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	assert.Equal(t, errJobIdTaken, err)
+	assert.Equal(t, 1, q.Len())
+
+	h := newHandler(q, log.NewNopLogger())
+	rr, _ := do(h, http.MethodPost, "/jobs/enqueue", http.Header{}, job{Type: "TIME_CRITICAL"})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestQueue_IdsFollowRecoveredJobs(t *testing.T) {
+	config := testConfig()
+	config.IDs = NewSequenceGenerator()
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+	q.replay(walRecord{Op: "enqueue", Job: &job{Id: 100, Type: "TIME_CRITICAL", Status: "QUEUED"}})
+
+	id, err := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	assert.Nil(t, err)
+	assert.Equal(t, 101, id)
+}
@@ -3,19 +3,74 @@ package main
 import (
 	"encoding/json"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"io"
 	"net/http"
 	"strconv"
-	"sync"
+	"time"
 )
 
 //Each item in the queue is of type job
+//ConsumerId and LeaseDeadline are only set while the job is leased to a consumer. Priority is only nil on a job sent
+//without one, it is set on enqueue.
 type job struct {
-	Id     int    `json:"id"`
-	Type   string `json:"type"`
-	Status string `json:"status"`
-	mutex  sync.Mutex
+	Id                int             `json:"id"`
+	Type              string          `json:"type"`
+	Status            string          `json:"status"`
+	Priority          *jobPriority    `json:"priority,omitempty"`
+	EffectivePriority jobPriority     `json:"effectivePriority"`
+	ConsumerId        string          `json:"consumerId,omitempty"`
+	LeaseDeadline     *time.Time      `json:"leaseDeadline,omitempty"`
+	Progress          int             `json:"progress,omitempty"`
+	MaxAttempts       int             `json:"maxAttempts,omitempty"`
+	Attempts          int             `json:"attempts"`
+	LastError         string          `json:"lastError,omitempty"`
+	RetryAt           *time.Time      `json:"retryAt,omitempty"`
+	History           []attempt       `json:"history,omitempty"`
+	DeadLetteredAt    *time.Time      `json:"deadLetteredAt,omitempty"`
+	UniqueKey         string          `json:"uniqueKey,omitempty"`
+	UniquePolicy      string          `json:"uniquePolicy,omitempty"`
+	RunAt             *time.Time      `json:"runAt,omitempty"`
+	EnqueuedAt        *time.Time      `json:"enqueuedAt,omitempty"`
+	IdempotencyKey    string          `json:"idempotencyKey,omitempty"`
+	DelaySeconds      int             `json:"delaySeconds,omitempty"`
+	Payload           json.RawMessage `json:"payload,omitempty"`
+	Result            json.RawMessage `json:"result,omitempty"`
+	leasedAt          time.Time
+	//releasedBy is the consumer which held the lease last, reported in the events once the lease is released.
+	releasedBy string
 }
 
+//A single attempt at processing a job, recorded when the lease ends without the job being concluded.
+type attempt struct {
+	ConsumerId string    `json:"consumerId"`
+	StartedAt  time.Time `json:"startedAt"`
+	EndedAt    time.Time `json:"endedAt"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+}
+
+//Optional body of a conclude request. Result is any JSON document describing the outcome of the job.
+type concludeRequest struct {
+	Result json.RawMessage `json:"result"`
+}
+
+//Optional body of a fail request. Error describes why the consumer could not process the job.
+type failRequest struct {
+	Error string `json:"error"`
+}
+
+//Optional body of a heartbeat. Progress is the percent of the job completed so far.
+type heartbeatRequest struct {
+	Progress *int `json:"progress"`
+}
+
+var (
+	errRunAtAndDelay   = errors.New("only one of runAt and delaySeconds can be set")
+	errNegativeDelay   = errors.New("delaySeconds cannot be negative")
+	errInvalidProgress = errors.New("progress must be between 0 and 100")
+)
+
 type jobIdResponse struct {
 	JobId int `json:"jobId"`
 }
@@ -29,27 +84,111 @@ func (h *handler) enqueue(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jobId, err := h.queue.Enqueue(&req)
+	if err := resolveDelay(&req); err != nil {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	//A retry with the key of an earlier enqueue gets the job enqueued then.
+	key := r.Header.Get(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		Respond(w, http.StatusBadRequest, errIdempotencyKeyTooLong.Error())
+		return
+	}
+
+	jobId, outcome, err := h.queueFor(r).EnqueueWithKey(&req, key)
 	if err != nil {
-		h.logger.Log("level", "error", "msg", "Not able to queue job", "error", err.Error())
-		Respond(w, http.StatusInternalServerError, err.Error())
+		status := enqueueErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			h.logger.Log("level", "error", "msg", "Not able to queue job", "error", err.Error())
+		}
+		Respond(w, status, err.Error())
+		return
 	}
 
 	enqueueResponse := jobIdResponse{JobId: jobId}
+	switch outcome {
+	case outcomeReplayed:
+		w.Header().Set("Idempotent-Replayed", "true")
+		Respond(w, http.StatusOK, enqueueResponse)
+		return
+	case outcomeExisting:
+		Respond(w, http.StatusOK, enqueueResponse)
+		return
+	}
 	Respond(w, http.StatusCreated, enqueueResponse)
 	return
 }
 
+//resolveDelay turns delaySeconds into runAt. A job is delayed either until runAt or by delaySeconds from now.
+func resolveDelay(req *job) error {
+	if req.RunAt != nil && req.DelaySeconds != 0 {
+		return errRunAtAndDelay
+	}
+	if req.DelaySeconds < 0 {
+		return errNegativeDelay
+	}
+	if req.DelaySeconds > 0 {
+		runAt := time.Now().Add(time.Duration(req.DelaySeconds) * time.Second)
+		req.RunAt = &runAt
+	}
+	return nil
+}
+
+//enqueueErrorStatus maps an error of an enqueue to the status code it is answered with.
+func enqueueErrorStatus(err error) int {
+	switch err {
+	case errPayloadTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errJobIdTaken, errUniqueKeyTaken:
+		return http.StatusConflict
+	case errInvalidUniquePolicy:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 func (h *handler) dequeue(w http.ResponseWriter, r *http.Request) {
 	cId := r.Header.Get("CONSUMER_ID")
 
-	jobDeque, err := h.queue.Dequeue(cId)
+	//With max the consumer gets an array of up to max jobs instead of a single job.
+	query := r.URL.Query()
+	max := 1
+	if query.Get("max") != "" {
+		n, err := strconv.Atoi(query.Get("max"))
+		if err != nil || n < 1 || n > maxBatchSize {
+			Respond(w, http.StatusBadRequest, errDequeueMax.Error())
+			return
+		}
+		max = n
+	}
+	//With wait the request is parked until a job is available, and answered 204 if none came in time.
+	wait, err := parseWait(query.Get("wait"))
+	if err != nil {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var jobs []job
+	if wait > 0 {
+		jobs, err = h.queueFor(r).DequeueWait(r.Context(), cId, max, wait)
+	} else {
+		jobs, err = h.queueFor(r).DequeueBatch(cId, max)
+	}
+	if err == errWaitElapsed {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 	if err != nil {
 		h.logger.Log("level", "error", "error", err.Error())
 		Respond(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	Respond(w, http.StatusOK, jobDeque)
+	if query.Get("max") != "" {
+		Respond(w, http.StatusOK, jobs)
+		return
+	}
+	Respond(w, http.StatusOK, jobs[0])
 	return
 }
 
@@ -66,7 +205,22 @@ func (h *handler) conclude(w http.ResponseWriter, r *http.Request) {
 
 	cId := r.Header.Get("CONSUMER_ID")
 
-	err := h.queue.Conclude(jobID, cId)
+	//The body is optional.
+	var req concludeRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil && err != io.EOF {
+			h.logger.Log("level", "error", "error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := h.queueFor(r).ConcludeWithResult(jobID, cId, req.Result)
+	if err == errResultTooLarge {
+		Respond(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
 	if err != nil {
 		Respond(w, http.StatusInternalServerError, err.Error())
 		return
@@ -76,6 +230,84 @@ func (h *handler) conclude(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+func (h *handler) heartbeat(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["job_id"]
+	if !ok {
+		h.logger.Log("level", "error", "msg", "could not get JobId from the request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	jobID, _ := strconv.Atoi(id)
+
+	cId := r.Header.Get("CONSUMER_ID")
+
+	//The body is optional. A heartbeat without a body only extends the lease.
+	var req heartbeatRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil && err != io.EOF {
+			h.logger.Log("level", "error", "error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Progress != nil && (*req.Progress < 0 || *req.Progress > 100) {
+		Respond(w, http.StatusBadRequest, errInvalidProgress.Error())
+		return
+	}
+
+	jobDetails, err := h.queueFor(r).Heartbeat(jobID, cId, req.Progress)
+	if err == errNotLeaseHolder {
+		Respond(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		Respond(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, jobDetails)
+	return
+}
+
+func (h *handler) fail(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["job_id"]
+	if !ok {
+		h.logger.Log("level", "error", "msg", "could not get JobId from the request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	jobID, _ := strconv.Atoi(id)
+
+	cId := r.Header.Get("CONSUMER_ID")
+
+	//The body is optional.
+	var req failRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil && err != io.EOF {
+			h.logger.Log("level", "error", "error", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	jobDetails, err := h.queueFor(r).Fail(jobID, cId, req.Error)
+	if err == errNotLeaseHolder {
+		Respond(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		Respond(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, jobDetails)
+	return
+}
+
 func (h *handler) getJob(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -87,7 +319,7 @@ func (h *handler) getJob(w http.ResponseWriter, r *http.Request) {
 	}
 
 	jobID, _ := strconv.Atoi(id)
-	jobDetails, err := h.queue.GetJob(jobID)
+	jobDetails, err := h.queueFor(r).GetJob(jobID)
 	if err != nil {
 		Respond(w, http.StatusInternalServerError, err.Error())
 		return
@@ -97,7 +329,7 @@ func (h *handler) getJob(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *handler) getJobs(w http.ResponseWriter, r *http.Request) {
-	jobDetails, err := h.queue.GetJobs()
+	jobDetails, err := h.queueFor(r).GetJobs()
 	if err != nil {
 		Respond(w, http.StatusInternalServerError, err.Error())
 		return
@@ -107,7 +339,7 @@ func (h *handler) getJobs(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *handler) remove(w http.ResponseWriter, r *http.Request) {
-	jobId, err := h.queue.Remove()
+	jobId, err := h.queueFor(r).Remove()
 	if err != nil {
 		Respond(w, http.StatusInternalServerError, err.Error())
 		return
@@ -11,6 +11,7 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestJobListQueue_Enqueue2(t *testing.T) {
@@ -23,6 +24,7 @@ func TestJobListQueue_Enqueue2(t *testing.T) {
 	}
 
 	q := NewLinkedListQueue(log.NewNopLogger())
+	defer q.Close()
 	h := newHandler(q, log.NewNopLogger())
 
 	// ResponseRecorder is an implementation of http.ResponseWriter .Used here to record the response
@@ -58,6 +60,7 @@ func TestJobListQueue_Dequeue2(t *testing.T) {
 	}
 
 	q := NewLinkedListQueue(log.NewNopLogger())
+	defer q.Close()
 	item1 := job{Type: "TIME_CRITICAL"}
 	id1, _ := q.Enqueue(&item1)
 
@@ -103,14 +106,17 @@ func TestJobListQueue_Dequeue2(t *testing.T) {
 
 func TestJobListQueue_Conclude2(t *testing.T) {
 	q := NewLinkedListQueue(log.NewNopLogger())
+	defer q.Close()
 	item1 := job{Type: "TIME_CRITICAL"}
 	id1, _ := q.Enqueue(&item1)
+	q.Dequeue("cId1")
 
 	url := fmt.Sprintf("/jobs/%s/conclude", strconv.Itoa(id1))
 	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("CONSUMER_ID", "cId1")
 	//Hack to try to fake gorilla/mux vars
 	vars := map[string]string{
 		"job_id": strconv.Itoa(id1),
@@ -147,6 +153,7 @@ func TestJobListQueue_Conclude2(t *testing.T) {
 
 func TestJobListQueue_GetJob2(t *testing.T) {
 	q := NewLinkedListQueue(log.NewNopLogger())
+	defer q.Close()
 	item1 := job{Type: "TIME_CRITICAL"}
 	id1, _ := q.Enqueue(&item1)
 
@@ -188,3 +195,126 @@ func TestJobListQueue_GetJob2(t *testing.T) {
 		t.Errorf("jobId returned from Enqueue cannot be 0: got %v", jobResponse.Id)
 	}
 }
+
+func TestJobListQueue_Heartbeat2(t *testing.T) {
+	q := NewLinkedListQueue(log.NewNopLogger())
+	defer q.Close()
+	item1 := job{Type: "TIME_CRITICAL"}
+	id1, _ := q.Enqueue(&item1)
+	q.Dequeue("cId1")
+
+	h := newHandler(q, log.NewNopLogger())
+	url := fmt.Sprintf("/jobs/%s/heartbeat", strconv.Itoa(id1))
+
+	//Heartbeat from a consumer not holding the lease
+	header := http.Header{}
+	header.Set("CONSUMER_ID", "cId2")
+	rr, _ := do(h, http.MethodPost, url, header, heartbeatRequest{})
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusForbidden)
+	}
+
+	progress := 50
+	header.Set("CONSUMER_ID", "cId1")
+	rr, _ = do(h, http.MethodPost, url, header, heartbeatRequest{Progress: &progress})
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	var jobResponse job
+	err := json.Unmarshal(rr.Body.Bytes(), &jobResponse)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if jobResponse.Progress != progress {
+		t.Errorf("got progress %v want %v", jobResponse.Progress, progress)
+	}
+}
+
+func TestJobListQueue_EnqueueDelayed(t *testing.T) {
+	q := NewLinkedListQueue(log.NewNopLogger())
+	defer q.Close()
+	h := newHandler(q, log.NewNopLogger())
+
+	rr, _ := do(h, http.MethodPost, "/jobs/enqueue", http.Header{}, job{Type: "TIME_CRITICAL", DelaySeconds: 30})
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+	var enqueueResponse jobIdResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &enqueueResponse)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	item, _ := q.GetJob(enqueueResponse.JobId)
+	if item.Status != "SCHEDULED" {
+		t.Errorf("got %s expected %s \n", item.Status, "SCHEDULED")
+	}
+
+	//runAt and delaySeconds cannot be combined
+	runAt := time.Now()
+	rr, _ = do(h, http.MethodPost, "/jobs/enqueue", http.Header{}, job{Type: "TIME_CRITICAL", DelaySeconds: 30, RunAt: &runAt})
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+}
+
+func TestJobListQueue_PayloadAndResult(t *testing.T) {
+	q := NewLinkedListQueue(log.NewNopLogger())
+	defer q.Close()
+	h := newHandler(q, log.NewNopLogger())
+
+	payload := json.RawMessage(`{"customer":42,"action":"REINDEX"}`)
+	rr, _ := do(h, http.MethodPost, "/jobs/enqueue", http.Header{}, job{Type: "TIME_CRITICAL", Payload: payload})
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+
+	header := http.Header{}
+	header.Set("CONSUMER_ID", "cId1")
+	rr, _ = do(h, http.MethodGet, "/jobs/dequeue", header, nil)
+	var dequeueResponse job
+	err := json.Unmarshal(rr.Body.Bytes(), &dequeueResponse)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if string(dequeueResponse.Payload) != string(payload) {
+		t.Errorf("got payload %s want %s", dequeueResponse.Payload, payload)
+	}
+
+	result := json.RawMessage(`{"indexed":1000}`)
+	url := fmt.Sprintf("/jobs/%s/conclude", strconv.Itoa(dequeueResponse.Id))
+	rr, _ = do(h, http.MethodPost, url, header, concludeRequest{Result: result})
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	rr, _ = do(h, http.MethodGet, fmt.Sprintf("/jobs/%s", strconv.Itoa(dequeueResponse.Id)), header, nil)
+	var jobResponse job
+	err = json.Unmarshal(rr.Body.Bytes(), &jobResponse)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if string(jobResponse.Result) != string(result) {
+		t.Errorf("got result %s want %s", jobResponse.Result, result)
+	}
+}
+
+func TestJobListQueue_PayloadTooLarge(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.MaxPayloadBytes = 8
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+	h := newHandler(q, log.NewNopLogger())
+
+	rr, _ := do(h, http.MethodPost, "/jobs/enqueue", http.Header{}, job{Type: "TIME_CRITICAL", Payload: json.RawMessage(`"0123456789"`)})
+	if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusRequestEntityTooLarge)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+//grantLease marks the job IN_PROGRESS for the consumer until the lease deadline. Caller must hold q.mutex.
+func (q *JobListQueue) grantLease(e *Element, consumerId string) {
+	q.unready(e)
+	e.Value.leasedAt = q.now()
+	deadline := e.Value.leasedAt.Add(q.config.LeaseTimeout)
+	e.Value.Status = "IN_PROGRESS"
+	e.Value.ConsumerId = consumerId
+	e.Value.LeaseDeadline = &deadline
+	e.Value.Progress = 0
+	q.consumerDetails.Store(e.Value.Id, consumerId) //Used to store the itemId and the consumer holding the lease.
+}
+
+//releaseLease drops the lease details from the job. Caller must hold q.mutex.
+func (q *JobListQueue) releaseLease(e *Element) {
+	if e.Value.ConsumerId != "" {
+		e.Value.releasedBy = e.Value.ConsumerId
+	}
+	e.Value.ConsumerId = ""
+	e.Value.LeaseDeadline = nil
+	q.consumerDetails.Delete(e.Value.Id)
+}
+
+//requeueExpired moves every job whose lease ran out back to QUEUED. Caller must hold q.mutex.
+//An expired lease counts as an attempt, jobs which used up their attempts are dead-lettered as EXPIRED.
+//Only the jobs in consumerDetails are leased, so the whole list does not need to be walked.
+func (q *JobListQueue) requeueExpired() {
+	now := q.now()
+	q.consumerDetails.Range(func(key, value interface{}) bool {
+		e, ok := q.store.Get(key.(int))
+		if !ok {
+			q.consumerDetails.Delete(key)
+			return true
+		}
+		if e.Value.Status != "IN_PROGRESS" || e.Value.LeaseDeadline == nil || now.Before(*e.Value.LeaseDeadline) {
+			return true
+		}
+		q.recordAttempt(e, "LEASE_EXPIRED", "lease expired")
+		q.releaseLease(e)
+		if q.exhausted(&e.Value) {
+			q.deadLetter(e, "EXPIRED")
+			return true
+		}
+		q.log.Log("level", "info", "msg", "lease expired, job requeued", "jobId", e.Value.Id, "consumerId", value)
+		q.markReady(e)
+		q.record("expire", e)
+		return true
+	})
+}
+
+//Heartbeat extends the lease held by the consumer by another LeaseTimeout and records the reported progress.
+//Heartbeats from any consumer other than the lease holder are rejected.
+func (q *JobListQueue) Heartbeat(jobID int, consumerId string, progress *int) (*job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.requeueExpired()
+
+	e, ok := q.store.Get(jobID)
+	if !ok {
+		return nil, errors.New("JobId not present in the Queue")
+	}
+
+	cId, ok := q.consumerDetails.Load(jobID)
+	if !ok {
+		return nil, errors.New("Job is not leased to any consumer")
+	}
+	if cId != consumerId {
+		return nil, errNotLeaseHolder
+	}
+
+	deadline := q.now().Add(q.config.LeaseTimeout)
+	e.Value.LeaseDeadline = &deadline
+	if progress != nil {
+		e.Value.Progress = *progress
+	}
+	if err := q.record("heartbeat", e); err != nil {
+		return nil, err
+	}
+	details := q.snapshot(e)
+	return &details, nil
+}
+
+//reap periodically requeues jobs with expired leases and promotes scheduled jobs and retries which are due until Close is called.
+func (q *JobListQueue) reap(interval time.Duration) {
+	defer q.reaper.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.reapDue()
+		case <-q.done:
+			return
+		}
+	}
+}
+
+//reapDue requeues jobs with expired leases, promotes scheduled jobs and retries which are due and drops the
+//idempotency keys which expired.
+func (q *JobListQueue) reapDue() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.requeueExpired()
+	q.promoteDue()
+	q.idempotencyKeys.prune(q.now())
+}
+
+//Close stops the background lease reaper, waits for it to finish and closes the store.
+func (q *JobListQueue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+		q.reaper.Wait()
+
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		if err := q.store.Close(); err != nil {
+			q.log.Log("level", "error", "msg", "failed to close store", "error", err.Error())
+		}
+	})
+}
@@ -2,39 +2,189 @@ package main
 
 import (
 	"context"
+	"flag"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
+	config := DefaultQueueConfig()
+	flag.DurationVar(&config.LeaseTimeout, "lease-timeout", config.LeaseTimeout, "how long a dequeued job is leased to its consumer")
+	flag.DurationVar(&config.ReapInterval, "reap-interval", config.ReapInterval, "how often expired leases are returned to the queue")
+	flag.IntVar(&config.MaxAttempts, "max-attempts", config.MaxAttempts, "how many times a job may fail before it is marked FAILED")
+	flag.Var(config.MaxAttemptsByType, "max-attempts-by-type", "per job type attempt limits, as TYPE=N,TYPE=N")
+	flag.DurationVar(&config.RetryBackoff, "retry-backoff", config.RetryBackoff, "delay before the first retry of a failed job, doubled on every further attempt")
+	flag.DurationVar(&config.MaxRetryBackoff, "max-retry-backoff", config.MaxRetryBackoff, "upper bound of the retry delay")
+	flag.IntVar(&config.MaxPayloadBytes, "max-payload-bytes", config.MaxPayloadBytes, "size limit of a job payload, 0 for no limit")
+	flag.IntVar(&config.MaxResultBytes, "max-result-bytes", config.MaxResultBytes, "size limit of a job result, 0 for no limit")
+	flag.DurationVar(&config.AgingInterval, "aging-interval", config.AgingInterval, "how long a queued job waits to gain one priority level, 0 disables aging")
+	flag.DurationVar(&config.IdempotencyWindow, "idempotency-window", config.IdempotencyWindow, "how long an Idempotency-Key of an enqueue is remembered, 0 disables idempotency keys")
+	idGenerator := flag.String("id-generator", "snowflake", "how job ids are generated: snowflake or sequence")
+	idNode := flag.Int("id-node", 0, "number of this node in snowflake ids, between 0 and 63, different on every node; required with -cluster and -shards")
+	addr := flag.String("addr", ":8080", "address the server listens on")
+	grpcAddr := flag.String("grpc-addr", "", "address the gRPC API listens on, it is not served when empty; standalone servers only, not with -cluster or -shards")
+	redisAddr := flag.String("redis-addr", "", "address the Redis protocol front end listens on, it is not served when empty; standalone servers only, not with -cluster or -shards")
+	nodeId := flag.String("node-id", "", "id of this node in the -cluster list")
+	members := flag.String("cluster", "", "all the nodes of the cluster, this one included, as id=url,id=url; the server runs standalone when empty")
+	raftDir := flag.String("raft-dir", "", "directory of the raft state and log of this node, required with -cluster")
+	raftConfig := DefaultRaftConfig()
+	flag.DurationVar(&raftConfig.HeartbeatInterval, "raft-heartbeat-interval", raftConfig.HeartbeatInterval, "how often the leader sends heartbeats to the other nodes")
+	flag.DurationVar(&raftConfig.ElectionTimeout, "raft-election-timeout", raftConfig.ElectionTimeout, "how long a node waits for the leader before starting an election")
+	flag.IntVar(&raftConfig.SnapshotEntries, "raft-snapshot-entries", raftConfig.SnapshotEntries, "entries added to the raft log before it is replaced by a snapshot of the queues, 0 keeps the whole log")
+	shardId := flag.String("shard-id", "", "id of the shard of this node in the -shards list")
+	shardList := flag.String("shards", "", "all the shards the queues are spread over, as id=url|url,id=url; every queue lives on this node when empty")
+	shardSecret := flag.String("shards-secret", "", "secret clients send as a bearer token to change the layout of the -shards, only their nodes can when empty")
+	shardInterval := flag.Duration("shard-rebalance-interval", 10*time.Second, "how often queues owned by another shard are handed over")
+	storeKind := flag.String("store", "memory", "where the jobs of the queues are kept: memory or file")
+	storeDir := flag.String("store-dir", "data", "directory of the queue files with -store=file")
+	walPath := flag.String("wal", "", "path of the write-ahead log, the queues are only kept in memory when empty")
+	walFsync := flag.String("wal-fsync", fsyncInterval, "when the write-ahead log is synced to disk: always, interval or never")
+	walFsyncInterval := flag.Duration("wal-fsync-interval", 100*time.Millisecond, "how often the write-ahead log is synced with -wal-fsync=interval")
+	snapshotInterval := flag.Duration("snapshot-interval", 5*time.Minute, "how often the queues are snapshotted and the write-ahead log compacted, 0 disables it")
+	snapshotWALBytes := flag.Int64("snapshot-wal-bytes", 64<<20, "size of the write-ahead log which triggers a snapshot, 0 disables it")
+	flag.Parse()
+
 	//Logger Instance
 	logger := log.NewJSONLogger(os.Stdout)
 	logger = log.WithPrefix(logger, "date", log.DefaultTimestampUTC)
 
-	//q := NewQueue()      //Slice based Queue
-	linkedListQ := NewLinkedListQueue(logger)
+	if (*grpcAddr != "" || *redisAddr != "") && (*members != "" || *shardList != "") {
+		logger.Log("level", "error", "msg", "the gRPC and Redis front ends are only served by a standalone server, -grpc-addr and -redis-addr cannot be used with -cluster and -shards")
+		os.Exit(1)
+	}
+
+	//Job ids, shared by all the queues. Nodes left at the same node number would hand out the same ids.
+	idNodeSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "id-node" {
+			idNodeSet = true
+		}
+	})
+	if *idGenerator == "snowflake" && !idNodeSet && (*members != "" || *shardList != "") {
+		logger.Log("level", "error", "msg", "-id-node is required with -cluster and -shards, every node needs its own number")
+		os.Exit(1)
+	}
+	ids, err := NewIDGenerator(*idGenerator, *idNode)
+	if err != nil {
+		logger.Log("level", "error", "msg", "invalid -id-generator", "error", err.Error())
+		os.Exit(1)
+	}
+	config.IDs = ids
+
+	//Named queues. The default one backs the /jobs routes.
+	//With a write-ahead log the queues are rebuilt from it and every change is appended to it.
+	//In a cluster the queues are replicated through the raft log instead.
+	var wal *WAL
+	var registry *Registry
+	var snapshotter *Snapshotter
+	var raft *Raft
+	var cluster *Cluster
+	stores, err := NewStoreFactory(*storeKind, *storeDir)
+	if err != nil {
+		logger.Log("level", "error", "msg", "failed to set up store", "error", err.Error())
+		os.Exit(1)
+	}
+	if *members != "" {
+		if *walPath != "" || *storeKind != "memory" {
+			logger.Log("level", "error", "msg", "a cluster node keeps its queues in memory, -wal and -store=file cannot be used with -cluster")
+			os.Exit(1)
+		}
+		if *raftDir == "" {
+			logger.Log("level", "error", "msg", "a cluster node must keep its raft state on disk, -raft-dir is required with -cluster")
+			os.Exit(1)
+		}
+		peers, err := parsePeers(*members)
+		if err != nil {
+			logger.Log("level", "error", "msg", "invalid -cluster", "error", err.Error())
+			os.Exit(1)
+		}
+		registry, raft, cluster, err = startClusterNode(logger, config, *nodeId, peers, *raftDir, raftConfig)
+		if err != nil {
+			logger.Log("level", "error", "msg", "failed to join cluster", "error", err.Error())
+			os.Exit(1)
+		}
+	} else if *walPath != "" {
+		if *storeKind != "memory" {
+			logger.Log("level", "error", "msg", "the write-ahead log can only be used with -store=memory, the file store persists the jobs itself")
+			os.Exit(1)
+		}
+		wal, err = OpenWAL(*walPath, *walFsync, *walFsyncInterval)
+		if err != nil {
+			logger.Log("level", "error", "msg", "failed to open write-ahead log", "error", err.Error())
+			os.Exit(1)
+		}
+		registry, err = NewRegistryWithWAL(logger, config, wal)
+		if err != nil {
+			logger.Log("level", "error", "msg", "failed to recover from write-ahead log", "error", err.Error())
+			os.Exit(1)
+		}
+		snapshotter = NewSnapshotter(registry, logger, *snapshotInterval, *snapshotWALBytes)
+	} else {
+		registry, err = NewRegistryWithStores(logger, config, stores)
+		if err != nil {
+			logger.Log("level", "error", "msg", "failed to open stores", "error", err.Error())
+			os.Exit(1)
+		}
+	}
+	linkedListQ := registry.Default()
+
+	//Scheduler for recurring jobs, its schedules are kept with the queues
+	scheduler := registry.Schedules()
+	scheduler.Start(time.Second)
+
+	var shards *Shards
+	if *shardList != "" {
+		layout, err := parseShards(*shardList)
+		if err == nil {
+			shards, err = NewShards(*shardId, layout, *shardSecret, registry, logger, *shardInterval)
+		}
+		if err != nil {
+			logger.Log("level", "error", "msg", "invalid -shards", "error", err.Error())
+			os.Exit(1)
+		}
+	}
 
 	//Create handler Instance
 	h := newHandler(linkedListQ, logger)
+	h.schedules = scheduler
+	h.queues = registry
+	h.shards = shards
+	if cluster != nil {
+		h.committed = cluster.Committed
+	}
 
 	//Create Router Instance
+	//A cluster serves the API on its leader, shards forward every queue to the shard owning it.
 	router := newRouter(&h)
+	serving := func() bool { return true }
+	if cluster != nil {
+		serving = cluster.Serving
+		router = cluster.Handler(router)
+	}
+	if shards != nil {
+		shards.SetActive(serving)
+		router = shards.Handler(router)
+	}
+	scheduler.SetActive(func() bool {
+		return serving() && (shards == nil || shards.Owns(defaultQueueName))
+	})
 
 	//Create http Server
 	server := http.Server{
-		Addr:    ":8080",
+		Addr:    *addr,
 		Handler: router,
 	}
 
 	//To store fatalErrors while server is running
 	fatalErrorChan := make(chan error)
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	logger.Log("level", "info", "msg", "starting server", "port", "8080")
+	logger.Log("level", "info", "msg", "starting server", "addr", *addr)
 
 	//start Server
 	go func() {
@@ -44,6 +194,38 @@ func main() {
 		}
 	}()
 
+	//gRPC API, over unencrypted HTTP/2
+	var grpcServer *http.Server
+	if *grpcAddr != "" {
+		var protocols http.Protocols
+		protocols.SetUnencryptedHTTP2(true)
+		grpcServer = &http.Server{
+			Addr:      *grpcAddr,
+			Handler:   NewGRPCServer(registry, logger),
+			Protocols: &protocols,
+		}
+		logger.Log("level", "info", "msg", "starting gRPC server", "addr", *grpcAddr)
+		go func() {
+			err := grpcServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				fatalErrorChan <- errors.Wrap(err, "gRPC server failed")
+			}
+		}()
+	}
+
+	//Redis protocol front end
+	var redisServer *RedisServer
+	if *redisAddr != "" {
+		redisServer = NewRedisServer(registry, logger)
+		logger.Log("level", "info", "msg", "starting Redis server", "addr", *redisAddr)
+		go func() {
+			err := redisServer.ListenAndServe(*redisAddr)
+			if err != nil {
+				fatalErrorChan <- errors.Wrap(err, "Redis server failed")
+			}
+		}()
+	}
+
 	//blocking
 	select {
 	case sig := <-sigChan:
@@ -56,11 +238,41 @@ func main() {
 
 	logger.Log("level", "info", "msg", "waiting on open connections to finish")
 
-	err := server.Shutdown(context.Background())
+	//Streams only end with their client, they are dropped after a while.
+	if grpcServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), grpcShutdownTimeout)
+		if grpcServer.Shutdown(ctx) != nil {
+			grpcServer.Close()
+		}
+		cancel()
+	}
+	if redisServer != nil {
+		redisServer.Close()
+	}
+
+	err = server.Shutdown(context.Background())
 	if err != nil {
 		logger.Log("level", "error", "msg", "failed to shutdown server")
 		os.Exit(1)
 	}
+	scheduler.Close()
+	if shards != nil {
+		shards.Close()
+	}
+	if snapshotter != nil {
+		snapshotter.Close()
+	}
+	if cluster != nil {
+		cluster.Close()
+		raft.Close()
+	}
+	registry.Close()
+	if wal != nil {
+		err = wal.Close()
+		if err != nil {
+			logger.Log("level", "error", "msg", "failed to close write-ahead log", "error", err.Error())
+		}
+	}
 	logger.Log("level", "info", "msg", "shutdown successful.")
 	os.Exit(0)
 }
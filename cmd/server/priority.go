@@ -0,0 +1,152 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+//Priorities the job types TIME_CRITICAL and NOT_TIME_CRITICAL stand for. They can also be used as the value of priority.
+const (
+	priorityTimeCritical    jobPriority = 10
+	priorityNotTimeCritical jobPriority = 0
+)
+
+var priorityAliases = map[string]jobPriority{
+	"TIME_CRITICAL":     priorityTimeCritical,
+	"NOT_TIME_CRITICAL": priorityNotTimeCritical,
+}
+
+//jobPriority is the priority of a job, higher is dequeued first. It is encoded as a number, but accepts the
+//TIME_CRITICAL and NOT_TIME_CRITICAL aliases when decoded.
+type jobPriority int
+
+func (p *jobPriority) UnmarshalJSON(data []byte) error {
+	var alias string
+	if err := json.Unmarshal(data, &alias); err == nil {
+		if value, ok := priorityAliases[alias]; ok {
+			*p = value
+			return nil
+		}
+		//Numbers sent as strings are fine too.
+		value, err := strconv.Atoi(alias)
+		if err != nil {
+			return errors.Errorf("unknown priority %q", alias)
+		}
+		*p = jobPriority(value)
+		return nil
+	}
+
+	var value int
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.Wrap(err, "priority must be a number or TIME_CRITICAL/NOT_TIME_CRITICAL")
+	}
+	*p = jobPriority(value)
+	return nil
+}
+
+//newPriority returns a priority to set on a job.
+func newPriority(value jobPriority) *jobPriority {
+	return &value
+}
+
+//priority returns the priority of the job, 0 while it has none.
+func (item job) priority() jobPriority {
+	if item.Priority == nil {
+		return 0
+	}
+	return *item.Priority
+}
+
+//defaultPriority gives jobs enqueued without a priority the priority of their type, so TIME_CRITICAL jobs are still
+//dequeued before the others. A priority sent by the client is kept, 0 included.
+func defaultPriority(item *job) {
+	if item.Priority != nil {
+		return
+	}
+	item.Priority = newPriority(priorityAliases[item.Type])
+}
+
+//readyHeap holds the QUEUED jobs ordered by effective priority, and by the order they were enqueued within a priority.
+//Dequeue pops from it in O(log n) instead of walking the list.
+//
+//With aging every job gains one priority level per agingInterval it waits. All waiting jobs age at the same rate, so
+//job a is ahead of job b whenever priority(a) - priority(b) > (readyAt(a) - readyAt(b)) / agingInterval, which does
+//not depend on the current time and keeps the heap ordered without re-sorting it.
+type readyHeap struct {
+	elements      []*Element
+	agingInterval time.Duration
+}
+
+func (r readyHeap) Len() int { return len(r.elements) }
+func (r readyHeap) Less(i, j int) bool {
+	a, b := r.elements[i], r.elements[j]
+	if r.agingInterval > 0 && !a.readyAt.Equal(b.readyAt) {
+		priorityDiff := float64(a.Value.priority() - b.Value.priority())
+		waitDiff := float64(a.readyAt.Sub(b.readyAt)) / float64(r.agingInterval)
+		if priorityDiff != waitDiff {
+			return priorityDiff > waitDiff
+		}
+	} else if a.Value.priority() != b.Value.priority() {
+		return a.Value.priority() > b.Value.priority()
+	}
+	return a.seq < b.seq
+}
+func (r readyHeap) Swap(i, j int) {
+	r.elements[i], r.elements[j] = r.elements[j], r.elements[i]
+	r.elements[i].readyIndex = i
+	r.elements[j].readyIndex = j
+}
+func (r *readyHeap) Push(x interface{}) {
+	e := x.(*Element)
+	e.readyIndex = len(r.elements)
+	r.elements = append(r.elements, e)
+}
+func (r *readyHeap) Pop() interface{} {
+	old := r.elements
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.readyIndex = -1
+	r.elements = old[:n-1]
+	return e
+}
+
+//markReady sets the job QUEUED and makes it available to Dequeue. Caller must hold q.mutex.
+//The job starts aging from now.
+func (q *JobListQueue) markReady(e *Element) {
+	e.Value.Status = "QUEUED"
+	if e.readyIndex < 0 {
+		e.readyAt = q.now()
+		heap.Push(&q.ready, e)
+	}
+	q.signalReady()
+}
+
+//snapshot returns a copy of the job with its current effective priority. Caller must hold q.mutex.
+//Jobs which are not QUEUED do not age.
+func (q *JobListQueue) snapshot(e *Element) job {
+	details := e.Value
+	details.EffectivePriority = details.priority()
+	if q.config.AgingInterval > 0 && e.Value.Status == "QUEUED" {
+		details.EffectivePriority += jobPriority(q.now().Sub(e.readyAt) / q.config.AgingInterval)
+	}
+	return details
+}
+
+//unready takes the job out of the ready heap. Caller must hold q.mutex.
+func (q *JobListQueue) unready(e *Element) {
+	if e.readyIndex >= 0 {
+		heap.Remove(&q.ready, e.readyIndex)
+	}
+}
+
+//popReady returns the QUEUED job with the highest priority, or nil if there is none. Caller must hold q.mutex.
+func (q *JobListQueue) popReady() *Element {
+	if q.ready.Len() == 0 {
+		return nil
+	}
+	return heap.Pop(&q.ready).(*Element)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestJobPriority_UnmarshalJSON(t *testing.T) {
+	tests := map[string]jobPriority{
+		`{"priority": 7}`:                   7,
+		`{"priority": "7"}`:                 7,
+		`{"priority": -3}`:                  -3,
+		`{"priority": "TIME_CRITICAL"}`:     priorityTimeCritical,
+		`{"priority": "NOT_TIME_CRITICAL"}`: priorityNotTimeCritical,
+		`{"priority": 0}`:                   0,
+	}
+	for body, want := range tests {
+		var item job
+		err := json.Unmarshal([]byte(body), &item)
+		assert.Nil(t, err, body)
+		assert.Equal(t, newPriority(want), item.Priority, body)
+	}
+
+	var item job
+	assert.Nil(t, json.Unmarshal([]byte(`{}`), &item))
+	assert.Nil(t, item.Priority)
+	assert.NotNil(t, json.Unmarshal([]byte(`{"priority": "URGENT"}`), &item))
+}
+
+func TestJobListQueue_DequeueByPriority(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+
+	low := job{Type: "NOT_TIME_CRITICAL"}
+	idLow, _ := q.Enqueue(&low)
+	mid1 := job{Type: "REPORT", Priority: newPriority(5)}
+	idMid1, _ := q.Enqueue(&mid1)
+	critical := job{Type: "TIME_CRITICAL"}
+	idCritical, _ := q.Enqueue(&critical)
+	mid2 := job{Type: "REPORT", Priority: newPriority(5)}
+	idMid2, _ := q.Enqueue(&mid2)
+	assert.Equal(t, newPriority(priorityTimeCritical), critical.Priority)
+
+	//A priority sent as 0 is kept, only a missing one takes the priority of the type.
+	zero := job{Type: "TIME_CRITICAL", Priority: newPriority(0)}
+	q.Enqueue(&zero)
+	assert.Equal(t, newPriority(0), zero.Priority)
+
+	for _, want := range []int{idCritical, idMid1, idMid2, idLow, zero.Id} {
+		item, err := q.Dequeue("cId1")
+		assert.Nil(t, err)
+		assert.Equal(t, want, item.Id)
+	}
+	_, err := q.Dequeue("cId1")
+	assert.NotNil(t, err)
+}
+
+func TestJobListQueue_RemovedJobIsNotDequeued(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+
+	item1 := job{Type: "TIME_CRITICAL"}
+	id1, _ := q.Enqueue(&item1)
+	item2 := job{Type: "NOT_TIME_CRITICAL"}
+	id2, _ := q.Enqueue(&item2)
+
+	removed, _ := q.Remove()
+	assert.Equal(t, id1, removed)
+	item, err := q.Dequeue("cId1")
+	assert.Nil(t, err)
+	assert.Equal(t, id2, item.Id)
+	assert.Equal(t, 0, q.ready.Len())
+}
+
+func TestJobListQueue_Aging(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	config.AgingInterval = time.Minute
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	low := job{Type: "NOT_TIME_CRITICAL"}
+	idLow, _ := q.Enqueue(&low)
+
+	//The low priority job waited long enough to catch up with the critical ones enqueued after it
+	now = now.Add(11 * time.Minute)
+	item, _ := q.GetJob(idLow)
+	assert.Equal(t, jobPriority(11), item.EffectivePriority)
+	assert.Equal(t, newPriority(priorityNotTimeCritical), item.Priority)
+
+	for i := 0; i < 3; i++ {
+		critical := job{Type: "TIME_CRITICAL"}
+		q.Enqueue(&critical)
+	}
+	item, err := q.Dequeue("cId1")
+	assert.Nil(t, err)
+	assert.Equal(t, idLow, item.Id)
+	assert.Equal(t, jobPriority(11), item.EffectivePriority)
+
+	//Leased jobs do not age
+	now = now.Add(time.Hour)
+	item, _ = q.GetJob(idLow)
+	assert.Equal(t, priorityNotTimeCritical, item.EffectivePriority)
+}
+
+func TestJobListQueue_NoAging(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	low := job{Type: "NOT_TIME_CRITICAL"}
+	q.Enqueue(&low)
+	now = now.Add(24 * time.Hour)
+	critical := job{Type: "TIME_CRITICAL"}
+	idCritical, _ := q.Enqueue(&critical)
+
+	item, _ := q.Dequeue("cId1")
+	assert.Equal(t, idCritical, item.Id)
+	assert.Equal(t, priorityTimeCritical, item.EffectivePriority)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"time"
+)
+
+//Wire types of the protocol buffers encoding. Groups are not supported.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errProtobuf = errors.New("Malformed protocol buffers message")
+
+//protoWriter encodes a message in the protocol buffers format. As in proto3, fields holding the zero value of their
+//type are left out.
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.buf = append(w.buf, b[:n]...)
+}
+
+func (w *protoWriter) tag(field int, wireType int) {
+	w.uvarint(uint64(field)<<3 | uint64(wireType))
+}
+
+//int writes an int32 or int64 field. Negative values take ten bytes, as they do in protoc generated code.
+func (w *protoWriter) int(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, wireVarint)
+	w.uvarint(uint64(v))
+}
+
+//presentInt writes an optional int32 or int64 field, whose presence is kept, zero included.
+func (w *protoWriter) presentInt(field int, v int64) {
+	w.tag(field, wireVarint)
+	w.uvarint(uint64(v))
+}
+
+func (w *protoWriter) bool(field int, v bool) {
+	if v {
+		w.tag(field, wireVarint)
+		w.uvarint(1)
+	}
+}
+
+func (w *protoWriter) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	w.message(field, v)
+}
+
+func (w *protoWriter) string(field int, v string) {
+	w.bytes(field, []byte(v))
+}
+
+//message writes an embedded message, also when it is empty.
+func (w *protoWriter) message(field int, m []byte) {
+	w.tag(field, wireBytes)
+	w.uvarint(uint64(len(m)))
+	w.buf = append(w.buf, m...)
+}
+
+//timestamp writes t as a google.protobuf.Timestamp, nothing when t is nil.
+func (w *protoWriter) timestamp(field int, t *time.Time) {
+	if t == nil {
+		return
+	}
+	var m protoWriter
+	m.int(1, t.Unix())
+	m.int(2, int64(t.Nanosecond()))
+	w.message(field, m.buf)
+}
+
+//protoReader decodes a message in the protocol buffers format. Unknown fields are skipped.
+type protoReader struct {
+	buf      []byte
+	wireType int
+}
+
+//readMessage calls read for every field of the message, which reads the field with the reader or skips it.
+func readMessage(data []byte, read func(r *protoReader, field int) error) error {
+	r := &protoReader{buf: data}
+	for len(r.buf) > 0 {
+		key, err := r.uvarint()
+		if err != nil {
+			return err
+		}
+		field := int(key >> 3)
+		if field == 0 {
+			return errProtobuf
+		}
+		r.wireType = int(key & 7)
+		if err := read(r, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *protoReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, errProtobuf
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+//int reads an int32 or int64 field.
+func (r *protoReader) int() (int64, error) {
+	if r.wireType != wireVarint {
+		return 0, errProtobuf
+	}
+	v, err := r.uvarint()
+	return int64(v), err
+}
+
+func (r *protoReader) bool() (bool, error) {
+	v, err := r.int()
+	return v != 0, err
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	if r.wireType != wireBytes {
+		return nil, errProtobuf
+	}
+	n, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.buf)) {
+		return nil, errProtobuf
+	}
+	v := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+func (r *protoReader) string() (string, error) {
+	v, err := r.bytes()
+	return string(v), err
+}
+
+//message reads an embedded message.
+func (r *protoReader) message(read func(r *protoReader, field int) error) error {
+	m, err := r.bytes()
+	if err != nil {
+		return err
+	}
+	return readMessage(m, read)
+}
+
+//secondsAndNanos reads a google.protobuf.Timestamp or google.protobuf.Duration, which share their layout.
+func (r *protoReader) secondsAndNanos() (int64, int64, error) {
+	var seconds, nanos int64
+	err := r.message(func(r *protoReader, field int) (err error) {
+		switch field {
+		case 1:
+			seconds, err = r.int()
+		case 2:
+			nanos, err = r.int()
+		default:
+			err = r.skip()
+		}
+		return err
+	})
+	return seconds, int64(int32(nanos)), err
+}
+
+func (r *protoReader) timestamp() (*time.Time, error) {
+	seconds, nanos, err := r.secondsAndNanos()
+	if err != nil {
+		return nil, err
+	}
+	t := time.Unix(seconds, nanos).UTC()
+	return &t, nil
+}
+
+func (r *protoReader) duration() (time.Duration, error) {
+	seconds, nanos, err := r.secondsAndNanos()
+	return time.Duration(seconds)*time.Second + time.Duration(nanos), err
+}
+
+//skip passes over a field the message does not know.
+func (r *protoReader) skip() error {
+	var n int
+	switch r.wireType {
+	case wireVarint:
+		_, err := r.uvarint()
+		return err
+	case wireBytes:
+		_, err := r.bytes()
+		return err
+	case wireFixed64:
+		n = 8
+	case wireFixed32:
+		n = 4
+	default:
+		return errProtobuf
+	}
+	if len(r.buf) < n {
+		return errProtobuf
+	}
+	r.buf = r.buf[n:]
+	return nil
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"container/heap"
+	"context"
+	"encoding/json"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
-	"math/rand"
 	"sync"
 	"time"
 )
@@ -11,231 +13,285 @@ import (
 //Queue is an interface used for storing job details.
 type Queue interface {
 	Enqueue(item *job) (int, error)
+	EnqueueWithKey(item *job, idempotencyKey string) (int, enqueueOutcome, error)
+	EnqueueBatch(items []*job) ([]enqueued, error)
 	Dequeue(consumerId string) (*job, error)
+	DequeueBatch(consumerId string, max int) ([]job, error)
+	DequeueWait(ctx context.Context, consumerId string, max int, wait time.Duration) ([]job, error)
 	Conclude(jobID int, consumerId string) error
+	ConcludeWithResult(jobID int, consumerId string, result json.RawMessage) error
 	GetJob(jobID int) (*job, error)
 	GetJobs() (*[]job, error)
 	Remove() (int, error)
+	Heartbeat(jobID int, consumerId string, progress *int) (*job, error)
+	Fail(jobID int, consumerId string, reason string) (*job, error)
+	ListDeadLetters() []job
+	GetDeadLetter(jobID int) (*job, error)
+	Redrive(jobID int) (*job, error)
+	PurgeDeadLetter(jobID int) error
+	PurgeDeadLetters() int
 }
 
-//JobQueue is a concrete implementation of the Queue Interface using slice.
-//sync.Map is used to store jobId and index as key,value pair. This helps to get the job in constant time.
-type JobQueue struct {
-	items []job
-	count int
-	m     *sync.Map
-	mutex sync.Mutex
+//Returned when the payload of a job or the result reported for it is larger than the configured limit.
+var (
+	errPayloadTooLarge = errors.New("Job payload exceeds the size limit")
+	errResultTooLarge  = errors.New("Job result exceeds the size limit")
+)
 
-}
+//Returned by Dequeue when no job can be handed out.
+var (
+	errQueueEmpty     = errors.New("Dequeue on empty Job Queue.No jobs to process.")
+	errNoJobAvailable = errors.New("None of the jobs are available to deque")
+)
 
-func NewQueue() *JobQueue {
-	items := make([]job, 0)
-	count := 0
-	return &JobQueue{items, count, &sync.Map{}, sync.Mutex{}}
-}
+//errNotLeaseHolder is returned when a consumer acts on a job leased to another consumer.
+var errNotLeaseHolder = errors.New("Consumer does not hold the lease on the Job")
 
-//Adds a job to the queue.And changes the job Status to "QUEUED". Returns JobId and error.
-func (q *JobQueue) Enqueue(item *job) (int, error) {
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+// LinkedList Node structure.
+//seq is the position the job was enqueued at and readyIndex its index in the ready heap, -1 when it is not QUEUED.
+//readyAt is when the job last became QUEUED, it ages from then on.
+type Element struct {
+	Value      job
+	Prev       *Element
+	Next       *Element
+	seq        uint64
+	readyIndex int
+	readyAt    time.Time
+}
 
-	//Generate random JobId and add the status.
-	item.Id = rand.Int()
-	item.Status = "QUEUED"
+//JobListQueue is a concrete implementation of the Queue Interface using LinkedList.
+//The jobs are kept in a Store, by default a linked list with a map of jobId to element to get a job in constant time.
+//All reads and writes of the store and the jobs in it are guarded by mutex, so the lease reaper can run alongside the handlers.
+type JobListQueue struct {
+	store           Store
+	log             log.Logger
+	mutex           sync.Mutex
+	consumerDetails sync.Map
+	delayed         delayHeap
+	ready           readyHeap
+	seq             uint64
+	deadLetters     *DeadLetterStore
+	idempotencyKeys *idempotencyTable
+	uniqueKeys      map[string]int
+	readyWaiters    chan struct{}
+	journal         journal
+	events          queueEvents
+	config          QueueConfig
+	now             func() time.Time
+	done            chan struct{}
+	closeOnce       sync.Once
+	reaper          sync.WaitGroup
+}
 
-	q.items = append(q.items, *item)
+func NewLinkedListQueue(logger log.Logger) *JobListQueue {
+	return NewLinkedListQueueWithConfig(logger, DefaultQueueConfig())
+}
 
-	q.m.Store(item.Id, q.count) // Used to store the itemId with the index
-	q.count++
-	return item.Id, nil
+//NewLinkedListQueueWithConfig creates the queue and starts the lease reaper. Call Close to stop the reaper.
+func NewLinkedListQueueWithConfig(logger log.Logger, config QueueConfig) *JobListQueue {
+	return NewQueueWithStore(logger, config, newListStore())
 }
 
-//Returns a job from the queue . Jobs are considered available for Dequeue if the job has not been concluded or has not been Dequeued already.
-func (q *JobQueue) Dequeue(consumerId string) (*job, error) {
-	if q.count == 0 {
-		return nil, errors.New("Dequeue on empty Job Queue.No jobs to process")
+//NewQueueWithStore creates the queue on top of the store, picking up the jobs already in it, and starts the lease reaper.
+//A store which keeps the settings and dead letters of the queue as well overrides config with its settings.
+func NewQueueWithStore(logger log.Logger, config QueueConfig, store Store) *JobListQueue {
+	q := &JobListQueue{
+		store:           store,
+		log:             logger,
+		ready:           readyHeap{agingInterval: config.AgingInterval},
+		deadLetters:     NewDeadLetterStore(),
+		idempotencyKeys: newIdempotencyTable(),
+		uniqueKeys:      make(map[string]int),
+		config:          config,
+		now:             time.Now,
+		done:            make(chan struct{}),
 	}
-
-	//Dequeue from the front of the list. But given the constraint need to verify the status.
-	for index := 0; index < q.count; index++ {
-		if q.items[index].Status == "QUEUED" {
-			//Lock on the item to be dequeued instead of entire queue.This allows operations like enqueue & conclude without blocking
-			q.items[index].mutex.Lock()
-			q.items[index].Status = "IN_PROGRESS"
-			q.items[index].mutex.Unlock()
-			return &q.items[index], nil
-		}
+	q.mutex.Lock()
+	q.loadState()
+	q.mutex.Unlock()
+	q.rebuildIndexes()
+	if config.ReapInterval > 0 {
+		q.reaper.Add(1)
+		go q.reap(config.ReapInterval)
 	}
-
-	return nil, errors.New("Jobs are not available to process.")
+	return q
 }
 
-//Given JobID ,finish execution on the job and change the status to CONCLUDED.
-func (q *JobQueue) Conclude(jobID int, consumerId string) error {
-	if q.count == 0 {
-		return errors.New("Empty Job Queue.No jobs to Conclude")
-	}
-
-	//Get the index from the map
-	v, ok := q.m.Load(jobID)
-	if !ok {
-		return errors.New("JobId not present in the Queue")
-	}
+//Config returns the current config of the queue.
+func (q *JobListQueue) Config() QueueConfig {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 
-	index := v.(int)
-	time.Sleep(2 * time.Millisecond)    //Instead of job execution code
-	q.items[index].Status = "CONCLUDED" //Change the status to concluded.
-	return nil
+	return q.config
 }
 
-//Get job details given JobID
-func (q *JobQueue) GetJob(jobID int) (*job, error) {
-	if q.count == 0 {
-		return nil, errors.New("Empty Job Queue.")
-	}
+//Configure replaces the config of the queue. The reaper keeps its interval, every other setting applies from now on.
+//The config is kept unchanged when the change cannot be recorded.
+func (q *JobListQueue) Configure(config QueueConfig) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 
-	//Get the index from the map
-	v, ok := q.m.Load(jobID)
-	if !ok {
-		return nil, errors.New("JobId not present in the Queue")
+	config.ReapInterval = q.config.ReapInterval
+	if config.IDs == nil {
+		config.IDs = q.config.IDs
 	}
-	return &q.items[v.(int)], nil
-}
-
-//Get all the jobs in the Queue
-func (q *JobQueue) GetJobs() (*[]job, error) {
-	if q.count == 0 {
-		return nil, errors.New("Empty Job Queue")
+	settings := settingsOf(config)
+	if err := q.writeRecord(walRecord{Op: "configure", Config: &settings}); err != nil {
+		return err
 	}
-	arr := make([]job, 0)
-	for index := 0; index < q.count; index++ {
-		arr = append(arr, q.items[index])
+	q.config = config
+	if q.ready.agingInterval != config.AgingInterval {
+		//The order of the ready heap depends on the aging interval.
+		q.ready.agingInterval = config.AgingInterval
+		heap.Init(&q.ready)
 	}
-	return &arr, nil
+	return nil
 }
 
-//Remove the item from the front of the Queue
-func (q *JobQueue) Remove() (int, error) {
+//Len returns the number of jobs in the queue, dead-lettered jobs not included.
+func (q *JobListQueue) Len() int {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
-	if q.count == 0 {
-		return 0, errors.New("Empty Job Queue.")
-	}
-
-	firstItem := q.items[0]
-	q.items = q.items[1:]
-	q.m.Delete(firstItem.Id)
-
-	return firstItem.Id, nil
-}
-
-// LinkedList Node structure.
-type Element struct {
-	Value job
-	Prev  *Element
-	Next  *Element
+	return q.store.Len()
 }
 
-//JobListQueue is a concrete implementation of the Queue Interface using LinkedList.
-//sync.Map is used to store jobId and index as key,value pair. This helps to get the job in constant time.
-type JobListQueue struct {
-	head            *Element
-	tail            *Element
-	count           int
-	log             log.Logger
-	mutex           sync.Mutex
-	m               sync.Map
-	consumerDetails sync.Map
-//
-}
+//Ready returns the number of jobs dequeue can hand out now.
+func (q *JobListQueue) Ready() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 
-func NewLinkedListQueue(logger log.Logger) *JobListQueue {
-	count := 0
-	return &JobListQueue{nil, nil, count, logger, sync.Mutex{}, sync.Map{}, sync.Map{}}
+	return q.ready.Len()
 }
 
 //Adds a job to the queue.And changes the job Status to "QUEUED". Returns JobId and error.
+//The payload is stored as is and handed to the consumer on Dequeue.
+//A job with RunAt in the future is SCHEDULED instead and only becomes QUEUED once RunAt has passed.
 func (q *JobListQueue) Enqueue(item *job) (int, error) {
+	id, _, err := q.EnqueueWithKey(item, "")
+	return id, err
+}
+
+//EnqueueWithKey enqueues the job unless a job was enqueued with the same idempotency key within the idempotency
+//window, or the uniqueKey of the job is taken. The outcome tells which job the returned id belongs to.
+//An empty idempotency key never matches.
+func (q *JobListQueue) EnqueueWithKey(item *job, idempotencyKey string) (int, enqueueOutcome, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
-	//Generate random JobId and add the status.
-	item.Id = rand.Int()
-	item.Status = "QUEUED"
-	newElement := Element{Value: *item}
+	if id, ok := q.idempotentJob(idempotencyKey); ok {
+		return id, outcomeReplayed, nil
+	}
+	if q.config.MaxPayloadBytes > 0 && len(item.Payload) > q.config.MaxPayloadBytes {
+		return 0, outcomeEnqueued, errPayloadTooLarge
+	}
+	id, existing, replaced, err := q.claimUniqueKey(item)
+	if err != nil {
+		return 0, outcomeEnqueued, err
+	}
+	if existing {
+		return id, outcomeExisting, nil
+	}
+	id, err = q.enqueueReplacing(item, idempotencyKey, replaced)
+	return id, outcomeEnqueued, err
+}
 
-	if q.head == nil {
-		q.head = &newElement
-		q.tail = &newElement
+//enqueue adds the job. Caller must hold q.mutex.
+func (q *JobListQueue) enqueue(item *job, idempotencyKey string) (int, error) {
+	//Generate a new JobId and add the status. The generator knows the ids of recovered jobs, an id already taken
+	//means two generators hand out the same ids.
+	item.Id = q.ids().NextID()
+	if _, err := q.deadLetters.Get(item.Id); err == nil {
+		q.log.Log("level", "error", "msg", "generated JobId is taken", "jobId", item.Id)
+		return 0, errJobIdTaken
+	}
+	item.Status = "QUEUED"
+	item.DelaySeconds = 0
+	item.Result = nil
+	item.ConsumerId = ""
+	item.LeaseDeadline = nil
+	item.Progress = 0
+	item.Attempts = 0
+	item.LastError = ""
+	item.RetryAt = nil
+	item.History = nil
+	item.DeadLetteredAt = nil
+	item.IdempotencyKey = idempotencyKey
+	now := q.now()
+	item.EnqueuedAt = &now
+	defaultPriority(item)
+	newElement := &Element{Value: *item}
+	if err := q.pushBack(newElement); err != nil {
+		return 0, err
+	}
+	if item.RunAt != nil && item.RunAt.After(q.now()) {
+		q.delay(newElement, "SCHEDULED", *item.RunAt)
+		item.Status = "SCHEDULED"
 	} else {
-		newElement.Prev = q.tail
-		q.tail.Next = &newElement
-		q.tail = &newElement
+		q.markReady(newElement)
+	}
+	q.rememberKey(newElement)
+	q.rememberUniqueKey(newElement)
+	if err := q.record("enqueue", newElement); err != nil {
+		return 0, err
 	}
-	q.m.Store(item.Id, &newElement) //Used to store the itemId and Address of the item as key,value pair.
-	q.count++
 	return item.Id, nil
 }
 
-//Returns a job from the queue . Jobs are considered available for Dequeue if the job has not been concluded or has not been Dequeued already.
-func (q *JobListQueue) Dequeue(consumerId string) (*job, error) {
-	if q.head == nil {
-		return nil, errors.New("Dequeue on empty Job Queue.No jobs to process.")
+//ids returns the id generator of the queue.
+func (q *JobListQueue) ids() IDGenerator {
+	if q.config.IDs == nil {
+		return defaultIDs
 	}
+	return q.config.IDs
+}
 
-	//Dequeue from the front of the list. But given the constraint need to verify the status.
-	curr := q.head
-	for curr != nil {
-		if curr.Value.Status == "QUEUED" {
-			//Check the type of the JOb. If time_critical return that. Otherwise move towards the end till you find the time_Critical.
-			if curr.Value.Type == "TIME_CRITICAL" {
-				//Found the job.
-				//Lock on the item to be dequeued instead of entire queue.This allows operations like enqueue & conclude without blocking
-				curr.Value.mutex.Lock()
-				curr.Value.Status = "IN_PROGRESS"
-				//Add the details to map
-				q.consumerDetails.Store(curr.Value.Id, consumerId) //Used to store the itemId and Address of the item as key,value pair.
-				curr.Value.mutex.Unlock()
-
-				return &curr.Value, nil
-			} else {
-				for curr != nil {
-					curr = curr.Next
-					if curr.Value.Type == "TIME_CRITICAL" {
-						//Found the job. Then do the return .
-						//Lock on the item to be dequeued instead of entire queue.This allows operations like enqueue & conclude without blocking
-						curr.Value.mutex.Lock()
-						curr.Value.Status = "IN_PROGRESS"
-						//Add the details to map
-						q.consumerDetails.Store(curr.Value.Id, consumerId) //Used to store the itemId and Address of the item as key,value pair.
-						curr.Value.mutex.Unlock()
-
-						return &curr.Value, nil
-					}
-				}
-				//It means there is no time_critical job in the queue. So i will return the head of the queue.
-				//Lock on the item to be dequeued instead of entire queue.This allows operations like enqueue & conclude without blocking
-				curr.Value.mutex.Lock()
-				curr.Value.Status = "IN_PROGRESS"
-				//Add the details to map
-				q.consumerDetails.Store(curr.Value.Id, consumerId) //Used to store the itemId and Address of the item as key,value pair.
-				curr.Value.mutex.Unlock()
-
-				return &curr.Value, nil
-			}
-		}
-		curr = curr.Next
+//pushBack appends the element to the end of the store. Caller must hold q.mutex.
+//The id generator learns about the job, so it never hands out its id again.
+func (q *JobListQueue) pushBack(newElement *Element) error {
+	q.ids().Observe(newElement.Value.Id)
+	q.seq++
+	newElement.seq = q.seq
+	newElement.readyIndex = -1
+	err := q.store.Append(newElement)
+	if err != nil {
+		q.log.Log("level", "error", "msg", "failed to store job", "jobId", newElement.Value.Id, "error", err.Error())
+	}
+	return err
+}
+
+//Returns a job from the queue . Jobs are considered available for Dequeue if the job has not been concluded or has not been Dequeued already.
+//The consumer is granted a lease on the job. If the lease runs out before the job is concluded the job becomes available again.
+func (q *JobListQueue) Dequeue(consumerId string) (*job, error) {
+	jobs, err := q.DequeueBatch(consumerId, 1)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("None of the jobs are available to deque")
+	return &jobs[0], nil
 }
 
 //For the jobId provided ,finishes execution on the job and change the status to CONCLUDED
+//Only the consumer holding the lease on the job can conclude it.
 func (q *JobListQueue) Conclude(jobID int, consumerId string) error {
-	if q.head == nil {
+	return q.ConcludeWithResult(jobID, consumerId, nil)
+}
+
+//ConcludeWithResult concludes the job and stores the result reported by the consumer on it.
+func (q *JobListQueue) ConcludeWithResult(jobID int, consumerId string, result json.RawMessage) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.config.MaxResultBytes > 0 && len(result) > q.config.MaxResultBytes {
+		return errResultTooLarge
+	}
+
+	if q.store.Len() == 0 {
 		return errors.New("Empty Job Queue.No jobs to Conclude.")
 	}
 
+	//Leases which ran out must not be concluded by their former holder.
+	q.requeueExpired()
+
 	//Get the consumerId used to Dequeue the Job
 	cId, ok := q.consumerDetails.Load(jobID)
 	if !ok {
@@ -246,61 +302,57 @@ func (q *JobListQueue) Conclude(jobID int, consumerId string) error {
 		return errors.New("Not Valid consumer to Conclude the Job")
 	}
 
-	//Get the index from the map
-	v, ok := q.m.Load(jobID)
+	//Get the element from the store
+	addrOfElement, ok := q.store.Get(jobID)
 	if !ok {
 		return errors.New("JobId not present in the Queue")
 	}
 
-	addrOfElement := v.(*Element)
-
-	addrOfElement.Value.mutex.Lock()
-	time.Sleep(2 * time.Millisecond)         //Instead of job execution code
+	q.releaseLease(addrOfElement)
 	addrOfElement.Value.Status = "CONCLUDED" //Change the status to concluded.
-	addrOfElement.Value.mutex.Unlock()
+	addrOfElement.Value.Result = result
 
-	return nil
+	return q.record("conclude", addrOfElement)
 }
 
 func (q *JobListQueue) Cancel(jobID int) error {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
-	if q.head == nil {
+	if q.store.Len() == 0 {
 		return errors.New("Empty Job Queue.No jobs to Conclude.")
 	}
 
-	//Get the index from the map
-	v, ok := q.m.Load(jobID)
+	//Get the element from the store
+	e, ok := q.store.Get(jobID)
 	if !ok {
 		return errors.New("JobId not present in the Queue")
 	}
 
-	addrOfElement := v.(*Element)
-
-	prev := addrOfElement.Prev
-	next := addrOfElement.Next
-	prev.Next = next
-	next.Prev = prev
-
-	addrOfElement = nil
-
-	return nil
+	if err := q.unlink(e); err != nil {
+		return err
+	}
+	return q.record("cancel", e)
 }
 
-//Given a job ID, returns details about the job
+//Given a job ID, returns details about the job. Dead-lettered jobs are looked up as well.
 func (q *JobListQueue) GetJob(jobID int) (*job, error) {
-	if q.head == nil {
-		return nil, errors.New("Empty Job Queue.")
-	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 
-	//Get the index from the map
-	v, ok := q.m.Load(jobID)
+	//Get the element from the store
+	e, ok := q.store.Get(jobID)
 	if !ok {
+		if deadLetter, err := q.deadLetters.Get(jobID); err == nil {
+			return deadLetter, nil
+		}
+		if q.store.Len() == 0 {
+			return nil, errors.New("Empty Job Queue.")
+		}
 		return nil, errors.New("JobId not present in the Queue")
 	}
-	addrOfElement := v.(*Element)
-	return &addrOfElement.Value, nil
+	details := q.snapshot(e)
+	return &details, nil
 }
 
 //Removes the job in front of the queue.
@@ -308,35 +360,45 @@ func (q *JobListQueue) Remove() (int, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
-	if q.head == nil {
+	if q.store.Len() == 0 {
 		return 0, errors.New("Empty Job Queue.")
 	}
-	//To store the next element in the list
-	curr := q.head
-	next := q.head.Next
-
-	q.m.Delete(q.head.Value.Id) //Delete the key from the map
 
-	//To remove connecting pointers
-	curr.Next = nil
-	q.head = next
-	q.head.Prev = nil
-
-	idDeleted := curr.Value.Id
-	curr = nil
-	return idDeleted, nil
+	removed := q.store.First()
+	if err := q.unlink(removed); err != nil {
+		return 0, err
+	}
+	if err := q.record("remove", removed); err != nil {
+		return 0, err
+	}
+	return removed.Value.Id, nil
 }
 
 //Returns info about all the jobs in the Queue.
 func (q *JobListQueue) GetJobs() (*[]job, error) {
-	if q.head == nil {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.store.Len() == 0 {
 		return nil, errors.New("Empty Job Queue")
 	}
-	arr := make([]job, 0)
-	curr := q.head
-	for curr != nil {
-		arr = append(arr, curr.Value)
-		curr = curr.Next
-	}
+	arr := make([]job, 0, q.store.Len())
+	q.store.Each(func(e *Element) bool {
+		arr = append(arr, q.snapshot(e))
+		return true
+	})
 	return &arr, nil
 }
+
+//unlink removes the element from the store and drops it from the ready heap and the leases. Caller must hold q.mutex.
+func (q *JobListQueue) unlink(e *Element) error {
+	q.unready(e)
+	q.consumerDetails.Delete(e.Value.Id)
+	q.forgetUniqueKey(e)
+	err := q.store.Remove(e)
+	if err != nil {
+		q.log.Log("level", "error", "msg", "failed to remove job from store", "jobId", e.Value.Id, "error", err.Error())
+		return err
+	}
+	return q.keepKey(e)
+}
@@ -4,97 +4,25 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
-func TestJobQueue_Enqueue(t *testing.T) {
-	var q = NewQueue()
-	item1 := job{Type: "TIME_CRITICAL"}
-	item2 := job{Type: "NOT_TIME_CRITICAL"}
-	q.Enqueue(&item1)
-	q.Enqueue(&item2)
-	if q.count != 2 {
-		t.Errorf("got %d expected %d \n", q.count, 2)
-	}
-	if q.items[0].Status != "QUEUED" {
-		t.Errorf("got %s expected %s \n", q.items[0].Status, "QUEUED")
-	}
-	v, ok := q.m.Load(item1.Id)
-	if !ok {
-		t.Errorf("item %d should be present in the list", item1.Id)
-	}
-	if v.(int) != q.count-2 {
-		t.Errorf("item %d should be mapped to index %d", item1.Id, q.count-2)
-	}
-}
-
-/*
-func TestJobQueue_Dequeue(t *testing.T) {
-	var q = NewQueue()
-	item1 := job{Type: "TIME_CRITICAL"}
-	item2 := job{Type: "NOT_TIME_CRITICAL"}
-	id1, _ := q.Enqueue(&item1)
-	id2, _ := q.Enqueue(&item2)
-
-	firstItem, _ := q.Dequeue()
-	if firstItem.Id != id1 {
-		t.Errorf("got %d expected %d \n", firstItem.Id, id1)
-	}
-	if firstItem.Status != "IN_PROGRESS" {
-		t.Errorf("got %s expected %s \n", firstItem.Status, "IN_PROGRESS")
-	}
-	secondItem, _ := q.Dequeue()
-	if secondItem.Id != id2 {
-		t.Errorf("got %d expected %d \n", secondItem.Id, id2)
-	}
-	if secondItem.Status != "IN_PROGRESS" {
-		t.Errorf("got %s expected %s \n", secondItem.Status, "IN_PROGRESS")
-	}
-}*/
-
-/*
-func TestJobQueue_Conclude(t *testing.T) {
-	var q = NewQueue()
-	item1 := job{Type: "TIME_CRITICAL"}
-	id1, _ := q.Enqueue(&item1)
-
-	q.Conclude(id1)
-	if q.items[0].Status != "CONCLUDED" {
-		t.Errorf("got %s expected %s \n", q.items[0].Status, "CONCLUDED")
-	}
-}*/
-
-func TestJobQueue_GetJob(t *testing.T) {
-	var q *JobQueue = NewQueue()
-	item1 := job{Type: "TIME_CRITICAL"}
-	id1, _ := q.Enqueue(&item1)
-
-	item, _ := q.GetJob(id1)
-	if item.Id != id1 {
-		t.Errorf("got %d expected %d \n", item.Id, id1)
-	}
-
-	var id2 int
-	expectedError := "JobId not present in the Queue"
-	_, actualError := q.GetJob(id2)
-	assert.Equal(t, expectedError, actualError.Error())
-}
-
 func TestJobListQueue_Enqueue(t *testing.T) {
 	var q = NewLinkedListQueue(log.NewNopLogger())
+	defer q.Close()
 	item1 := job{Type: "TIME_CRITICAL"}
 	id1, _ := q.Enqueue(&item1)
 
-	if q.count != 1 {
-		t.Errorf("got %d expected %d \n", q.count, 1)
+	if q.Len() != 1 {
+		t.Errorf("got %d expected %d \n", q.Len(), 1)
 	}
-	if q.head.Value.Id != id1 {
-		t.Errorf("got %d expected %d \n", q.head.Value.Id, id1)
+	if q.store.First().Value.Id != id1 {
+		t.Errorf("got %d expected %d \n", q.store.First().Value.Id, id1)
 	}
-	v, ok := q.m.Load(item1.Id)
+	addrOfElement, ok := q.store.Get(item1.Id)
 	if !ok {
 		t.Errorf("item %d should be present in the list", item1.Id)
 	}
-	addrOfElement := v.(*Element)
 	if addrOfElement.Value.Id != id1 {
 		t.Errorf("item %d should be mapped to index %d", item1.Id, addrOfElement.Value.Id)
 	}
@@ -102,6 +30,7 @@ func TestJobListQueue_Enqueue(t *testing.T) {
 
 func TestJobListQueue_Dequeue(t *testing.T) {
 	var q *JobListQueue = NewLinkedListQueue(log.NewNopLogger())
+	defer q.Close()
 	item1 := job{Type: "TIME_CRITICAL"}
 	id1, _ := q.Enqueue(&item1)
 	item2 := job{Type: "NOT_TIME_CRITICAL"}
@@ -119,6 +48,7 @@ func TestJobListQueue_Dequeue(t *testing.T) {
 
 func TestJobListQueue_Conclude(t *testing.T) {
 	var q *JobListQueue = NewLinkedListQueue(log.NewNopLogger())
+	defer q.Close()
 	item1 := job{Type: "TIME_CRITICAL"}
 	id1, _ := q.Enqueue(&item1)
 
@@ -129,17 +59,18 @@ func TestJobListQueue_Conclude(t *testing.T) {
 	if firstItem.Id != id1 {
 		t.Errorf("got %d expected %d \n", firstItem.Id, id1)
 	}
-	err := q.Conclude(id1, "cId2")
+	err := q.Conclude(id1, "cId1")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 	}
-	if q.head.Value.Status != "CONCLUDED" {
-		t.Errorf("got %s expected %s \n", q.head.Value.Status, "CONCLUDED")
+	if q.store.First().Value.Status != "CONCLUDED" {
+		t.Errorf("got %s expected %s \n", q.store.First().Value.Status, "CONCLUDED")
 	}
 }
 
 func TestJobListQueue_GetJob(t *testing.T) {
 	var q *JobListQueue = NewLinkedListQueue(log.NewNopLogger())
+	defer q.Close()
 	item1 := job{Type: "TIME_CRITICAL"}
 	id1, _ := q.Enqueue(&item1)
 
@@ -153,3 +84,168 @@ func TestJobListQueue_GetJob(t *testing.T) {
 	_, actualError := q.GetJob(id2)
 	assert.Equal(t, expectedError, actualError.Error())
 }
+
+func TestJobListQueue_LeaseExpiry(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	item1 := job{Type: "TIME_CRITICAL"}
+	id1, _ := q.Enqueue(&item1)
+
+	firstItem, _ := q.Dequeue("cId1")
+	assert.Equal(t, id1, firstItem.Id)
+	assert.Equal(t, "cId1", firstItem.ConsumerId)
+	assert.Equal(t, now.Add(config.LeaseTimeout), *firstItem.LeaseDeadline)
+
+	//Job is invisible while the lease is held
+	_, err := q.Dequeue("cId2")
+	assert.NotNil(t, err)
+
+	//Once the lease runs out the job is handed to the next consumer
+	now = now.Add(config.LeaseTimeout)
+	secondItem, err := q.Dequeue("cId2")
+	assert.Nil(t, err)
+	assert.Equal(t, id1, secondItem.Id)
+	assert.Equal(t, "cId2", secondItem.ConsumerId)
+
+	//The former holder can no longer conclude the job
+	assert.NotNil(t, q.Conclude(id1, "cId1"))
+	assert.Nil(t, q.Conclude(id1, "cId2"))
+}
+
+func TestJobListQueue_Reaper(t *testing.T) {
+	config := QueueConfig{LeaseTimeout: time.Millisecond, ReapInterval: time.Millisecond}
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+
+	item1 := job{Type: "NOT_TIME_CRITICAL"}
+	id1, _ := q.Enqueue(&item1)
+	q.Dequeue("cId1")
+
+	assert.Eventually(t, func() bool {
+		item, _ := q.GetJob(id1)
+		return item.Status == "QUEUED" && item.LeaseDeadline == nil
+	}, time.Second, time.Millisecond)
+}
+
+func TestJobListQueue_Heartbeat(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	item1 := job{Type: "TIME_CRITICAL"}
+	id1, _ := q.Enqueue(&item1)
+	q.Dequeue("cId1")
+
+	//Heartbeats from other consumers are rejected
+	_, err := q.Heartbeat(id1, "cId2", nil)
+	assert.Equal(t, errNotLeaseHolder, err)
+
+	//The holder keeps the job past the original deadline by sending heartbeats
+	now = now.Add(config.LeaseTimeout - time.Second)
+	progress := 40
+	item, err := q.Heartbeat(id1, "cId1", &progress)
+	assert.Nil(t, err)
+	assert.Equal(t, 40, item.Progress)
+	assert.Equal(t, now.Add(config.LeaseTimeout), *item.LeaseDeadline)
+
+	now = now.Add(2 * time.Second)
+	_, err = q.Dequeue("cId2")
+	assert.NotNil(t, err)
+	assert.Nil(t, q.Conclude(id1, "cId1"))
+}
+
+func TestJobListQueue_Fail(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	config.MaxAttemptsByType = TypeLimits{"TIME_CRITICAL": 2}
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	item1 := job{Type: "TIME_CRITICAL"}
+	id1, _ := q.Enqueue(&item1)
+	q.Dequeue("cId1")
+
+	_, err := q.Fail(id1, "cId2", "boom")
+	assert.Equal(t, errNotLeaseHolder, err)
+
+	//First failure schedules a retry after the base backoff
+	item, err := q.Fail(id1, "cId1", "boom")
+	assert.Nil(t, err)
+	assert.Equal(t, "RETRY_PENDING", item.Status)
+	assert.Equal(t, 1, item.Attempts)
+	assert.Equal(t, "boom", item.LastError)
+	assert.Equal(t, now.Add(config.RetryBackoff), *item.RetryAt)
+
+	//Job is invisible until the backoff elapsed
+	_, err = q.Dequeue("cId1")
+	assert.NotNil(t, err)
+	now = now.Add(config.RetryBackoff)
+	item, err = q.Dequeue("cId1")
+	assert.Nil(t, err)
+	assert.Equal(t, id1, item.Id)
+
+	//Second failure exhausts the limit of the job type
+	item, err = q.Fail(id1, "cId1", "boom again")
+	assert.Nil(t, err)
+	assert.Equal(t, "FAILED", item.Status)
+	assert.Equal(t, 2, item.Attempts)
+	_, err = q.GetDeadLetter(id1)
+	assert.Nil(t, err)
+}
+
+func TestJobListQueue_Backoff(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	config.RetryBackoff = time.Second
+	config.MaxRetryBackoff = 5 * time.Second
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+
+	assert.Equal(t, time.Second, q.backoff(1))
+	assert.Equal(t, 2*time.Second, q.backoff(2))
+	assert.Equal(t, 4*time.Second, q.backoff(3))
+	assert.Equal(t, 5*time.Second, q.backoff(4))
+}
+
+func TestJobListQueue_ScheduledEnqueue(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	later := now.Add(time.Minute)
+	soon := now.Add(time.Second)
+	item1 := job{Type: "TIME_CRITICAL", RunAt: &later}
+	id1, _ := q.Enqueue(&item1)
+	item2 := job{Type: "NOT_TIME_CRITICAL", RunAt: &soon}
+	id2, _ := q.Enqueue(&item2)
+	assert.Equal(t, "SCHEDULED", item1.Status)
+
+	_, err := q.Dequeue("cId1")
+	assert.NotNil(t, err)
+
+	//Jobs are promoted in order of their due time
+	now = now.Add(time.Second)
+	item, err := q.Dequeue("cId1")
+	assert.Nil(t, err)
+	assert.Equal(t, id2, item.Id)
+	_, err = q.Dequeue("cId1")
+	assert.NotNil(t, err)
+
+	now = now.Add(time.Minute)
+	item, err = q.Dequeue("cId1")
+	assert.Nil(t, err)
+	assert.Equal(t, id1, item.Id)
+}
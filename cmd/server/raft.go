@@ -0,0 +1,824 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Roles of a Raft node.
+const (
+	raftFollower  = "follower"
+	raftCandidate = "candidate"
+	raftLeader    = "leader"
+)
+
+var (
+	errNotLeader      = errors.New("This node is not the leader of the cluster")
+	errLeadershipLost = errors.New("Leadership was lost before the change was committed, it may or may not be applied")
+	errCommitTimeout  = errors.New("Timed out waiting for the change to be committed")
+)
+
+//RaftConfig holds the timings of a Raft node.
+//Elections start after ElectionTimeout to twice that without hearing from a leader. A leader which did not hear from
+//a majority of the nodes for ElectionTimeout steps down.
+//A cluster replaces the log by a snapshot of its queues once SnapshotEntries entries were added since the last one,
+//zero keeps the whole log.
+type RaftConfig struct {
+	HeartbeatInterval   time.Duration
+	ElectionTimeout     time.Duration
+	CommitTimeout       time.Duration
+	MaxEntriesPerAppend int
+	SnapshotEntries     int
+}
+
+func DefaultRaftConfig() RaftConfig {
+	return RaftConfig{
+		HeartbeatInterval:   50 * time.Millisecond,
+		ElectionTimeout:     500 * time.Millisecond,
+		CommitTimeout:       5 * time.Second,
+		MaxEntriesPerAppend: 256,
+		SnapshotEntries:     10000,
+	}
+}
+
+//raftEntry is an entry of the replicated log. Every new leader appends an entry without data to commit the
+//entries of earlier terms.
+type raftEntry struct {
+	Index uint64          `json:"index"`
+	Term  uint64          `json:"term"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+type voteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateId  string `json:"candidateId"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type voteResponse struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"voteGranted"`
+}
+
+type appendRequest struct {
+	Term         uint64      `json:"term"`
+	LeaderId     string      `json:"leaderId"`
+	PrevLogIndex uint64      `json:"prevLogIndex"`
+	PrevLogTerm  uint64      `json:"prevLogTerm"`
+	Entries      []raftEntry `json:"entries,omitempty"`
+	LeaderCommit uint64      `json:"leaderCommit"`
+}
+
+//appendResponse tells the leader where to continue when Success is false: ConflictIndex is the first index of
+//the conflicting term, or the end of the follower's log if it is too short.
+type appendResponse struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflictIndex,omitempty"`
+}
+
+//snapshotRequest sends the snapshot of the leader to a follower which needs entries compacted into it.
+type snapshotRequest struct {
+	Term     uint64       `json:"term"`
+	LeaderId string       `json:"leaderId"`
+	Snapshot raftSnapshot `json:"snapshot"`
+}
+
+type snapshotResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+}
+
+//raftTransport carries the RPCs of a node to its peers.
+type raftTransport interface {
+	RequestVote(peer string, req voteRequest) (voteResponse, error)
+	AppendEntries(peer string, req appendRequest) (appendResponse, error)
+	InstallSnapshot(peer string, req snapshotRequest) (snapshotResponse, error)
+}
+
+//raftStatus is a view of the state of a node.
+type raftStatus struct {
+	Id            string `json:"id"`
+	Role          string `json:"role"`
+	Term          uint64 `json:"term"`
+	Leader        string `json:"leader,omitempty"`
+	SnapshotIndex uint64 `json:"snapshotIndex"`
+	CommitIndex   uint64 `json:"commitIndex"`
+	LastIndex     uint64 `json:"lastIndex"`
+}
+
+//Raft replicates a log of entries to its peers. Entries are committed once a majority of the nodes stored them,
+//and a committed entry is never lost as long as a majority of the nodes is up.
+//A node which heard from its leader within the election timeout refuses to vote, so a leader acknowledged by a
+//majority within that time holds a lease: no other leader can be elected before it runs out.
+//The committed start of the log can be replaced by a snapshot. entries[0] stands for the last entry the snapshot
+//covers, or is a sentinel without one, so entries[i].Index == entries[0].Index+i.
+type Raft struct {
+	id               string
+	peers            []string
+	transport        raftTransport
+	storage          raftStorage
+	config           RaftConfig
+	log              log.Logger
+	mutex            sync.Mutex
+	role             string
+	term             uint64
+	votedFor         string
+	leaderId         string
+	heardFromLeader  time.Time
+	leaderSince      time.Time
+	entries          []raftEntry
+	snapshot         raftSnapshot
+	commitIndex      uint64
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	contact          map[string]time.Time
+	triggers         map[string]chan struct{}
+	electionDeadline time.Time
+	changed          chan struct{}
+	notify           chan struct{}
+	done             chan struct{}
+	closeOnce        sync.Once
+	waitGroup        sync.WaitGroup
+}
+
+//NewRaft loads the state of the node from storage and starts it as a follower. peers are the ids of the other nodes.
+func NewRaft(id string, peers []string, transport raftTransport, storage raftStorage, config RaftConfig, logger log.Logger) (*Raft, error) {
+	state, snapshot, entries, err := storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	r := &Raft{
+		id:          id,
+		peers:       peers,
+		transport:   transport,
+		storage:     storage,
+		config:      config,
+		log:         log.With(logger, "node", id),
+		role:        raftFollower,
+		term:        state.Term,
+		votedFor:    state.VotedFor,
+		entries:     append([]raftEntry{{Index: snapshot.Index, Term: snapshot.Term}}, entries...),
+		snapshot:    snapshot,
+		commitIndex: snapshot.Index,
+		changed:     make(chan struct{}),
+		notify:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	r.resetElectionDeadline()
+
+	r.waitGroup.Add(1)
+	go r.run()
+	return r, nil
+}
+
+//Notify returns a channel which receives a value whenever the role, term or commit index of the node changed.
+func (r *Raft) Notify() <-chan struct{} {
+	return r.notify
+}
+
+func (r *Raft) Status() raftStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return raftStatus{
+		Id:            r.id,
+		Role:          r.role,
+		Term:          r.term,
+		Leader:        r.leaderId,
+		SnapshotIndex: r.snapshotIndex(),
+		CommitIndex:   r.commitIndex,
+		LastIndex:     r.lastIndex(),
+	}
+}
+
+//LastIndex returns the index of the last entry in the log, committed or not.
+func (r *Raft) LastIndex() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.lastIndex()
+}
+
+//Entries returns the entries from index from up to index to, none if some of them were compacted.
+func (r *Raft) Entries(from uint64, to uint64) []raftEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if to > r.lastIndex() {
+		to = r.lastIndex()
+	}
+	if from <= r.snapshotIndex() || from > to {
+		return nil
+	}
+	return append([]raftEntry(nil), r.entries[from-r.snapshotIndex():to-r.snapshotIndex()+1]...)
+}
+
+//EntriesAfter returns the entries after index after up to index to. If some of them were compacted, it returns the
+//snapshot which replaced them too, and the entries after the snapshot.
+func (r *Raft) EntriesAfter(after uint64, to uint64) (*raftSnapshot, []raftEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var snapshot *raftSnapshot
+	if after < r.snapshotIndex() {
+		s := r.snapshot
+		snapshot = &s
+		after = s.Index
+	}
+	if to > r.lastIndex() {
+		to = r.lastIndex()
+	}
+	if after >= to {
+		return snapshot, nil
+	}
+	return snapshot, append([]raftEntry(nil), r.entries[after+1-r.snapshotIndex():to-r.snapshotIndex()+1]...)
+}
+
+//Compact replaces the entries up to index, which must be committed, by a snapshot of the state they lead to.
+func (r *Raft) Compact(index uint64, data []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if index <= r.snapshotIndex() {
+		return nil
+	}
+	if index > r.commitIndex {
+		return errors.Errorf("raft log entry %d is not committed", index)
+	}
+	snapshot := raftSnapshot{Index: index, Term: r.entry(index).Term, Data: data}
+	if err := r.storage.SaveSnapshot(snapshot); err != nil {
+		return err
+	}
+	r.entries = append([]raftEntry{{Index: index, Term: snapshot.Term}}, r.entries[index-r.snapshotIndex()+1:]...)
+	r.snapshot = snapshot
+	return nil
+}
+
+//Lease reports whether the node is the leader of term and a majority of the nodes acknowledged it within the
+//election timeout. Until the lease runs out no other node can be elected, so the state of the leader is current.
+func (r *Raft) Lease(term uint64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.role == raftLeader && r.term == term && time.Since(r.quorumContact()) < r.config.ElectionTimeout
+}
+
+//Propose appends data to the log if the node is still the leader of term, and returns its index.
+//The entry is replicated in the background, WaitCommitted tells when it is safe.
+func (r *Raft) Propose(term uint64, data []byte) (uint64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.role != raftLeader || r.term != term {
+		return 0, errNotLeader
+	}
+	entry := raftEntry{Index: r.lastIndex() + 1, Term: r.term, Data: data}
+	if err := r.storage.Append([]raftEntry{entry}); err != nil {
+		return 0, err
+	}
+	r.entries = append(r.entries, entry)
+	r.advanceCommit()
+	r.triggerReplication()
+	return entry.Index, nil
+}
+
+//WaitCommitted waits until the entry at index, appended in term, is committed.
+func (r *Raft) WaitCommitted(index uint64, term uint64) error {
+	timeout := time.NewTimer(r.config.CommitTimeout)
+	defer timeout.Stop()
+	for {
+		r.mutex.Lock()
+		if index <= r.snapshotIndex() {
+			//The entry is committed, but only a leader of another term could have replaced it.
+			lost := r.term != term
+			r.mutex.Unlock()
+			if lost {
+				return errLeadershipLost
+			}
+			return nil
+		}
+		if index <= r.lastIndex() && r.entry(index).Term != term {
+			r.mutex.Unlock()
+			return errLeadershipLost
+		}
+		if r.commitIndex >= index {
+			r.mutex.Unlock()
+			return nil
+		}
+		if r.role != raftLeader || r.term != term {
+			r.mutex.Unlock()
+			return errLeadershipLost
+		}
+		changed := r.changed
+		r.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return errCommitTimeout
+		case <-r.done:
+			return errLeadershipLost
+		}
+	}
+}
+
+//snapshotIndex returns the index of the last entry the snapshot covers, 0 without a snapshot.
+func (r *Raft) snapshotIndex() uint64 {
+	return r.entries[0].Index
+}
+
+func (r *Raft) lastIndex() uint64 {
+	return r.entries[0].Index + uint64(len(r.entries)-1)
+}
+
+//entry returns the entry at index, from the index of the snapshot up to the last one.
+func (r *Raft) entry(index uint64) raftEntry {
+	return r.entries[index-r.entries[0].Index]
+}
+
+func (r *Raft) lastTerm() uint64 {
+	return r.entries[len(r.entries)-1].Term
+}
+
+//signal wakes up everyone waiting for a change of role, term or commit index. Caller must hold r.mutex.
+func (r *Raft) signal() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Raft) resetElectionDeadline() {
+	timeout := r.config.ElectionTimeout + time.Duration(rand.Int63n(int64(r.config.ElectionTimeout)))
+	r.electionDeadline = time.Now().Add(timeout)
+}
+
+func (r *Raft) saveState() error {
+	return r.storage.SaveState(raftState{Term: r.term, VotedFor: r.votedFor})
+}
+
+//run starts an election whenever the node has not heard from a leader for an election timeout. A leader which has
+//not heard from a majority for an election timeout steps down, it may be cut off from the rest of the cluster.
+func (r *Raft) run() {
+	defer r.waitGroup.Done()
+	ticker := time.NewTicker(r.config.ElectionTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mutex.Lock()
+			if r.role != raftLeader && time.Now().After(r.electionDeadline) {
+				r.startElection()
+			}
+			if r.role == raftLeader && !r.hasQuorum() {
+				r.log.Log("level", "warn", "msg", "lost contact with a majority of the nodes", "term", r.term)
+				r.becomeFollower(r.term, "")
+			}
+			r.mutex.Unlock()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+//startElection makes the node a candidate of the next term and asks its peers for their votes. Caller must hold r.mutex.
+func (r *Raft) startElection() {
+	r.role = raftCandidate
+	r.term++
+	r.votedFor = r.id
+	r.leaderId = ""
+	r.resetElectionDeadline()
+	if err := r.saveState(); err != nil {
+		r.log.Log("level", "error", "msg", "failed to save raft state", "error", err.Error())
+		return
+	}
+	r.log.Log("level", "info", "msg", "starting election", "term", r.term)
+	r.signal()
+
+	if len(r.peers) == 0 {
+		r.becomeLeader()
+		return
+	}
+
+	req := voteRequest{Term: r.term, CandidateId: r.id, LastLogIndex: r.lastIndex(), LastLogTerm: r.lastTerm()}
+	votes := 1
+	for _, peer := range r.peers {
+		r.waitGroup.Add(1)
+		go func(peer string) {
+			defer r.waitGroup.Done()
+			resp, err := r.transport.RequestVote(peer, req)
+			if err != nil {
+				return
+			}
+
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if resp.Term > r.term {
+				r.becomeFollower(resp.Term, "")
+				return
+			}
+			if r.role != raftCandidate || r.term != req.Term || !resp.VoteGranted {
+				return
+			}
+			votes++
+			if votes*2 > len(r.peers)+1 {
+				r.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+//becomeFollower steps down to follower, moving on to term if it is newer. Caller must hold r.mutex.
+func (r *Raft) becomeFollower(term uint64, leaderId string) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		if err := r.saveState(); err != nil {
+			r.log.Log("level", "error", "msg", "failed to save raft state", "error", err.Error())
+		}
+	}
+	if r.role == raftLeader {
+		r.log.Log("level", "info", "msg", "stepping down", "term", r.term)
+	}
+	r.role = raftFollower
+	r.leaderId = leaderId
+	r.resetElectionDeadline()
+	r.signal()
+}
+
+//becomeLeader takes over the cluster for the current term. Caller must hold r.mutex.
+func (r *Raft) becomeLeader() {
+	r.role = raftLeader
+	r.leaderId = r.id
+	r.leaderSince = time.Now()
+	r.log.Log("level", "info", "msg", "elected leader", "term", r.term)
+
+	//Entries of earlier terms are only committed together with an entry of the current term.
+	entry := raftEntry{Index: r.lastIndex() + 1, Term: r.term}
+	if err := r.storage.Append([]raftEntry{entry}); err != nil {
+		r.log.Log("level", "error", "msg", "failed to append to raft log", "error", err.Error())
+		r.becomeFollower(r.term, "")
+		return
+	}
+	r.entries = append(r.entries, entry)
+
+	r.nextIndex = make(map[string]uint64)
+	r.matchIndex = make(map[string]uint64)
+	r.contact = make(map[string]time.Time)
+	r.triggers = make(map[string]chan struct{})
+	for _, peer := range r.peers {
+		r.nextIndex[peer] = r.lastIndex()
+		r.matchIndex[peer] = 0
+		r.triggers[peer] = make(chan struct{}, 1)
+		r.waitGroup.Add(1)
+		go r.replicate(peer, r.term, r.triggers[peer])
+	}
+	r.advanceCommit()
+	r.signal()
+}
+
+//quorumContact returns the time since when a majority of the nodes, the leader included, is known to follow the
+//leader. The contact with a peer is the time the last request it answered was sent. Caller must hold r.mutex.
+func (r *Raft) quorumContact() time.Time {
+	needed := (len(r.peers) + 1) / 2
+	if needed == 0 {
+		return time.Now()
+	}
+	times := make([]time.Time, 0, len(r.peers))
+	for _, peer := range r.peers {
+		times = append(times, r.contact[peer])
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+	return times[needed-1]
+}
+
+//hasQuorum reports whether the leader heard from a majority within the election timeout, counting from the
+//election. Caller must hold r.mutex.
+func (r *Raft) hasQuorum() bool {
+	since := r.quorumContact()
+	if since.Before(r.leaderSince) {
+		since = r.leaderSince
+	}
+	return time.Since(since) < r.config.ElectionTimeout
+}
+
+//triggerReplication wakes up the replication to every peer. Caller must hold r.mutex.
+func (r *Raft) triggerReplication() {
+	for _, trigger := range r.triggers {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//replicate sends new entries, or a heartbeat, to the peer for as long as the node is the leader of term.
+func (r *Raft) replicate(peer string, term uint64, trigger chan struct{}) {
+	defer r.waitGroup.Done()
+	ticker := time.NewTicker(r.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		more, leading := r.sendAppend(peer, term)
+		if !leading {
+			return
+		}
+		if more {
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-trigger:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+//sendAppend sends the entries the peer is missing. It reports whether more are left to send, and whether the
+//node is still the leader of term.
+func (r *Raft) sendAppend(peer string, term uint64) (bool, bool) {
+	r.mutex.Lock()
+	if r.role != raftLeader || r.term != term {
+		r.mutex.Unlock()
+		return false, false
+	}
+	next := r.nextIndex[peer]
+	last := r.lastIndex()
+	if next > last+1 {
+		next = last + 1
+	}
+	if next <= r.snapshotIndex() {
+		snapshot := r.snapshot
+		r.mutex.Unlock()
+		return r.sendSnapshot(peer, term, snapshot)
+	}
+	end := next + uint64(r.config.MaxEntriesPerAppend)
+	if end > last+1 {
+		end = last + 1
+	}
+	base := r.snapshotIndex()
+	req := appendRequest{
+		Term:         term,
+		LeaderId:     r.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.entry(next - 1).Term,
+		Entries:      append([]raftEntry(nil), r.entries[next-base:end-base]...),
+		LeaderCommit: r.commitIndex,
+	}
+	r.mutex.Unlock()
+
+	sent := time.Now()
+	resp, err := r.transport.AppendEntries(peer, req)
+	if err != nil {
+		//The peer is down or unreachable, try again with the next heartbeat.
+		return false, true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if resp.Term > r.term {
+		r.becomeFollower(resp.Term, "")
+		return false, false
+	}
+	if r.role != raftLeader || r.term != term {
+		return false, false
+	}
+	if sent.After(r.contact[peer]) {
+		r.contact[peer] = sent
+	}
+	if !resp.Success {
+		next = req.PrevLogIndex
+		if resp.ConflictIndex > 0 && resp.ConflictIndex < next {
+			next = resp.ConflictIndex
+		}
+		if next < 1 {
+			next = 1
+		}
+		r.nextIndex[peer] = next
+		return true, true
+	}
+
+	match := req.PrevLogIndex + uint64(len(req.Entries))
+	if match > r.matchIndex[peer] {
+		r.matchIndex[peer] = match
+	}
+	r.nextIndex[peer] = match + 1
+	r.advanceCommit()
+	return r.nextIndex[peer] <= r.lastIndex(), true
+}
+
+//sendSnapshot sends the snapshot to a peer which needs entries compacted into it. It reports the same as sendAppend.
+func (r *Raft) sendSnapshot(peer string, term uint64, snapshot raftSnapshot) (bool, bool) {
+	req := snapshotRequest{Term: term, LeaderId: r.id, Snapshot: snapshot}
+	sent := time.Now()
+	resp, err := r.transport.InstallSnapshot(peer, req)
+	if err != nil {
+		return false, true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if resp.Term > r.term {
+		r.becomeFollower(resp.Term, "")
+		return false, false
+	}
+	if r.role != raftLeader || r.term != term {
+		return false, false
+	}
+	if sent.After(r.contact[peer]) {
+		r.contact[peer] = sent
+	}
+	if !resp.Success {
+		return false, true
+	}
+	if snapshot.Index > r.matchIndex[peer] {
+		r.matchIndex[peer] = snapshot.Index
+	}
+	r.nextIndex[peer] = snapshot.Index + 1
+	r.advanceCommit()
+	return r.nextIndex[peer] <= r.lastIndex(), true
+}
+
+//advanceCommit commits the entries of the current term stored on a majority of the nodes. Caller must hold r.mutex.
+func (r *Raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex && r.entry(n).Term == r.term; n-- {
+		count := 1
+		for _, peer := range r.peers {
+			if r.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if count*2 > len(r.peers)+1 {
+			r.commitIndex = n
+			r.signal()
+			return
+		}
+	}
+}
+
+//RequestVote grants the vote of the node to a candidate whose log is at least as up to date as its own,
+//once per term. A node which still follows a leader, or leads with a majority behind it, refuses without moving on
+//to the term of the candidate, which keeps the lease of the leader.
+func (r *Raft) RequestVote(req voteRequest) voteResponse {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.role == raftLeader && r.hasQuorum() {
+		return voteResponse{Term: r.term}
+	}
+	if r.role == raftFollower && r.leaderId != "" && time.Since(r.heardFromLeader) < r.config.ElectionTimeout {
+		return voteResponse{Term: r.term}
+	}
+	if req.Term > r.term {
+		r.becomeFollower(req.Term, "")
+	}
+	resp := voteResponse{Term: r.term}
+	if req.Term < r.term {
+		return resp
+	}
+	upToDate := req.LastLogTerm > r.lastTerm() || (req.LastLogTerm == r.lastTerm() && req.LastLogIndex >= r.lastIndex())
+	if (r.votedFor == "" || r.votedFor == req.CandidateId) && upToDate {
+		r.votedFor = req.CandidateId
+		if err := r.saveState(); err != nil {
+			r.log.Log("level", "error", "msg", "failed to save raft state", "error", err.Error())
+			return resp
+		}
+		r.resetElectionDeadline()
+		resp.VoteGranted = true
+	}
+	return resp
+}
+
+//AppendEntries stores the entries sent by the leader, replacing any conflicting entries the node has.
+func (r *Raft) AppendEntries(req appendRequest) appendResponse {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if req.Term < r.term {
+		return appendResponse{Term: r.term}
+	}
+	if req.Term > r.term || r.role != raftFollower || r.leaderId != req.LeaderId {
+		r.becomeFollower(req.Term, req.LeaderId)
+	}
+	r.heardFromLeader = time.Now()
+	r.resetElectionDeadline()
+	resp := appendResponse{Term: r.term}
+
+	//The entries up to the snapshot are committed, so they match the ones of the leader.
+	base := r.snapshotIndex()
+	if req.PrevLogIndex < base {
+		skip := base - req.PrevLogIndex
+		if skip > uint64(len(req.Entries)) {
+			skip = uint64(len(req.Entries))
+		}
+		req.Entries = req.Entries[skip:]
+		req.PrevLogIndex = base
+		req.PrevLogTerm = r.entries[0].Term
+	}
+	if req.PrevLogIndex > r.lastIndex() {
+		resp.ConflictIndex = r.lastIndex() + 1
+		return resp
+	}
+	if conflictTerm := r.entry(req.PrevLogIndex).Term; conflictTerm != req.PrevLogTerm {
+		index := req.PrevLogIndex
+		for index > base+1 && r.entry(index-1).Term == conflictTerm {
+			index--
+		}
+		resp.ConflictIndex = index
+		return resp
+	}
+
+	for i, entry := range req.Entries {
+		if entry.Index <= r.lastIndex() {
+			if r.entry(entry.Index).Term == entry.Term {
+				continue
+			}
+			//A leader of a later term overwrote this part of the log.
+			if err := r.storage.TruncateAfter(entry.Index - 1); err != nil {
+				r.log.Log("level", "error", "msg", "failed to truncate raft log", "error", err.Error())
+				return resp
+			}
+			r.entries = r.entries[:entry.Index-base]
+		}
+		if err := r.storage.Append(req.Entries[i:]); err != nil {
+			r.log.Log("level", "error", "msg", "failed to append to raft log", "error", err.Error())
+			return resp
+		}
+		r.entries = append(r.entries, req.Entries[i:]...)
+		break
+	}
+
+	if req.LeaderCommit > r.commitIndex {
+		commitIndex := req.LeaderCommit
+		if last := req.PrevLogIndex + uint64(len(req.Entries)); commitIndex > last {
+			commitIndex = last
+		}
+		if commitIndex > r.commitIndex {
+			r.commitIndex = commitIndex
+			r.signal()
+		}
+	}
+	resp.Success = true
+	return resp
+}
+
+//InstallSnapshot replaces the log of the node by the snapshot sent by the leader. The entries after the snapshot are
+//kept if the log holds the last entry it covers.
+func (r *Raft) InstallSnapshot(req snapshotRequest) snapshotResponse {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if req.Term < r.term {
+		return snapshotResponse{Term: r.term}
+	}
+	if req.Term > r.term || r.role != raftFollower || r.leaderId != req.LeaderId {
+		r.becomeFollower(req.Term, req.LeaderId)
+	}
+	r.heardFromLeader = time.Now()
+	r.resetElectionDeadline()
+	resp := snapshotResponse{Term: r.term}
+
+	snapshot := req.Snapshot
+	if snapshot.Index <= r.commitIndex {
+		//Every entry it covers is committed here already.
+		resp.Success = true
+		return resp
+	}
+	if err := r.storage.SaveSnapshot(snapshot); err != nil {
+		r.log.Log("level", "error", "msg", "failed to save raft snapshot", "error", err.Error())
+		return resp
+	}
+	kept := []raftEntry{{Index: snapshot.Index, Term: snapshot.Term}}
+	if snapshot.Index <= r.lastIndex() && r.entry(snapshot.Index).Term == snapshot.Term {
+		kept = append(kept, r.entries[snapshot.Index-r.snapshotIndex()+1:]...)
+	}
+	r.entries = kept
+	r.snapshot = snapshot
+	r.commitIndex = snapshot.Index
+	r.signal()
+	resp.Success = true
+	return resp
+}
+
+//Close stops the node and its replication, and closes the storage.
+func (r *Raft) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.waitGroup.Wait()
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		err = r.storage.Close()
+	})
+	return err
+}
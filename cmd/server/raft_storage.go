@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//raftState is the part of the state of a Raft node which must survive a restart besides its log.
+type raftState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor,omitempty"`
+}
+
+//raftSnapshot replaces the entries of the log up to Index, the last of them of Term, by the state they lead to.
+type raftSnapshot struct {
+	Index uint64          `json:"index"`
+	Term  uint64          `json:"term"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+//raftStorage persists the state, the snapshot and the log of a Raft node. Every call returns once the change is on disk.
+type raftStorage interface {
+	//Load returns the state, the snapshot and the entries after it.
+	Load() (raftState, raftSnapshot, []raftEntry, error)
+	SaveState(state raftState) error
+	Append(entries []raftEntry) error
+	//TruncateAfter drops the entries after index.
+	TruncateAfter(index uint64) error
+	//SaveSnapshot persists the snapshot and drops the entries it covers. The entries after it are kept if the log
+	//holds the last entry it covers, they are dropped otherwise.
+	SaveSnapshot(snapshot raftSnapshot) error
+	Close() error
+}
+
+//fileRaftStorage keeps the state of the node in dir/state and the snapshot in dir/snapshot, both rewritten on every
+//change, and the log in dir/log, one entry per line like the write-ahead log. The log starts after entry base, the
+//last one the snapshot covers. ends[i] is the size of the log file up to entry base+i, and terms[i] its term.
+type fileRaftStorage struct {
+	dir   string
+	file  *os.File
+	base  uint64
+	ends  []int64
+	terms []uint64
+}
+
+func OpenFileRaftStorage(dir string) (*fileRaftStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create raft directory")
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "log"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open raft log")
+	}
+	return &fileRaftStorage{dir: dir, file: file, ends: []int64{0}, terms: []uint64{0}}, nil
+}
+
+func (s *fileRaftStorage) Load() (raftState, raftSnapshot, []raftEntry, error) {
+	var state raftState
+	var snapshot raftSnapshot
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, "state"))
+	if err != nil && !os.IsNotExist(err) {
+		return state, snapshot, nil, errors.Wrap(err, "failed to read raft state")
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return state, snapshot, nil, errors.Wrap(err, "corrupt raft state")
+		}
+	}
+	data, err = ioutil.ReadFile(filepath.Join(s.dir, "snapshot"))
+	if err != nil && !os.IsNotExist(err) {
+		return state, snapshot, nil, errors.Wrap(err, "failed to read raft snapshot")
+	}
+	if err == nil {
+		if err := decodeLine(data, &snapshot); err != nil {
+			return state, snapshot, nil, errors.Wrap(err, "corrupt raft snapshot")
+		}
+	}
+	s.base = snapshot.Index
+	s.terms[0] = snapshot.Term
+
+	entries := make([]raftEntry, 0)
+	reader := bufio.NewReader(s.file)
+	var offset int64
+	torn := false
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			//The last entry was not written completely.
+			torn = len(line) > 0
+			break
+		}
+		if err != nil {
+			return state, snapshot, nil, errors.Wrap(err, "failed to read raft log")
+		}
+
+		var entry raftEntry
+		if decodeErr := decodeLine(line, &entry); decodeErr != nil {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				torn = true
+				break
+			}
+			return state, snapshot, nil, errors.Wrapf(decodeErr, "corrupt raft log entry at offset %d", offset)
+		}
+		if len(entries) == 0 {
+			if entry.Index == 0 || entry.Index > snapshot.Index+1 {
+				return state, snapshot, nil, errors.Errorf("raft log starts at entry %d, the snapshot ends at %d", entry.Index, snapshot.Index)
+			}
+			s.base = entry.Index - 1
+		}
+		if expected := s.base + uint64(len(entries)) + 1; entry.Index != expected {
+			return state, snapshot, nil, errors.Errorf("raft log entry %d found where %d was expected", entry.Index, expected)
+		}
+		entries = append(entries, entry)
+		offset += int64(len(line))
+		s.ends = append(s.ends, offset)
+		s.terms = append(s.terms, entry.Term)
+	}
+	if torn {
+		err = s.truncate(offset)
+	} else {
+		_, err = s.file.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		return state, snapshot, nil, err
+	}
+
+	//The node stopped between writing the snapshot and dropping the entries it covers.
+	if s.base < snapshot.Index {
+		if err := s.compact(snapshot); err != nil {
+			return state, snapshot, nil, err
+		}
+		entries = entries[len(entries)-(len(s.ends)-1):]
+	}
+	return state, snapshot, entries, nil
+}
+
+func (s *fileRaftStorage) SaveState(state raftState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(replaceFile(filepath.Join(s.dir, "state"), data), "failed to save raft state")
+}
+
+//replaceFile writes data to a temporary file and renames it over path, so a crash leaves either the old or the new
+//content behind.
+func replaceFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(path)
+	return nil
+}
+
+func (s *fileRaftStorage) Append(entries []raftEntry) error {
+	var buf []byte
+	ends := make([]int64, 0, len(entries))
+	terms := make([]uint64, 0, len(entries))
+	end := s.ends[len(s.ends)-1]
+	for _, entry := range entries {
+		line, err := encodeLine(entry)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode raft log entry")
+		}
+		buf = append(buf, line...)
+		end += int64(len(line))
+		ends = append(ends, end)
+		terms = append(terms, entry.Term)
+	}
+	_, err := s.file.Write(buf)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		//Cut off whatever part of the entries made it to the file.
+		s.truncate(s.ends[len(s.ends)-1])
+		return errors.Wrap(err, "failed to write raft log")
+	}
+	s.ends = append(s.ends, ends...)
+	s.terms = append(s.terms, terms...)
+	return nil
+}
+
+func (s *fileRaftStorage) TruncateAfter(index uint64) error {
+	if index >= s.base+uint64(len(s.ends)-1) {
+		return nil
+	}
+	if index < s.base {
+		return errors.Errorf("raft log entry %d is part of the snapshot", index)
+	}
+	if err := s.truncate(s.ends[index-s.base]); err != nil {
+		return err
+	}
+	s.ends = s.ends[:index-s.base+1]
+	s.terms = s.terms[:index-s.base+1]
+	return errors.Wrap(s.file.Sync(), "failed to sync raft log")
+}
+
+//SaveSnapshot writes the snapshot before it drops the entries from the log, Load finishes the job after a crash.
+func (s *fileRaftStorage) SaveSnapshot(snapshot raftSnapshot) error {
+	line, err := encodeLine(snapshot)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode raft snapshot")
+	}
+	if err := replaceFile(filepath.Join(s.dir, "snapshot"), line); err != nil {
+		return errors.Wrap(err, "failed to save raft snapshot")
+	}
+	return s.compact(snapshot)
+}
+
+//compact drops the entries covered by the snapshot from the log. The rest of the log is copied to a new file which
+//atomically replaces the old one.
+func (s *fileRaftStorage) compact(snapshot raftSnapshot) error {
+	last := s.base + uint64(len(s.ends)-1)
+	keep := len(s.ends) - 1
+	if snapshot.Index >= s.base && snapshot.Index <= last && s.terms[snapshot.Index-s.base] == snapshot.Term {
+		keep = int(snapshot.Index - s.base)
+	}
+	offset := s.ends[keep]
+	size := s.ends[len(s.ends)-1]
+
+	path := filepath.Join(s.dir, "log")
+	compactPath := path + ".compact"
+	file, err := os.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to compact raft log")
+	}
+	_, err = io.Copy(file, io.NewSectionReader(s.file, offset, size-offset))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(compactPath, path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(compactPath)
+		return errors.Wrap(err, "failed to compact raft log")
+	}
+	syncDir(path)
+
+	s.file.Close()
+	s.file = file
+	ends := []int64{0}
+	for _, end := range s.ends[keep+1:] {
+		ends = append(ends, end-offset)
+	}
+	s.ends = ends
+	s.terms = append([]uint64{snapshot.Term}, s.terms[keep+1:]...)
+	s.base = snapshot.Index
+	return nil
+}
+
+func (s *fileRaftStorage) truncate(offset int64) error {
+	err := s.file.Truncate(offset)
+	if err != nil {
+		return errors.Wrap(err, "failed to truncate raft log")
+	}
+	_, err = s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (s *fileRaftStorage) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errUnreachable = errors.New("unreachable")
+
+//testNetwork connects Raft nodes in memory. A disconnected node can neither send nor receive.
+type testNetwork struct {
+	mutex        sync.Mutex
+	nodes        map[string]*Raft
+	disconnected map[string]bool
+}
+
+func newTestNetwork() *testNetwork {
+	return &testNetwork{nodes: make(map[string]*Raft), disconnected: make(map[string]bool)}
+}
+
+func (n *testNetwork) node(from string, to string) (*Raft, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	node, ok := n.nodes[to]
+	if !ok || n.disconnected[from] || n.disconnected[to] {
+		return nil, errUnreachable
+	}
+	return node, nil
+}
+
+func (n *testNetwork) setConnected(id string, connected bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.disconnected[id] = !connected
+}
+
+type testTransport struct {
+	network *testNetwork
+	from    string
+}
+
+func (t testTransport) RequestVote(peer string, req voteRequest) (voteResponse, error) {
+	node, err := t.network.node(t.from, peer)
+	if err != nil {
+		return voteResponse{}, err
+	}
+	return node.RequestVote(req), nil
+}
+
+func (t testTransport) AppendEntries(peer string, req appendRequest) (appendResponse, error) {
+	node, err := t.network.node(t.from, peer)
+	if err != nil {
+		return appendResponse{}, err
+	}
+	return node.AppendEntries(req), nil
+}
+
+func (t testTransport) InstallSnapshot(peer string, req snapshotRequest) (snapshotResponse, error) {
+	node, err := t.network.node(t.from, peer)
+	if err != nil {
+		return snapshotResponse{}, err
+	}
+	return node.InstallSnapshot(req), nil
+}
+
+//memoryRaftStorage keeps nothing, the nodes of the tests are never restarted.
+type memoryRaftStorage struct{}
+
+func (memoryRaftStorage) Load() (raftState, raftSnapshot, []raftEntry, error) {
+	return raftState{}, raftSnapshot{}, nil, nil
+}
+
+func (memoryRaftStorage) SaveState(state raftState) error {
+	return nil
+}
+
+func (memoryRaftStorage) Append(entries []raftEntry) error {
+	return nil
+}
+
+func (memoryRaftStorage) TruncateAfter(index uint64) error {
+	return nil
+}
+
+func (memoryRaftStorage) SaveSnapshot(snapshot raftSnapshot) error {
+	return nil
+}
+
+func (memoryRaftStorage) Close() error {
+	return nil
+}
+
+func testRaftConfig() RaftConfig {
+	config := DefaultRaftConfig()
+	config.HeartbeatInterval = 10 * time.Millisecond
+	config.ElectionTimeout = 100 * time.Millisecond
+	config.CommitTimeout = time.Second
+	return config
+}
+
+func startTestRafts(t *testing.T, network *testNetwork, ids ...string) map[string]*Raft {
+	nodes := make(map[string]*Raft)
+	for _, id := range ids {
+		peers := make([]string, 0)
+		for _, peer := range ids {
+			if peer != id {
+				peers = append(peers, peer)
+			}
+		}
+		node, err := NewRaft(id, peers, testTransport{network: network, from: id}, memoryRaftStorage{}, testRaftConfig(), log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[id] = node
+		network.mutex.Lock()
+		network.nodes[id] = node
+		network.mutex.Unlock()
+	}
+	return nodes
+}
+
+//waitFor polls cond until it holds or a few seconds passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+//waitForLeader returns the only leader among the connected nodes.
+func waitForLeader(t *testing.T, network *testNetwork, nodes map[string]*Raft) *Raft {
+	var leader *Raft
+	waitFor(t, "a leader", func() bool {
+		leader = nil
+		for id, node := range nodes {
+			if _, err := network.node(id, id); err != nil {
+				continue
+			}
+			if node.Status().Role == raftLeader {
+				if leader != nil {
+					return false
+				}
+				leader = node
+			}
+		}
+		return leader != nil
+	})
+	return leader
+}
+
+func TestRaft_ElectsSingleLeader(t *testing.T) {
+	network := newTestNetwork()
+	nodes := startTestRafts(t, network, "a", "b", "c")
+	for _, node := range nodes {
+		defer node.Close()
+	}
+
+	leader := waitForLeader(t, network, nodes)
+	term := leader.Status().Term
+	waitFor(t, "followers", func() bool {
+		for _, node := range nodes {
+			status := node.Status()
+			if status.Term != term || status.Leader != leader.id {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestRaft_ReplicatesProposals(t *testing.T) {
+	network := newTestNetwork()
+	nodes := startTestRafts(t, network, "a", "b", "c")
+	for _, node := range nodes {
+		defer node.Close()
+	}
+
+	leader := waitForLeader(t, network, nodes)
+	term := leader.Status().Term
+	var last uint64
+	for i := 0; i < 10; i++ {
+		index, err := leader.Propose(term, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+		assert.Nil(t, err)
+		last = index
+	}
+	assert.Nil(t, leader.WaitCommitted(last, term))
+
+	for _, node := range nodes {
+		if node == leader {
+			continue
+		}
+		_, err := node.Propose(term, []byte(`{}`))
+		assert.Equal(t, errNotLeader, err)
+	}
+	waitFor(t, "replication", func() bool {
+		for _, node := range nodes {
+			if node.Status().CommitIndex < last {
+				return false
+			}
+		}
+		return true
+	})
+	want := leader.Entries(1, last)
+	for _, node := range nodes {
+		assert.Equal(t, want, node.Entries(1, last))
+	}
+}
+
+func TestRaft_Failover(t *testing.T) {
+	network := newTestNetwork()
+	nodes := startTestRafts(t, network, "a", "b", "c")
+	for _, node := range nodes {
+		defer node.Close()
+	}
+
+	oldLeader := waitForLeader(t, network, nodes)
+	oldTerm := oldLeader.Status().Term
+	committed, err := oldLeader.Propose(oldTerm, []byte(`"committed"`))
+	assert.Nil(t, err)
+	assert.Nil(t, oldLeader.WaitCommitted(committed, oldTerm))
+
+	//The isolated leader keeps accepting proposals, but cannot commit them.
+	network.setConnected(oldLeader.id, false)
+	lost, err := oldLeader.Propose(oldTerm, []byte(`"lost"`))
+	assert.Nil(t, err)
+
+	newLeader := waitForLeader(t, network, nodes)
+	assert.NotEqual(t, oldLeader, newLeader)
+	newTerm := newLeader.Status().Term
+	assert.True(t, newTerm > oldTerm)
+	assert.Equal(t, []byte(`"committed"`), []byte(newLeader.Entries(committed, committed)[0].Data))
+	index, err := newLeader.Propose(newTerm, []byte(`"replaced"`))
+	assert.Nil(t, err)
+	assert.Nil(t, newLeader.WaitCommitted(index, newTerm))
+
+	//Once it is back, the old leader steps down and its uncommitted entry is replaced.
+	network.setConnected(oldLeader.id, true)
+	assert.Equal(t, errLeadershipLost, oldLeader.WaitCommitted(lost, oldTerm))
+	waitFor(t, "the old leader to catch up", func() bool {
+		return oldLeader.Status().CommitIndex >= index
+	})
+	assert.Equal(t, raftFollower, oldLeader.Status().Role)
+	assert.Equal(t, newLeader.Entries(1, index), oldLeader.Entries(1, index))
+	for _, entry := range oldLeader.Entries(1, index) {
+		assert.NotEqual(t, `"lost"`, string(entry.Data))
+	}
+}
+
+func TestRaft_IsolatedLeaderStepsDown(t *testing.T) {
+	network := newTestNetwork()
+	nodes := startTestRafts(t, network, "a", "b", "c")
+	for _, node := range nodes {
+		defer node.Close()
+	}
+
+	leader := waitForLeader(t, network, nodes)
+	term := leader.Status().Term
+	waitFor(t, "the lease of the leader", func() bool {
+		return leader.Lease(term)
+	})
+	//A follower which just heard from the leader refuses to vote for anyone else.
+	for _, node := range nodes {
+		if node != leader {
+			waitFor(t, "the follower to hear from the leader", func() bool {
+				return node.Status().Leader == leader.id
+			})
+			resp := node.RequestVote(voteRequest{Term: term + 1, CandidateId: "x", LastLogIndex: 100, LastLogTerm: term})
+			assert.False(t, resp.VoteGranted)
+			assert.Equal(t, term, resp.Term)
+			break
+		}
+	}
+
+	network.setConnected(leader.id, false)
+	waitFor(t, "the isolated leader to step down", func() bool {
+		return leader.Status().Role != raftLeader
+	})
+	assert.False(t, leader.Lease(term))
+}
+
+func TestRaft_SingleNode(t *testing.T) {
+	network := newTestNetwork()
+	nodes := startTestRafts(t, network, "a")
+	defer nodes["a"].Close()
+
+	leader := waitForLeader(t, network, nodes)
+	term := leader.Status().Term
+	index, err := leader.Propose(term, []byte(`{}`))
+	assert.Nil(t, err)
+	assert.Nil(t, leader.WaitCommitted(index, term))
+}
+
+func TestFileRaftStorage_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := OpenFileRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, entries, err := storage.Load()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	want := []raftEntry{{Index: 1, Term: 1}, {Index: 2, Term: 1, Data: []byte(`{"op":"enqueue"}`)}, {Index: 3, Term: 2}}
+	assert.Nil(t, storage.SaveState(raftState{Term: 2, VotedFor: "b"}))
+	assert.Nil(t, storage.Append(want[:2]))
+	assert.Nil(t, storage.Append([]raftEntry{{Index: 3, Term: 1}, {Index: 4, Term: 1}}))
+	//A leader of term 2 replaced entries 3 and 4.
+	assert.Nil(t, storage.TruncateAfter(2))
+	assert.Nil(t, storage.Append(want[2:]))
+	storage.Close()
+
+	storage, err = OpenFileRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	state, _, entries, err := storage.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, raftState{Term: 2, VotedFor: "b"}, state)
+	assert.Equal(t, want, entries)
+}
+
+func TestFileRaftStorage_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := OpenFileRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Load()
+	entries := []raftEntry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 2, Data: []byte(`{"op":"enqueue"}`)}}
+	assert.Nil(t, storage.Append(entries))
+	first := raftSnapshot{Index: 2, Term: 1, Data: []byte(`{"queues":[]}`)}
+	assert.Nil(t, storage.SaveSnapshot(first))
+	assert.Nil(t, storage.Append([]raftEntry{{Index: 4, Term: 2}}))
+	storage.Close()
+
+	//The entries after the snapshot are kept, and appended to.
+	storage, err = OpenFileRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, snapshot, loaded, err := storage.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, first, snapshot)
+	assert.Equal(t, []raftEntry{entries[2], {Index: 4, Term: 2}}, loaded)
+
+	//A snapshot of a leader of another term replaces the whole log.
+	second := raftSnapshot{Index: 4, Term: 3, Data: []byte(`{"queues":[]}`)}
+	assert.Nil(t, storage.SaveSnapshot(second))
+	assert.Nil(t, storage.Append([]raftEntry{{Index: 5, Term: 3}}))
+	storage.Close()
+
+	//A crash after the snapshot was written leaves the entries it covers in the log, they are dropped on load.
+	assert.Nil(t, replaceFile(filepath.Join(dir, "snapshot"), mustEncodeLine(t, raftSnapshot{Index: 5, Term: 3})))
+	storage, err = OpenFileRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	_, snapshot, loaded, err = storage.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), snapshot.Index)
+	assert.Empty(t, loaded)
+	assert.Nil(t, storage.Append([]raftEntry{{Index: 6, Term: 3}}))
+	assert.Nil(t, storage.TruncateAfter(5))
+}
+
+func mustEncodeLine(t *testing.T, v interface{}) []byte {
+	line, err := encodeLine(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func TestRaft_InstallSnapshot(t *testing.T) {
+	network := newTestNetwork()
+	nodes := startTestRafts(t, network, "a", "b", "c")
+	for _, node := range nodes {
+		defer node.Close()
+	}
+
+	leader := waitForLeader(t, network, nodes)
+	var lagging *Raft
+	for _, node := range nodes {
+		if node != leader {
+			lagging = node
+		}
+	}
+	network.setConnected(lagging.id, false)
+	term := leader.Status().Term
+	var index uint64
+	for i := 0; i < 5; i++ {
+		var err error
+		index, err = leader.Propose(term, []byte(fmt.Sprintf("%d", i)))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, leader.WaitCommitted(index, term))
+	assert.Nil(t, leader.Compact(index, []byte(`"state"`)))
+	assert.Nil(t, leader.Entries(1, index))
+	last, err := leader.Propose(term, []byte(`"after"`))
+	assert.Nil(t, err)
+
+	//The lagging node gets the snapshot in place of the entries it missed, then the entries after it.
+	network.setConnected(lagging.id, true)
+	waitFor(t, "the lagging node to catch up", func() bool {
+		return lagging.Status().CommitIndex >= last
+	})
+	snapshot, entries := lagging.EntriesAfter(0, last)
+	assert.Equal(t, index, snapshot.Index)
+	assert.Equal(t, []byte(`"state"`), []byte(snapshot.Data))
+	assert.Equal(t, leader.Entries(index+1, last), entries)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"container/heap"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+//record saves the job to the store, writes its state after op to the journal of the queue and publishes the change
+//as an event. Caller must hold q.mutex.
+//A failed write is logged and returned, the change is already applied in memory but must not be acknowledged.
+func (q *JobListQueue) record(op string, e *Element) error {
+	if err := q.store.Save(e); err != nil {
+		q.log.Log("level", "error", "msg", "failed to save job", "op", op, "jobId", e.Value.Id, "error", err.Error())
+		return err
+	}
+	s := snapshotOf(e)
+	record := walRecord{Op: op, JobId: s.Job.Id, Job: &s.Job, ReadyAt: s.ReadyAt, LeasedAt: s.LeasedAt, Time: q.now()}
+	if err := q.writeRecord(record); err != nil {
+		return err
+	}
+	q.events.publish(op, e.Value, q.now())
+	return nil
+}
+
+//writeRecord saves the settings or dead letters the record changes to a store which keeps them, and appends the
+//record to the journal of the queue. Caller must hold q.mutex.
+func (q *JobListQueue) writeRecord(record walRecord) error {
+	if err := q.saveState(record); err != nil {
+		return err
+	}
+	if q.journal == nil {
+		return nil
+	}
+	if record.Time.IsZero() {
+		record.Time = q.now()
+	}
+	err := q.journal.Append(record)
+	if err != nil {
+		q.log.Log("level", "error", "msg", "failed to write write-ahead log", "op", record.Op, "jobId", record.JobId, "error", err.Error())
+	}
+	return err
+}
+
+//saveState persists the settings, dead letters or schedules changed by the record, if the store of the queue keeps
+//them. Caller must hold q.mutex.
+func (q *JobListQueue) saveState(record walRecord) error {
+	s, ok := q.store.(StateStore)
+	if !ok {
+		return nil
+	}
+	var err error
+	switch record.Op {
+	case "configure":
+		err = s.SaveConfig(*record.Config)
+	case "deadletter":
+		err = s.SaveDeadLetter(*record.Job)
+	case "redrive", "purge":
+		err = s.RemoveDeadLetter(record.JobId)
+	case "saveSchedule":
+		err = s.SaveSchedule(*record.Schedule)
+	case "deleteSchedule":
+		err = s.RemoveSchedule(record.ScheduleId)
+	}
+	if err != nil {
+		q.log.Log("level", "error", "msg", "failed to save queue state", "op", record.Op, "error", err.Error())
+	}
+	return err
+}
+
+//loadState picks up the settings, dead letters and idempotency keys left in the store by an earlier run.
+//Caller must hold q.mutex.
+func (q *JobListQueue) loadState() {
+	s, ok := q.store.(StateStore)
+	if !ok {
+		return
+	}
+	state := s.State()
+	if state.Config != nil {
+		q.config = state.Config.apply(q.config)
+		q.ready.agingInterval = q.config.AgingInterval
+	}
+	for _, entry := range state.IdempotencyKeys {
+		q.idempotencyKeys.put(entry, q.now())
+	}
+	for _, item := range state.DeadLetters {
+		//A redrive which crashed before its dead letter was removed left the job in both places.
+		if _, ok := q.store.Get(item.Id); ok {
+			continue
+		}
+		q.ids().Observe(item.Id)
+		q.deadLetters.Add(item)
+	}
+}
+
+//stateJournal writes the records of the scheduler to the store of the queue, for stores which keep them.
+type stateJournal struct {
+	queue *JobListQueue
+}
+
+func (j stateJournal) Append(record walRecord) error {
+	j.queue.mutex.Lock()
+	defer j.queue.mutex.Unlock()
+
+	return j.queue.saveState(record)
+}
+
+//replay applies a record read back from the write-ahead log. The ready heap, delay heap and leases are not
+//maintained while replaying, rebuildIndexes restores them once the whole log is applied.
+func (q *JobListQueue) replay(record walRecord) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	switch record.Op {
+	case "configure":
+		if record.Config == nil {
+			return errors.New("record configure has no config")
+		}
+		q.config = record.Config.apply(q.config)
+		q.ready.agingInterval = q.config.AgingInterval
+		return nil
+	case "purge":
+		if record.JobId == 0 {
+			q.deadLetters.Purge()
+			return nil
+		}
+		_, err := q.deadLetters.Take(record.JobId)
+		return err
+	}
+
+	if record.Job == nil {
+		return errors.Errorf("record %s has no job", record.Op)
+	}
+	item := *record.Job
+	if record.LeasedAt != nil {
+		item.leasedAt = *record.LeasedAt
+	}
+
+	switch record.Op {
+	case "enqueue", "redrive":
+		if record.Op == "redrive" {
+			q.deadLetters.Take(item.Id)
+		}
+		e := &Element{Value: item}
+		if record.ReadyAt != nil {
+			e.readyAt = *record.ReadyAt
+		}
+		//The key outlives the job, which a later record may remove.
+		q.rememberKey(e)
+		return q.pushBack(e)
+	}
+
+	e, ok := q.store.Get(record.JobId)
+	if !ok {
+		return errors.New("JobId not present in the Queue")
+	}
+
+	switch record.Op {
+	case "cancel", "remove":
+		return q.unlink(e)
+	case "deadletter":
+		q.deadLetters.Add(item)
+		return q.unlink(e)
+	}
+	//dequeue, heartbeat, conclude, fail, expire and promote replace the state of the job.
+	e.Value = item
+	if record.ReadyAt != nil {
+		e.readyAt = *record.ReadyAt
+	}
+	return q.store.Save(e)
+}
+
+//rebuildIndexes restores the ready heap, the delay heap, the leases, the idempotency keys and the unique keys from
+//the state of the jobs in the store, after a replay or when the queue is opened on a store which already holds jobs.
+//The idempotency keys of jobs which left the queue are kept.
+func (q *JobListQueue) rebuildIndexes() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.ready.elements = nil
+	q.delayed = nil
+	q.seq = 0
+	q.uniqueKeys = make(map[string]int)
+	q.store.Each(func(e *Element) bool {
+		q.rememberKey(e)
+		q.rememberUniqueKey(e)
+		//The store keeps the enqueue order, which the ready heap breaks ties by.
+		q.ids().Observe(e.Value.Id)
+		q.seq++
+		e.seq = q.seq
+		e.readyIndex = -1
+		switch e.Value.Status {
+		case "QUEUED":
+			e.readyIndex = len(q.ready.elements)
+			q.ready.elements = append(q.ready.elements, e)
+		case "SCHEDULED":
+			if e.Value.RunAt != nil {
+				heap.Push(&q.delayed, delayedJob{due: *e.Value.RunAt, element: e})
+			}
+		case "RETRY_PENDING":
+			if e.Value.RetryAt != nil {
+				heap.Push(&q.delayed, delayedJob{due: *e.Value.RetryAt, element: e})
+			}
+		case "IN_PROGRESS":
+			q.consumerDetails.Store(e.Value.Id, e.Value.ConsumerId)
+		}
+		return true
+	})
+	heap.Init(&q.ready)
+	q.signalReady()
+}
+
+//NewRegistryWithWAL rebuilds the queues from the latest snapshot and the write-ahead log written after it,
+//and records every further change to the log.
+func NewRegistryWithWAL(logger log.Logger, defaultConfig QueueConfig, wal *WAL) (*Registry, error) {
+	r := NewRegistry(logger, defaultConfig)
+
+	s, err := readSnapshot(wal.SnapshotPath())
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if s != nil {
+		if err := r.restore(s); err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.snapshotSeq = s.LastSeq
+		logger.Log("level", "info", "msg", "restored snapshot", "lastSeq", s.LastSeq, "time", s.Time)
+	}
+
+	err = wal.Replay(r.snapshotSeq, r.replay)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	r.wal = wal
+	r.journal = wal
+	r.schedules.setJournal(wal)
+	r.rebuildIndexes()
+	for name, q := range r.queues {
+		q.journal = queueJournal{journal: wal, name: name}
+		logger.Log("level", "info", "msg", "recovered queue", "queue", name, "jobs", q.Len())
+	}
+	return r, nil
+}
+
+//replay applies a record of the write-ahead log, or of the replicated log of a cluster, to the queues or the schedules.
+//The indexes of the queues are left to rebuildIndexes.
+func (r *Registry) replay(record walRecord) error {
+	switch record.Op {
+	case "saveSchedule", "deleteSchedule":
+		return r.schedules.replay(record)
+	}
+
+	r.mutex.Lock()
+	switch record.Op {
+	case "createQueue":
+		defer r.mutex.Unlock()
+		q, ok := r.queues[record.Queue]
+		if !ok {
+			var err error
+			q, err = r.newQueue(record.Queue, r.defaultConfig)
+			if err != nil {
+				return err
+			}
+			r.queues[record.Queue] = q
+		}
+		//Queues created on first use carry no config.
+		if record.Config != nil {
+			q.config = record.Config.apply(r.defaultConfig)
+			q.ready.agingInterval = q.config.AgingInterval
+		}
+		return nil
+	case "deleteQueue":
+		defer r.mutex.Unlock()
+		if q, ok := r.queues[record.Queue]; ok {
+			q.Close()
+			delete(r.queues, record.Queue)
+		}
+		return nil
+	case "releaseQueue":
+		defer r.mutex.Unlock()
+		return r.release(record.Queue)
+	case "importQueue":
+		defer r.mutex.Unlock()
+		if record.Snapshot == nil {
+			return errors.New("record importQueue has no snapshot")
+		}
+		_, err := r.importQueue(*record.Snapshot)
+		return err
+	}
+
+	q, ok := r.queues[record.Queue]
+	r.mutex.Unlock()
+	if !ok {
+		return errors.Wrapf(errQueueNotFound, "queue %s", record.Queue)
+	}
+	return q.replay(record)
+}
+
+//rebuildIndexes rebuilds the indexes of every queue once the records are replayed.
+func (r *Registry) rebuildIndexes() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, q := range r.queues {
+		q.rebuildIndexes()
+	}
+}
+
+//reset drops every queue, job and schedule, leaving an empty default queue. The journal is not written to, the state
+//is rebuilt by replaying records afterwards.
+func (r *Registry) reset() error {
+	r.schedules.clear()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for name, q := range r.queues {
+		if name == defaultQueueName {
+			continue
+		}
+		q.Close()
+		delete(r.queues, name)
+		if err := r.stores.Drop(name); err != nil {
+			return err
+		}
+	}
+	//The handlers hold on to the default queue, so it is emptied in place.
+	return r.queues[defaultQueueName].clear(r.defaultConfig, func() (Store, error) {
+		if err := r.stores.Drop(defaultQueueName); err != nil {
+			return nil, err
+		}
+		return r.stores.Open(defaultQueueName)
+	})
+}
+
+//clear drops every job of the queue, including the dead letters, and puts the config back to config.
+//The store is closed and replaced by the one returned by reopen.
+func (q *JobListQueue) clear(config QueueConfig, reopen func() (Store, error)) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if err := q.store.Close(); err != nil {
+		return err
+	}
+	store, err := reopen()
+	if err != nil {
+		return err
+	}
+	q.store = store
+	q.consumerDetails.Range(func(key, value interface{}) bool {
+		q.consumerDetails.Delete(key)
+		return true
+	})
+	q.ready = readyHeap{agingInterval: config.AgingInterval}
+	q.delayed = nil
+	q.seq = 0
+	q.idempotencyKeys = newIdempotencyTable()
+	q.uniqueKeys = make(map[string]int)
+	q.deadLetters.Purge()
+	config.ReapInterval = q.config.ReapInterval
+	if config.IDs == nil {
+		config.IDs = q.config.IDs
+	}
+	q.config = config
+	return nil
+}
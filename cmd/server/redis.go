@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//maxRedisArgument bounds an argument of a command. It leaves room for a job with a payload of the default size limit.
+const maxRedisArgument = 1 << 20
+
+//maxRedisArguments bounds the number of arguments of a command, a push of a full batch included.
+const maxRedisArguments = maxBatchSize + 2
+
+var (
+	errRedisProtocol  = errors.New("Protocol error")
+	errRedisTooLarge  = errors.Errorf("Protocol error: an argument exceeds %d bytes", maxRedisArgument)
+	errRedisJob       = errors.New("the value must be a job as taken by POST /jobs/enqueue")
+	errRedisTimeout   = errors.New("timeout is not a float or out of range")
+	errRedisSingleKey = errors.New("blocking pops take a single key")
+	errRedisJobId     = errors.New("job id is not an integer")
+	errRedisSyntax    = errors.New("syntax error")
+)
+
+//redisArity holds the least and the most arguments of the commands, the command name left out. -1 is no limit.
+var redisArity = map[string][2]int{
+	"PING":       {0, 1},
+	"QUIT":       {0, 0},
+	"CLIENT":     {1, 2},
+	"LPUSH":      {2, -1},
+	"RPUSH":      {2, -1},
+	"LPOP":       {1, 1},
+	"RPOP":       {1, 1},
+	"BLPOP":      {2, -1},
+	"BRPOP":      {2, -1},
+	"LMOVE":      {4, 4},
+	"RPOPLPUSH":  {2, 2},
+	"BLMOVE":     {5, 5},
+	"BRPOPLPUSH": {3, 3},
+	"LLEN":       {1, 1},
+	"ACK":        {2, 3},
+	"NACK":       {2, 3},
+}
+
+//RedisServer serves the queues of a registry to Redis clients, over the part of RESP2 list commands need. Every
+//queue is a list named after it: a push enqueues jobs, a pop dequeues a job leased to the connection, whose consumer
+//id is its client name (CLIENT SETNAME), or an id of its own when it has none. ACK concludes a popped job and NACK
+//fails it.
+type RedisServer struct {
+	queues   *Registry
+	accepted uint64
+	log      log.Logger
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+//redisConn is a connection of a Redis client. name is the client name, id the consumer id of the jobs it pops while
+//it has no name, which no other connection shares.
+type redisConn struct {
+	writer *bufio.Writer
+	name   string
+	id     string
+}
+
+//consumer is the consumer id of the jobs the connection pops, acknowledges and fails.
+func (c *redisConn) consumer() string {
+	if c.name == "" {
+		return c.id
+	}
+	return c.name
+}
+
+//redisCommand is a command read from a connection, or the protocol error which stopped the reading.
+type redisCommand struct {
+	args [][]byte
+	err  error
+}
+
+func NewRedisServer(queues *Registry, logger log.Logger) *RedisServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RedisServer{
+		queues: queues,
+		log:    logger,
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]bool),
+	}
+}
+
+//ListenAndServe serves the clients connecting to the address until the server is closed.
+func (s *RedisServer) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+//Serve serves the clients of the listener until the server is closed, which closes the listener.
+func (s *RedisServer) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	if s.ctx.Err() != nil {
+		s.mutex.Unlock()
+		return listener.Close()
+	}
+	s.listener = listener
+	s.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s.mutex.Lock()
+		if s.ctx.Err() != nil {
+			s.mutex.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mutex.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serve(conn)
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+//Close stops accepting clients, ends the blocking pops and closes the connections.
+func (s *RedisServer) Close() error {
+	s.mutex.Lock()
+	s.cancel()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+//serve runs the commands of the connection until the client quits or goes away.
+func (s *RedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	//Commands are read ahead, so a blocking pop ends as soon as its client goes away.
+	commands := make(chan redisCommand)
+	go func() {
+		defer close(commands)
+		defer cancel()
+		reader := bufio.NewReader(conn)
+		for {
+			args, err := readRedisCommand(reader)
+			if err != nil && err != errRedisProtocol && err != errRedisTooLarge {
+				return
+			}
+			if err == nil && len(args) == 0 {
+				continue
+			}
+			select {
+			case commands <- redisCommand{args: args, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	id := fmt.Sprintf("redis:%s:%d", conn.RemoteAddr(), atomic.AddUint64(&s.accepted, 1))
+	c := &redisConn{writer: bufio.NewWriter(conn), id: id}
+	for command := range commands {
+		quit := command.err != nil
+		if quit {
+			c.error(command.err)
+		} else {
+			quit = s.execute(ctx, c, command.args)
+		}
+		if err := c.writer.Flush(); err != nil || quit {
+			return
+		}
+	}
+}
+
+//execute runs the command and writes its reply. It returns true once the client quits.
+func (s *RedisServer) execute(ctx context.Context, c *redisConn, args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	arity, ok := redisArity[name]
+	if !ok {
+		c.error(errors.Errorf("unknown command '%s'", shortName(name)))
+		return false
+	}
+	if len(args) < arity[0] || (arity[1] >= 0 && len(args) > arity[1]) {
+		c.error(errors.Errorf("wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+
+	switch name {
+	case "PING":
+		if len(args) == 0 {
+			c.simple("PONG")
+		} else {
+			c.bulk(args[0])
+		}
+	case "QUIT":
+		c.simple("OK")
+		return true
+	case "CLIENT":
+		s.client(c, args)
+	case "LPUSH", "RPUSH":
+		s.push(c, string(args[0]), args[1:])
+	case "LPOP", "RPOP":
+		s.pop(ctx, c, string(args[0]), false, 0, false)
+	case "BLPOP", "BRPOP":
+		if len(args) > 2 {
+			c.error(errRedisSingleKey)
+			break
+		}
+		timeout, err := parseRedisTimeout(args[1])
+		if err != nil {
+			c.error(err)
+			break
+		}
+		s.pop(ctx, c, string(args[0]), true, timeout, true)
+	case "LMOVE", "BLMOVE":
+		if !isRedisEnd(args[2]) || !isRedisEnd(args[3]) {
+			c.error(errRedisSyntax)
+			break
+		}
+		var timeout time.Duration
+		if name == "BLMOVE" {
+			var err error
+			if timeout, err = parseRedisTimeout(args[4]); err != nil {
+				c.error(err)
+				break
+			}
+		}
+		s.pop(ctx, c, string(args[0]), name == "BLMOVE", timeout, false)
+	case "RPOPLPUSH":
+		s.pop(ctx, c, string(args[0]), false, 0, false)
+	case "BRPOPLPUSH":
+		timeout, err := parseRedisTimeout(args[2])
+		if err != nil {
+			c.error(err)
+			break
+		}
+		s.pop(ctx, c, string(args[0]), true, timeout, false)
+	case "LLEN":
+		//A queue which does not exist is an empty list.
+		q, err := s.queues.Lookup(string(args[0]))
+		if err != nil {
+			c.integer(0)
+			break
+		}
+		c.integer(q.Ready())
+	case "ACK", "NACK":
+		s.release(c, name, args)
+	}
+	return false
+}
+
+//shortName cuts the name of an unknown command for the error reply.
+func shortName(name string) string {
+	if len(name) > 64 {
+		return name[:64] + "..."
+	}
+	return name
+}
+
+//client handles CLIENT SETNAME and GETNAME. SETINFO, which clients send when they connect, is accepted and ignored.
+func (s *RedisServer) client(c *redisConn, args [][]byte) {
+	switch strings.ToUpper(string(args[0])) {
+	case "SETNAME":
+		if len(args) != 2 {
+			c.error(errRedisSyntax)
+			return
+		}
+		c.name = string(args[1])
+		c.simple("OK")
+	case "GETNAME":
+		if c.name == "" {
+			c.nullBulk()
+			return
+		}
+		c.bulk([]byte(c.name))
+	case "SETINFO":
+		c.simple("OK")
+	default:
+		c.error(errors.Errorf("unknown subcommand '%s'", shortName(string(args[0]))))
+	}
+}
+
+//push enqueues the jobs, all of them or none, and answers the number of jobs ready in the queue.
+func (s *RedisServer) push(c *redisConn, key string, values [][]byte) {
+	if len(values) > maxBatchSize {
+		c.error(errBatchSize)
+		return
+	}
+	items := make([]*job, 0, len(values))
+	for _, value := range values {
+		var item job
+		if err := json.Unmarshal(value, &item); err != nil {
+			c.error(errRedisJob)
+			return
+		}
+		if err := resolveDelay(&item); err != nil {
+			c.error(err)
+			return
+		}
+		items = append(items, &item)
+	}
+	q, err := s.queues.Get(key)
+	if err != nil {
+		c.error(err)
+		return
+	}
+
+	results, err := q.EnqueueBatch(items)
+	if err == errBatchRejected {
+		for _, result := range results {
+			if result.Err != nil {
+				err = result.Err
+				break
+			}
+		}
+	}
+	if err != nil {
+		c.error(err)
+		return
+	}
+	c.integer(q.Ready())
+}
+
+//pop dequeues a job leased to the connection and answers it as JSON. A blocking pop waits up to timeout for a job,
+//forever with a timeout of 0. withKey answers the key along with the job, as BLPOP and BRPOP do.
+func (s *RedisServer) pop(ctx context.Context, c *redisConn, key string, block bool, timeout time.Duration, withKey bool) {
+	q, err := s.queues.Get(key)
+	if err != nil {
+		c.error(err)
+		return
+	}
+
+	var jobs []job
+	if !block {
+		jobs, err = q.DequeueBatch(c.consumer(), 1)
+		if err == errQueueEmpty || err == errNoJobAvailable {
+			err = errWaitElapsed
+		}
+	}
+	for block {
+		wait := timeout
+		if timeout == 0 {
+			wait = maxDequeueWait
+		}
+		jobs, err = q.DequeueWait(ctx, c.consumer(), 1, wait)
+		//Without a timeout the pop keeps waiting.
+		block = err == errWaitElapsed && timeout == 0
+	}
+	if err == errWaitElapsed {
+		if withKey {
+			c.nullArray()
+		} else {
+			c.nullBulk()
+		}
+		return
+	}
+	if err != nil {
+		c.error(err)
+		return
+	}
+
+	data, err := json.Marshal(jobs[0])
+	if err != nil {
+		c.error(err)
+		return
+	}
+	if withKey {
+		c.array(2)
+		c.bulk([]byte(key))
+	}
+	c.bulk(data)
+}
+
+//release handles ACK key jobId [result], which concludes a job popped by the connection, and NACK key jobId [error],
+//which fails it.
+func (s *RedisServer) release(c *redisConn, name string, args [][]byte) {
+	jobID, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		c.error(errRedisJobId)
+		return
+	}
+	var detail []byte
+	if len(args) == 3 {
+		detail = args[2]
+	}
+	if name == "ACK" && len(detail) > 0 && !json.Valid(detail) {
+		c.error(errInvalidResult)
+		return
+	}
+	q, err := s.queues.Lookup(string(args[0]))
+	if err != nil {
+		c.error(err)
+		return
+	}
+
+	if name == "ACK" {
+		err = q.ConcludeWithResult(jobID, c.consumer(), detail)
+	} else {
+		_, err = q.Fail(jobID, c.consumer(), string(detail))
+	}
+	if err != nil {
+		c.error(err)
+		return
+	}
+	c.simple("OK")
+}
+
+//parseRedisTimeout parses the timeout of a blocking pop, in seconds.
+func parseRedisTimeout(arg []byte) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || seconds < 0 || math.IsNaN(seconds) || seconds > float64(math.MaxInt64/int64(time.Second)) {
+		return 0, errRedisTimeout
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+//isRedisEnd reports whether the argument names an end of a list, LEFT or RIGHT. The queue ignores it.
+func isRedisEnd(arg []byte) bool {
+	end := strings.ToUpper(string(arg))
+	return end == "LEFT" || end == "RIGHT"
+}
+
+//readRedisCommand reads a command sent as an array of bulk strings, or inline as words on a line as telnet sends it.
+//An empty command is returned for an empty line.
+func readRedisCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxRedisArguments {
+		return nil, errRedisProtocol
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readRedisLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRedisProtocol
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 {
+			return nil, errRedisProtocol
+		}
+		if size > maxRedisArgument {
+			return nil, errRedisTooLarge
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, errRedisProtocol
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+//readRedisLine reads a line ended by CRLF, or by LF alone. The line is copied out of the buffer of the reader.
+func readRedisLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errRedisProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+	return append([]byte(nil), line...), nil
+}
+
+func (c *redisConn) simple(s string) {
+	fmt.Fprintf(c.writer, "+%s\r\n", s)
+}
+
+//error answers the error. Redis clients read the first word as the kind of error.
+func (c *redisConn) error(err error) {
+	message := strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+	fmt.Fprintf(c.writer, "-ERR %s\r\n", message)
+}
+
+func (c *redisConn) integer(n int) {
+	fmt.Fprintf(c.writer, ":%d\r\n", n)
+}
+
+func (c *redisConn) bulk(b []byte) {
+	fmt.Fprintf(c.writer, "$%d\r\n", len(b))
+	c.writer.Write(b)
+	c.writer.WriteString("\r\n")
+}
+
+func (c *redisConn) nullBulk() {
+	c.writer.WriteString("$-1\r\n")
+}
+
+func (c *redisConn) array(n int) {
+	fmt.Fprintf(c.writer, "*%d\r\n", n)
+}
+
+func (c *redisConn) nullArray() {
+	c.writer.WriteString("*-1\r\n")
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//redisClient sends commands as arrays of bulk strings and reads the replies.
+type redisClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newTestRedisServer(t *testing.T) (*RedisServer, *Registry, string) {
+	_, registry := newTestRegistryHandler()
+	server := NewRedisServer(registry, registry.log)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	return server, registry, listener.Addr().String()
+}
+
+func dialRedis(t *testing.T, addr string) *redisClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &redisClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+//do sends the command and returns its reply: a string for simple strings and errors, which keep their prefix, an int,
+//a []byte, a []interface{} or nil.
+func (c *redisClient) do(args ...string) interface{} {
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, command); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read()
+}
+
+func (c *redisClient) read() interface{} {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', '-':
+		return line
+	case ':':
+		n, _ := strconv.Atoi(line[1:])
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		data := make([]byte, n+2)
+		io.ReadFull(c.reader, data)
+		return data[:n]
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = c.read()
+		}
+		return items
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func TestRedis_PushPopAck(t *testing.T) {
+	server, registry, addr := newTestRedisServer(t)
+	defer registry.Close()
+	defer server.Close()
+	c := dialRedis(t, addr)
+	defer c.conn.Close()
+
+	assert.Equal(t, "+PONG", c.do("PING"))
+	assert.Equal(t, 0, c.do("LLEN", "emails"))
+	assert.Equal(t, 2, c.do("LPUSH", "emails", `{"type":"TIME_CRITICAL","payload":{"to":"a@b.c"}}`, `{"type":"NOT_TIME_CRITICAL"}`))
+	assert.Equal(t, 2, c.do("LLEN", "emails"))
+
+	assert.Equal(t, "+OK", c.do("CLIENT", "SETNAME", "worker-1"))
+	assert.Equal(t, []byte("worker-1"), c.do("CLIENT", "GETNAME"))
+	reply := c.do("BRPOP", "emails", "1").([]interface{})
+	assert.Equal(t, []byte("emails"), reply[0])
+	var popped job
+	json.Unmarshal(reply[1].([]byte), &popped)
+	assert.Equal(t, "TIME_CRITICAL", popped.Type)
+	assert.Equal(t, "IN_PROGRESS", popped.Status)
+	assert.Equal(t, "worker-1", popped.ConsumerId)
+	assert.Equal(t, 1, c.do("LLEN", "emails"))
+
+	id := strconv.Itoa(popped.Id)
+	assert.Equal(t, "-ERR result must be a JSON document", c.do("ACK", "emails", id, "not json"))
+	assert.Equal(t, "+OK", c.do("ACK", "emails", id, `{"sent":true}`))
+	emails, _ := registry.Lookup("emails")
+	item, _ := emails.GetJob(popped.Id)
+	assert.Equal(t, "CONCLUDED", item.Status)
+	assert.JSONEq(t, `{"sent":true}`, string(item.Result))
+
+	//The reliable pop leases the job the same way, and NACK fails it.
+	var moved job
+	json.Unmarshal(c.do("BLMOVE", "emails", "emails:processing", "RIGHT", "LEFT", "0").([]byte), &moved)
+	assert.Equal(t, "NOT_TIME_CRITICAL", moved.Type)
+	assert.Equal(t, "+OK", c.do("NACK", "emails", strconv.Itoa(moved.Id), "boom"))
+	item, _ = emails.GetJob(moved.Id)
+	assert.Equal(t, "boom", item.LastError)
+
+	//Nothing came within the timeout.
+	assert.Nil(t, c.do("BRPOP", "default", "0.05"))
+	assert.Nil(t, c.do("RPOPLPUSH", "default", "default:processing"))
+	assert.Equal(t, "+OK", c.do("QUIT"))
+}
+
+func TestRedis_UnnamedConnectionsDoNotShareLeases(t *testing.T) {
+	server, registry, addr := newTestRedisServer(t)
+	defer registry.Close()
+	defer server.Close()
+	a := dialRedis(t, addr)
+	defer a.conn.Close()
+	b := dialRedis(t, addr)
+	defer b.conn.Close()
+
+	assert.Equal(t, 1, a.do("RPUSH", "emails", `{"type":"TIME_CRITICAL"}`))
+	var popped job
+	json.Unmarshal(a.do("LPOP", "emails").([]byte), &popped)
+	assert.NotEqual(t, "", popped.ConsumerId)
+	assert.Nil(t, a.do("CLIENT", "GETNAME"))
+
+	//Neither has a name, the other connection holds no lease on the job.
+	id := strconv.Itoa(popped.Id)
+	assert.True(t, strings.HasPrefix(b.do("ACK", "emails", id).(string), "-"))
+	assert.True(t, strings.HasPrefix(b.do("NACK", "emails", id).(string), "-"))
+	assert.Equal(t, "+OK", a.do("ACK", "emails", id))
+}
+
+func TestRedis_BlockingPopWakesUp(t *testing.T) {
+	server, registry, addr := newTestRedisServer(t)
+	defer registry.Close()
+	defer server.Close()
+	consumer := dialRedis(t, addr)
+	defer consumer.conn.Close()
+	producer := dialRedis(t, addr)
+	defer producer.conn.Close()
+
+	popped := make(chan interface{})
+	go func() {
+		popped <- consumer.do("BLPOP", "default", "0")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.IsType(t, 0, producer.do("RPUSH", "default", `{"type":"TIME_CRITICAL"}`))
+	select {
+	case reply := <-popped:
+		var item job
+		json.Unmarshal(reply.([]interface{})[1].([]byte), &item)
+		assert.Equal(t, "TIME_CRITICAL", item.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocking pop was not answered")
+	}
+}
+
+func TestRedis_Errors(t *testing.T) {
+	server, registry, addr := newTestRedisServer(t)
+	defer registry.Close()
+	defer server.Close()
+	c := dialRedis(t, addr)
+	defer c.conn.Close()
+
+	assert.Equal(t, "-ERR unknown command 'SET'", c.do("SET", "a", "b"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'llen' command", c.do("LLEN"))
+	assert.Equal(t, "-ERR "+errRedisJob.Error(), c.do("RPUSH", "default", "hello"))
+	//A batch with an invalid job enqueues none.
+	assert.Equal(t, "-ERR "+errInvalidUniquePolicy.Error(), c.do("RPUSH", "default", `{"type":"A"}`, `{"type":"B","uniqueKey":"k","uniquePolicy":"never"}`))
+	assert.Equal(t, 0, c.do("LLEN", "default"))
+	assert.Equal(t, "-ERR "+errRedisSingleKey.Error(), c.do("BRPOP", "a", "b", "1"))
+	assert.Equal(t, "-ERR "+errRedisTimeout.Error(), c.do("BRPOP", "a", "-1"))
+	assert.Equal(t, "-ERR syntax error", c.do("LMOVE", "a", "b", "UP", "LEFT"))
+	assert.Equal(t, "-ERR "+errInvalidQueueName.Error(), c.do("RPOP", "not a queue"))
+	assert.Equal(t, "-ERR "+errRedisJobId.Error(), c.do("ACK", "default", "x"))
+
+	//Inline commands, as typed in telnet.
+	io.WriteString(c.conn, "PING\r\n\r\nLLEN default\n")
+	assert.Equal(t, "+PONG", c.read())
+	assert.Equal(t, 0, c.read())
+
+	//A protocol error closes the connection.
+	io.WriteString(c.conn, "*1\r\n+PING\r\n")
+	assert.Equal(t, "-ERR Protocol error", c.read())
+	_, err := c.reader.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
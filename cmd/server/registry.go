@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+//defaultQueueName is the queue served by the /jobs and /deadletters routes.
+const defaultQueueName = "default"
+
+var queueNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+var (
+	errQueueNotFound      = errors.New("Queue not present")
+	errQueueExists        = errors.New("Queue already exists")
+	errInvalidQueueName   = errors.New("Queue names must be 1 to 64 letters, digits, '_', '.' or '-'")
+	errDeleteDefaultQueue = errors.New("The default queue cannot be deleted")
+	errNegativeDuration   = errors.New("Durations cannot be negative")
+)
+
+//Registry holds the named queues of the server. Queues are created with the default config the first time they are used.
+//The jobs of every queue are kept in a store opened by stores. The recurring jobs of the server enqueue into the default queue.
+type Registry struct {
+	queues        map[string]*JobListQueue
+	defaultConfig QueueConfig
+	log           log.Logger
+	mutex         sync.Mutex
+	stores        StoreFactory
+	journal       journal
+	wal           *WAL
+	snapshotMutex sync.Mutex
+	snapshotSeq   uint64
+	events        *EventHub
+	schedules     *Scheduler
+}
+
+//NewRegistry keeps the queues in memory.
+func NewRegistry(logger log.Logger, defaultConfig QueueConfig) *Registry {
+	//Memory stores cannot fail to open.
+	r, _ := NewRegistryWithStores(logger, defaultConfig, memoryStores{})
+	return r
+}
+
+//NewRegistryWithStores opens the queues left in the stores by an earlier run, and keeps the queues created later there as well.
+func NewRegistryWithStores(logger log.Logger, defaultConfig QueueConfig, stores StoreFactory) (*Registry, error) {
+	r := &Registry{
+		queues:        make(map[string]*JobListQueue),
+		defaultConfig: defaultConfig,
+		log:           logger,
+		stores:        stores,
+		events:        NewEventHub(),
+	}
+
+	names, err := stores.Names()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range append(names, defaultQueueName) {
+		if _, ok := r.queues[name]; ok || !queueNamePattern.MatchString(name) {
+			continue
+		}
+		q, err := r.newQueue(name, defaultConfig)
+		if err != nil {
+			r.Close()
+			return nil, errors.Wrapf(err, "failed to open queue %s", name)
+		}
+		r.queues[name] = q
+	}
+	def := r.queues[defaultQueueName]
+	r.schedules = NewScheduler(r, def.ids(), logger, 0)
+	//A store which keeps state holds the schedules next to the default queue.
+	if store, ok := def.store.(StateStore); ok {
+		if err := r.schedules.restore(store.State().Schedules); err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.schedules.setJournal(stateJournal{queue: def})
+	}
+	return r, nil
+}
+
+func (r *Registry) newQueue(name string, config QueueConfig) (*JobListQueue, error) {
+	store, err := r.stores.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	q := NewQueueWithStore(log.With(r.log, "queue", name), config, store)
+	if r.journal != nil {
+		q.journal = queueJournal{journal: r.journal, name: name}
+	}
+	q.events = queueEvents{hub: r.events, name: name}
+	return q, nil
+}
+
+//writeRecord appends a change to the set of queues to the journal. Caller must hold r.mutex.
+func (r *Registry) writeRecord(record walRecord) error {
+	if r.journal == nil {
+		return nil
+	}
+	record.Time = time.Now()
+	err := r.journal.Append(record)
+	if err != nil {
+		r.log.Log("level", "error", "msg", "failed to write write-ahead log", "op", record.Op, "queue", record.Queue, "error", err.Error())
+	}
+	return err
+}
+
+//Schedules returns the scheduler of the recurring jobs, it is started by its owner.
+func (r *Registry) Schedules() *Scheduler {
+	return r.schedules
+}
+
+//Events returns the hub the queues publish their job events to.
+func (r *Registry) Events() *EventHub {
+	return r.events
+}
+
+//Default returns the queue behind the /jobs routes.
+func (r *Registry) Default() *JobListQueue {
+	q, _ := r.Get(defaultQueueName)
+	return q
+}
+
+//Get returns the named queue, creating it if it does not exist yet.
+func (r *Registry) Get(name string) (*JobListQueue, error) {
+	if !queueNamePattern.MatchString(name) {
+		return nil, errInvalidQueueName
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	q, ok := r.queues[name]
+	if !ok {
+		var err error
+		q, err = r.newQueue(name, r.defaultConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.writeRecord(walRecord{Op: "createQueue", Queue: name}); err != nil {
+			q.Close()
+			return nil, err
+		}
+		r.queues[name] = q
+	}
+	return q, nil
+}
+
+//Create adds a queue with the given config. It fails if the queue already exists.
+func (r *Registry) Create(name string, config QueueConfig) (*JobListQueue, error) {
+	if !queueNamePattern.MatchString(name) {
+		return nil, errInvalidQueueName
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.queues[name]; ok {
+		return nil, errQueueExists
+	}
+	q, err := r.newQueue(name, config)
+	if err != nil {
+		return nil, err
+	}
+	settings := settingsOf(config)
+	q.mutex.Lock()
+	err = q.saveState(walRecord{Op: "configure", Config: &settings})
+	q.mutex.Unlock()
+	if err == nil {
+		err = r.writeRecord(walRecord{Op: "createQueue", Queue: name, Config: &settings})
+	}
+	if err != nil {
+		q.Close()
+		return nil, err
+	}
+	r.queues[name] = q
+	return q, nil
+}
+
+//Lookup returns the named queue without creating it.
+func (r *Registry) Lookup(name string) (*JobListQueue, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	q, ok := r.queues[name]
+	if !ok {
+		return nil, errQueueNotFound
+	}
+	return q, nil
+}
+
+//Names returns the names of all the queues, sorted.
+func (r *Registry) Names() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	names := make([]string, 0, len(r.queues))
+	for name := range r.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//Delete stops the queue and drops it together with its jobs.
+func (r *Registry) Delete(name string) error {
+	if name == defaultQueueName {
+		return errDeleteDefaultQueue
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	q, ok := r.queues[name]
+	if !ok {
+		return errQueueNotFound
+	}
+	if err := r.writeRecord(walRecord{Op: "deleteQueue", Queue: name}); err != nil {
+		return err
+	}
+	delete(r.queues, name)
+	q.Close()
+	return r.stores.Drop(name)
+}
+
+//Copy returns everything in the queue, leaving it in place.
+func (r *Registry) Copy(name string) (queueSnapshot, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	q, ok := r.queues[name]
+	if !ok {
+		return queueSnapshot{}, errQueueNotFound
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.capture(name), nil
+}
+
+//Release removes the queue and returns everything in it, so it can be imported somewhere else.
+//The default queue is emptied instead.
+func (r *Registry) Release(name string) (queueSnapshot, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	q, ok := r.queues[name]
+	if !ok {
+		return queueSnapshot{}, errQueueNotFound
+	}
+	q.mutex.Lock()
+	s := q.capture(name)
+	q.mutex.Unlock()
+	if err := r.writeRecord(walRecord{Op: "releaseQueue", Queue: name}); err != nil {
+		return queueSnapshot{}, err
+	}
+	return s, r.release(name)
+}
+
+//release drops the queue and its jobs, the default queue is emptied in place. Caller must hold r.mutex.
+func (r *Registry) release(name string) error {
+	q, ok := r.queues[name]
+	if !ok {
+		return nil
+	}
+	if name == defaultQueueName {
+		return q.clear(r.defaultConfig, func() (Store, error) {
+			if err := r.stores.Drop(name); err != nil {
+				return nil, err
+			}
+			return r.stores.Open(name)
+		})
+	}
+	delete(r.queues, name)
+	q.Close()
+	return r.stores.Drop(name)
+}
+
+//Import adds the jobs, dead letters and config of a released queue to the queue of the same name, which is
+//created if it does not exist. Jobs the queue already holds are skipped, so importing a snapshot again changes
+//nothing.
+func (r *Registry) Import(s queueSnapshot) (*JobListQueue, error) {
+	if !queueNamePattern.MatchString(s.Name) {
+		return nil, errInvalidQueueName
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	q, err := r.importQueue(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.writeRecord(walRecord{Op: "importQueue", Queue: s.Name, Snapshot: &s}); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+//importQueue loads the snapshot into its queue. Caller must hold r.mutex.
+func (r *Registry) importQueue(s queueSnapshot) (*JobListQueue, error) {
+	q, ok := r.queues[s.Name]
+	if !ok {
+		var err error
+		q, err = r.newQueue(s.Name, r.defaultConfig)
+		if err != nil {
+			return nil, err
+		}
+		r.queues[s.Name] = q
+	}
+	if err := q.restore(s); err != nil {
+		return nil, err
+	}
+	q.rebuildIndexes()
+	return q, nil
+}
+
+//reapAll requeues the expired leases and promotes the due jobs of every queue.
+func (r *Registry) reapAll() {
+	r.mutex.Lock()
+	queues := make([]*JobListQueue, 0, len(r.queues))
+	for _, q := range r.queues {
+		queues = append(queues, q)
+	}
+	r.mutex.Unlock()
+
+	for _, q := range queues {
+		q.reapDue()
+	}
+}
+
+//Close stops every queue.
+func (r *Registry) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, q := range r.queues {
+		q.Close()
+	}
+}
+
+//jsonDuration is a time.Duration written as a string like "30s" in JSON.
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.Wrap(err, "durations must be strings like \"30s\"")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if parsed < 0 {
+		return errNegativeDuration
+	}
+	*d = jsonDuration(parsed)
+	return nil
+}
+
+//queueSettings is the JSON view of the QueueConfig of a queue. Fields left out of a request keep their current value.
+type queueSettings struct {
+	LeaseTimeout      *jsonDuration `json:"leaseTimeout,omitempty"`
+	MaxAttempts       *int          `json:"maxAttempts,omitempty"`
+	MaxAttemptsByType TypeLimits    `json:"maxAttemptsByType,omitempty"`
+	RetryBackoff      *jsonDuration `json:"retryBackoff,omitempty"`
+	MaxRetryBackoff   *jsonDuration `json:"maxRetryBackoff,omitempty"`
+	MaxPayloadBytes   *int          `json:"maxPayloadBytes,omitempty"`
+	MaxResultBytes    *int          `json:"maxResultBytes,omitempty"`
+	AgingInterval     *jsonDuration `json:"agingInterval,omitempty"`
+	IdempotencyWindow *jsonDuration `json:"idempotencyWindow,omitempty"`
+}
+
+func settingsOf(config QueueConfig) queueSettings {
+	leaseTimeout := jsonDuration(config.LeaseTimeout)
+	retryBackoff := jsonDuration(config.RetryBackoff)
+	maxRetryBackoff := jsonDuration(config.MaxRetryBackoff)
+	agingInterval := jsonDuration(config.AgingInterval)
+	idempotencyWindow := jsonDuration(config.IdempotencyWindow)
+	return queueSettings{
+		LeaseTimeout:      &leaseTimeout,
+		MaxAttempts:       &config.MaxAttempts,
+		MaxAttemptsByType: config.MaxAttemptsByType,
+		RetryBackoff:      &retryBackoff,
+		MaxRetryBackoff:   &maxRetryBackoff,
+		MaxPayloadBytes:   &config.MaxPayloadBytes,
+		MaxResultBytes:    &config.MaxResultBytes,
+		AgingInterval:     &agingInterval,
+		IdempotencyWindow: &idempotencyWindow,
+	}
+}
+
+//apply returns the config with the fields set in the settings replaced.
+func (s queueSettings) apply(config QueueConfig) QueueConfig {
+	if s.LeaseTimeout != nil {
+		config.LeaseTimeout = time.Duration(*s.LeaseTimeout)
+	}
+	if s.MaxAttempts != nil {
+		config.MaxAttempts = *s.MaxAttempts
+	}
+	if s.MaxAttemptsByType != nil {
+		config.MaxAttemptsByType = s.MaxAttemptsByType
+	}
+	if s.RetryBackoff != nil {
+		config.RetryBackoff = time.Duration(*s.RetryBackoff)
+	}
+	if s.MaxRetryBackoff != nil {
+		config.MaxRetryBackoff = time.Duration(*s.MaxRetryBackoff)
+	}
+	if s.MaxPayloadBytes != nil {
+		config.MaxPayloadBytes = *s.MaxPayloadBytes
+	}
+	if s.MaxResultBytes != nil {
+		config.MaxResultBytes = *s.MaxResultBytes
+	}
+	if s.AgingInterval != nil {
+		config.AgingInterval = time.Duration(*s.AgingInterval)
+	}
+	if s.IdempotencyWindow != nil {
+		config.IdempotencyWindow = time.Duration(*s.IdempotencyWindow)
+	}
+	return config
+}
+
+type queueRequest struct {
+	Name   string        `json:"name"`
+	Config queueSettings `json:"config"`
+}
+
+type queueInfo struct {
+	Name   string        `json:"name"`
+	Jobs   int           `json:"jobs"`
+	Config queueSettings `json:"config"`
+}
+
+func infoOf(name string, q *JobListQueue) queueInfo {
+	return queueInfo{Name: name, Jobs: q.Len(), Config: settingsOf(q.Config())}
+}
+
+type queueContextKey struct{}
+
+//withNamedQueue resolves the {queue_name} of the request, creating the queue if needed, for the job handlers.
+func (h *handler) withNamedQueue(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := h.queues.Get(mux.Vars(r)["queue_name"])
+		if err != nil {
+			Respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), queueContextKey{}, q)))
+	})
+}
+
+//queueFor returns the queue the request operates on, the handler's queue unless the route names one.
+func (h *handler) queueFor(r *http.Request) Queue {
+	if q, ok := r.Context().Value(queueContextKey{}).(*JobListQueue); ok {
+		return q
+	}
+	return h.queue
+}
+
+func (h *handler) getQueues(w http.ResponseWriter, r *http.Request) {
+	arr := make([]queueInfo, 0)
+	for _, name := range h.queues.Names() {
+		q, err := h.queues.Lookup(name)
+		if err != nil {
+			continue
+		}
+		arr = append(arr, infoOf(name, q))
+	}
+	Respond(w, http.StatusOK, arr)
+	return
+}
+
+func (h *handler) createQueue(w http.ResponseWriter, r *http.Request) {
+	var req queueRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Log("level", "error", "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	q, err := h.queues.Create(req.Name, req.Config.apply(h.queues.defaultConfig))
+	if err == errQueueExists {
+		Respond(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	Respond(w, http.StatusCreated, infoOf(req.Name, q))
+	return
+}
+
+func (h *handler) getQueue(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["queue_name"]
+	q, err := h.queues.Lookup(name)
+	if err != nil {
+		Respond(w, http.StatusNotFound, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, infoOf(name, q))
+	return
+}
+
+func (h *handler) configureQueue(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["queue_name"]
+	q, err := h.queues.Lookup(name)
+	if err != nil {
+		Respond(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	var req queueSettings
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Log("level", "error", "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = q.Configure(req.apply(q.Config()))
+	if err != nil {
+		h.logger.Log("level", "error", "msg", "failed to configure queue", "queue", name, "error", err.Error())
+		Respond(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, infoOf(name, q))
+	return
+}
+
+//importQueue adds the jobs of a queue released by another server, as sent when shards are rebalanced.
+func (h *handler) importQueue(w http.ResponseWriter, r *http.Request) {
+	var req queueSnapshot
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Log("level", "error", "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req.Name = mux.Vars(r)["queue_name"]
+
+	q, err := h.queues.Import(req)
+	if err == errInvalidQueueName {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		h.logger.Log("level", "error", "msg", "failed to import queue", "queue", req.Name, "error", err.Error())
+		Respond(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, infoOf(req.Name, q))
+	return
+}
+
+func (h *handler) deleteQueue(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["queue_name"]
+	err := h.queues.Delete(name)
+	if err == errDeleteDefaultQueue {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		Respond(w, http.StatusNotFound, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, queueInfo{Name: name})
+	return
+}
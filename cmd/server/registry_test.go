@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestRegistryHandler() (handler, *Registry) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	registry := NewRegistry(log.NewNopLogger(), config)
+	h := newHandler(registry.Default(), log.NewNopLogger())
+	h.queues = registry
+	return h, registry
+}
+
+func TestNamedQueues_Isolation(t *testing.T) {
+	h, registry := newTestRegistryHandler()
+
+	rr, _ := do(h, http.MethodPost, "/queues/emails/jobs/enqueue", http.Header{}, job{Type: "TIME_CRITICAL"})
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+	var enqueueResponse jobIdResponse
+	json.Unmarshal(rr.Body.Bytes(), &enqueueResponse)
+
+	//The queue was created on first use and holds the job
+	emails, err := registry.Lookup("emails")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, emails.Len())
+	assert.Equal(t, 0, registry.Default().Len())
+
+	//The default queue has nothing to dequeue
+	header := http.Header{}
+	header.Set("CONSUMER_ID", "cId1")
+	rr, _ = do(h, http.MethodGet, "/jobs/dequeue", header, nil)
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusInternalServerError)
+	}
+
+	rr, _ = do(h, http.MethodGet, "/queues/emails/jobs/dequeue", header, nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	var dequeueResponse job
+	json.Unmarshal(rr.Body.Bytes(), &dequeueResponse)
+	assert.Equal(t, enqueueResponse.JobId, dequeueResponse.Id)
+
+	rr, _ = do(h, http.MethodPost, "/queues/not%20valid/jobs/enqueue", http.Header{}, job{Type: "TIME_CRITICAL"})
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+}
+
+func TestNamedQueues_Management(t *testing.T) {
+	h, registry := newTestRegistryHandler()
+
+	leaseTimeout := jsonDuration(time.Minute)
+	body := queueRequest{Name: "reports", Config: queueSettings{LeaseTimeout: &leaseTimeout}}
+	rr, _ := do(h, http.MethodPost, "/queues", http.Header{}, body)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+	rr, _ = do(h, http.MethodPost, "/queues", http.Header{}, body)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusConflict)
+	}
+
+	reports, _ := registry.Lookup("reports")
+	assert.Equal(t, time.Minute, reports.Config().LeaseTimeout)
+	assert.Equal(t, DefaultQueueConfig().MaxAttempts, reports.Config().MaxAttempts)
+
+	maxAttempts := 7
+	rr, _ = do(h, http.MethodPut, "/queues/reports", http.Header{}, queueSettings{MaxAttempts: &maxAttempts})
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	var info queueInfo
+	json.Unmarshal(rr.Body.Bytes(), &info)
+	assert.Equal(t, 7, *info.Config.MaxAttempts)
+	assert.Equal(t, jsonDuration(time.Minute), *info.Config.LeaseTimeout)
+
+	rr, _ = do(h, http.MethodGet, "/queues", http.Header{}, nil)
+	var infos []queueInfo
+	json.Unmarshal(rr.Body.Bytes(), &infos)
+	assert.Equal(t, 2, len(infos))
+	assert.Equal(t, "default", infos[0].Name)
+	assert.Equal(t, "reports", infos[1].Name)
+
+	rr, _ = do(h, http.MethodDelete, "/queues/default", http.Header{}, nil)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+	rr, _ = do(h, http.MethodDelete, "/queues/reports", http.Header{}, nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	rr, _ = do(h, http.MethodGet, "/queues/reports", http.Header{}, nil)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+}
+
+//failingJournal refuses every record.
+type failingJournal struct{}
+
+func (failingJournal) Append(record walRecord) error {
+	return errors.New("disk full")
+}
+
+func TestNamedQueues_ConfigureRefused(t *testing.T) {
+	h, registry := newTestRegistryHandler()
+	reports, _ := registry.Get("reports")
+
+	rr, _ := do(h, http.MethodPut, "/queues/reports", http.Header{}, map[string]string{"leaseTimeout": "-1s"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, DefaultQueueConfig().LeaseTimeout, reports.Config().LeaseTimeout)
+
+	//A change which is not recorded is not made.
+	reports.mutex.Lock()
+	reports.journal = failingJournal{}
+	reports.mutex.Unlock()
+	maxAttempts := 7
+	rr, _ = do(h, http.MethodPut, "/queues/reports", http.Header{}, queueSettings{MaxAttempts: &maxAttempts})
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, DefaultQueueConfig().MaxAttempts, reports.Config().MaxAttempts)
+}
+
+func TestJobListQueue_ConfigureAging(t *testing.T) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	var q = NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	low := job{Type: "NOT_TIME_CRITICAL"}
+	idLow, _ := q.Enqueue(&low)
+	now = now.Add(time.Hour)
+	critical := job{Type: "TIME_CRITICAL"}
+	q.Enqueue(&critical)
+
+	//Turning aging on reorders the jobs already queued
+	config.AgingInterval = time.Minute
+	q.Configure(config)
+	item, _ := q.Dequeue("cId1")
+	assert.Equal(t, idLow, item.Id)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+//Fail is called by the consumer holding the lease when it could not process the job.
+//The attempt is counted and the job is retried after an exponential backoff, or marked FAILED and
+//dead-lettered once it has used up its attempts.
+func (q *JobListQueue) Fail(jobID int, consumerId string, reason string) (*job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.requeueExpired()
+
+	e, ok := q.store.Get(jobID)
+	if !ok {
+		return nil, errors.New("JobId not present in the Queue")
+	}
+
+	cId, ok := q.consumerDetails.Load(jobID)
+	if !ok {
+		return nil, errors.New("Job is not leased to any consumer")
+	}
+	if cId != consumerId {
+		return nil, errNotLeaseHolder
+	}
+
+	q.recordAttempt(e, "FAILED", reason)
+	q.releaseLease(e)
+
+	var err error
+	if q.exhausted(&e.Value) {
+		err = q.deadLetter(e, "FAILED")
+	} else {
+		retryAt := q.now().Add(q.backoff(e.Value.Attempts))
+		e.Value.RetryAt = &retryAt
+		q.delay(e, "RETRY_PENDING", retryAt)
+		err = q.record("fail", e)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	details := q.snapshot(e)
+	return &details, nil
+}
+
+//maxAttempts resolves the attempt limit of the job. The job's own limit wins over the limit of its type.
+//Zero means the job is retried forever.
+func (q *JobListQueue) maxAttempts(item *job) int {
+	if item.MaxAttempts > 0 {
+		return item.MaxAttempts
+	}
+	if limit, ok := q.config.MaxAttemptsByType[item.Type]; ok && limit > 0 {
+		return limit
+	}
+	return q.config.MaxAttempts
+}
+
+//exhausted reports whether the job used up all its attempts.
+func (q *JobListQueue) exhausted(item *job) bool {
+	limit := q.maxAttempts(item)
+	return limit > 0 && item.Attempts >= limit
+}
+
+//backoff returns RetryBackoff doubled for every attempt after the first, capped at MaxRetryBackoff.
+func (q *JobListQueue) backoff(attempts int) time.Duration {
+	delay := q.config.RetryBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if q.config.MaxRetryBackoff > 0 && delay >= q.config.MaxRetryBackoff {
+			return q.config.MaxRetryBackoff
+		}
+	}
+	return delay
+}
@@ -9,13 +9,62 @@ func newRouter(h *handler) http.Handler {
 	router := mux.NewRouter()
 	router.HandleFunc("/health", healthHandler).Methods(http.MethodGet)
 
+	//The /jobs and /deadletters routes serve the default queue
+	registerQueueRoutes(router, h)
+
+	//Named queues, only served when the handler has a registry
+	if h.queues != nil {
+		queuesRouter := router.PathPrefix("/queues").Subrouter()
+		queuesRouter.HandleFunc("/{queue_name}", h.getQueue).Methods(http.MethodGet)
+		queuesRouter.HandleFunc("/{queue_name}", h.configureQueue).Methods(http.MethodPut)
+		queuesRouter.HandleFunc("/{queue_name}", h.deleteQueue).Methods(http.MethodDelete)
+		queuesRouter.HandleFunc("", h.createQueue).Methods(http.MethodPost)
+		queuesRouter.HandleFunc("", h.getQueues).Methods(http.MethodGet)
+		//Queues handed over by another shard, Shards only lets peer shards through
+		if h.shards != nil {
+			queuesRouter.HandleFunc("/{queue_name}/import", h.importQueue).Methods(http.MethodPost)
+		}
+
+		namedQueueRouter := queuesRouter.PathPrefix("/{queue_name}").Subrouter()
+		namedQueueRouter.Use(h.withNamedQueue)
+		registerQueueRoutes(namedQueueRouter, h)
+
+		//Job lifecycle events of all the queues
+		router.HandleFunc("/events", h.events).Methods(http.MethodGet)
+	}
+
+	//Recurring jobs, only served when the handler has a scheduler
+	if h.schedules != nil {
+		schedulesRouter := router.PathPrefix("/schedules").Subrouter()
+		schedulesRouter.HandleFunc("/{schedule_id}", h.getSchedule).Methods(http.MethodGet)
+		schedulesRouter.HandleFunc("/{schedule_id}", h.updateSchedule).Methods(http.MethodPut)
+		schedulesRouter.HandleFunc("/{schedule_id}", h.deleteSchedule).Methods(http.MethodDelete)
+		schedulesRouter.HandleFunc("", h.createSchedule).Methods(http.MethodPost)
+		schedulesRouter.HandleFunc("", h.getSchedules).Methods(http.MethodGet)
+	}
+	return router
+}
+
+//registerQueueRoutes adds the routes operating on a single queue to the router.
+func registerQueueRoutes(router *mux.Router, h *handler) {
 	//Create a subRouter for all the paths with prefix jobs
 	jobsRouter := router.PathPrefix("/jobs").Subrouter()
 	jobsRouter.HandleFunc("/enqueue", h.enqueue).Methods(http.MethodPost)
+	jobsRouter.HandleFunc("/enqueue:batch", h.enqueueBatch).Methods(http.MethodPost)
 	jobsRouter.HandleFunc("/dequeue", h.dequeue).Methods(http.MethodGet)
+	jobsRouter.HandleFunc("/stream", h.stream).Methods(http.MethodGet)
 	jobsRouter.HandleFunc("/{job_id}/conclude", h.conclude).Methods(http.MethodPost)
+	jobsRouter.HandleFunc("/{job_id}/heartbeat", h.heartbeat).Methods(http.MethodPost)
+	jobsRouter.HandleFunc("/{job_id}/fail", h.fail).Methods(http.MethodPost)
 	jobsRouter.HandleFunc("/{job_id}", h.getJob).Methods(http.MethodGet)
 	jobsRouter.HandleFunc("", h.remove).Methods(http.MethodDelete)
 	jobsRouter.HandleFunc("", h.getJobs).Methods(http.MethodGet)
-	return router
+
+	//Jobs which failed permanently or ran out of leases
+	deadLettersRouter := router.PathPrefix("/deadletters").Subrouter()
+	deadLettersRouter.HandleFunc("/{job_id}/redrive", h.redrive).Methods(http.MethodPost)
+	deadLettersRouter.HandleFunc("/{job_id}", h.getDeadLetter).Methods(http.MethodGet)
+	deadLettersRouter.HandleFunc("/{job_id}", h.purgeDeadLetter).Methods(http.MethodDelete)
+	deadLettersRouter.HandleFunc("", h.getDeadLetters).Methods(http.MethodGet)
+	deadLettersRouter.HandleFunc("", h.purgeDeadLetters).Methods(http.MethodDelete)
 }
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//maxCatchUpRuns bounds how many missed runs a catch-up schedule enqueues in one go.
+const maxCatchUpRuns = 100
+
+//A recurring job. Every time the cron expression fires a copy of Job is enqueued into Queue, the default queue
+//when it is empty. MissedRunPolicy decides what happens to runs which came due while the scheduler could not fire them:
+//"skip" enqueues a single job for the latest of them, "catchup" enqueues one job per missed run.
+type schedule struct {
+	Id              int        `json:"id"`
+	Cron            string     `json:"cron"`
+	Job             job        `json:"job"`
+	Queue           string     `json:"queue,omitempty"`
+	MissedRunPolicy string     `json:"missedRunPolicy"`
+	LastRun         *time.Time `json:"lastRun,omitempty"`
+	NextRun         *time.Time `json:"nextRun,omitempty"`
+	LastJobId       int        `json:"lastJobId,omitempty"`
+	cron            *cronSchedule
+}
+
+//Scheduler enqueues jobs for the registered schedules on every tick of their cron expression, into the queues of
+//the registry. Every change to the schedules is written to the journal before it is applied, like the changes to
+//the jobs.
+type Scheduler struct {
+	schedules map[int]*schedule
+	queues    *Registry
+	ids       IDGenerator
+	journal   journal
+	log       log.Logger
+	mutex     sync.Mutex
+	now       func() time.Time
+	active    func() bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+//NewScheduler creates the scheduler and starts checking for due schedules every interval. Zero disables the ticker.
+//Schedule ids are taken from ids, the generator of the queues.
+func NewScheduler(queues *Registry, ids IDGenerator, logger log.Logger, interval time.Duration) *Scheduler {
+	s := &Scheduler{
+		schedules: make(map[int]*schedule),
+		queues:    queues,
+		ids:       ids,
+		log:       logger,
+		now:       time.Now,
+		done:      make(chan struct{}),
+	}
+	if interval > 0 {
+		s.Start(interval)
+	}
+	return s
+}
+
+//Start checks for due schedules every interval.
+func (s *Scheduler) Start(interval time.Duration) {
+	go s.run(interval)
+}
+
+//setJournal makes the scheduler write its changes to j.
+func (s *Scheduler) setJournal(j journal) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.journal = j
+}
+
+//writeRecord appends a change to the schedules to the journal. Caller must hold s.mutex.
+func (s *Scheduler) writeRecord(record walRecord) error {
+	if s.journal == nil {
+		return nil
+	}
+	record.Time = s.now()
+	err := s.journal.Append(record)
+	if err != nil {
+		s.log.Log("level", "error", "msg", "failed to write write-ahead log", "op", record.Op, "scheduleId", record.ScheduleId, "error", err.Error())
+	}
+	return err
+}
+
+//save records the state of the schedule and puts it in place. Caller must hold s.mutex.
+func (s *Scheduler) save(sc *schedule) error {
+	if err := s.writeRecord(walRecord{Op: "saveSchedule", ScheduleId: sc.Id, Schedule: sc}); err != nil {
+		return err
+	}
+	s.schedules[sc.Id] = sc
+	return nil
+}
+
+//remove records the removal of the schedule and drops it. Caller must hold s.mutex.
+func (s *Scheduler) remove(id int) error {
+	if err := s.writeRecord(walRecord{Op: "deleteSchedule", ScheduleId: id}); err != nil {
+		return err
+	}
+	delete(s.schedules, id)
+	return nil
+}
+
+//prepare validates the schedule and computes its next run. Caller must hold s.mutex.
+func (s *Scheduler) prepare(sc *schedule) error {
+	parsed, err := parseCron(sc.Cron)
+	if err != nil {
+		return err
+	}
+	if err := s.checkJob(sc); err != nil {
+		return err
+	}
+	switch sc.MissedRunPolicy {
+	case "":
+		sc.MissedRunPolicy = "skip"
+	case "skip", "catchup":
+	default:
+		return errors.Errorf("unknown missedRunPolicy %q, expected skip or catchup", sc.MissedRunPolicy)
+	}
+	next := parsed.Next(s.now())
+	if next.IsZero() {
+		return errors.Errorf("cron expression %q never fires", sc.Cron)
+	}
+	sc.cron = parsed
+	sc.NextRun = &next
+	return nil
+}
+
+//checkJob refuses a job template its queue would refuse on every run. The queue is not created until the schedule
+//fires. Caller must hold s.mutex.
+func (s *Scheduler) checkJob(sc *schedule) error {
+	if sc.Queue != "" && !queueNamePattern.MatchString(sc.Queue) {
+		return errInvalidQueueName
+	}
+	if !validUniquePolicy(sc.Job.UniquePolicy) {
+		return errInvalidUniquePolicy
+	}
+	config := s.queues.defaultConfig
+	if q, err := s.queues.Lookup(s.queueName(sc)); err == nil {
+		config = q.Config()
+	}
+	if config.MaxPayloadBytes > 0 && len(sc.Job.Payload) > config.MaxPayloadBytes {
+		return errPayloadTooLarge
+	}
+	return nil
+}
+
+//queueName returns the name of the queue the schedule enqueues into.
+func (s *Scheduler) queueName(sc *schedule) string {
+	if sc.Queue == "" {
+		return defaultQueueName
+	}
+	return sc.Queue
+}
+
+//Create registers a new schedule and returns it with its id and next run.
+func (s *Scheduler) Create(sc *schedule) (*schedule, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.prepare(sc)
+	if err != nil {
+		return nil, err
+	}
+	sc.Id = s.ids.NextID()
+	sc.LastRun = nil
+	sc.LastJobId = 0
+	if err := s.save(sc); err != nil {
+		return nil, err
+	}
+
+	details := *sc
+	return &details, nil
+}
+
+//Update replaces the cron expression, job template and policy of the schedule. The run history is kept.
+func (s *Scheduler) Update(id int, sc *schedule) (*schedule, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing, ok := s.schedules[id]
+	if !ok {
+		return nil, errScheduleNotFound
+	}
+	err := s.prepare(sc)
+	if err != nil {
+		return nil, err
+	}
+	sc.Id = id
+	sc.LastRun = existing.LastRun
+	sc.LastJobId = existing.LastJobId
+	if err := s.save(sc); err != nil {
+		return nil, err
+	}
+
+	details := *sc
+	return &details, nil
+}
+
+func (s *Scheduler) Get(id int) (*schedule, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sc, ok := s.schedules[id]
+	if !ok {
+		return nil, errScheduleNotFound
+	}
+	details := *sc
+	return &details, nil
+}
+
+//List returns all the schedules ordered by their next run.
+func (s *Scheduler) List() []schedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	arr := make([]schedule, 0, len(s.schedules))
+	for _, sc := range s.schedules {
+		arr = append(arr, *sc)
+	}
+	sort.Slice(arr, func(i, j int) bool { return arr[i].NextRun.Before(*arr[j].NextRun) })
+	return arr
+}
+
+func (s *Scheduler) Delete(id int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.schedules[id]; !ok {
+		return errScheduleNotFound
+	}
+	return s.remove(id)
+}
+
+//SetActive makes the scheduler fire schedules only while active returns true, in a cluster only on the leader.
+func (s *Scheduler) SetActive(active func() bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.active = active
+}
+
+//runDue enqueues the jobs of every schedule which came due.
+func (s *Scheduler) runDue() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.active != nil && !s.active() {
+		return
+	}
+
+	now := s.now()
+	for _, sc := range s.schedules {
+		if sc.NextRun.After(now) {
+			continue
+		}
+
+		//Collect the runs which came due since the last tick.
+		runs := []time.Time{*sc.NextRun}
+		next := sc.cron.Next(*sc.NextRun)
+		for !next.IsZero() && !next.After(now) {
+			if len(runs) < maxCatchUpRuns {
+				runs = append(runs, next)
+			}
+			next = sc.cron.Next(next)
+		}
+		if sc.MissedRunPolicy == "skip" {
+			runs = runs[len(runs)-1:]
+		}
+
+		q, err := s.queues.Get(s.queueName(sc))
+		for _, run := range runs {
+			if err != nil {
+				s.log.Log("level", "error", "msg", "Not able to queue scheduled job", "scheduleId", sc.Id, "queue", s.queueName(sc), "error", err.Error())
+				break
+			}
+			item := sc.Job
+			item.RunAt = nil
+			item.DelaySeconds = 0
+			jobId, err := q.Enqueue(&item)
+			if err != nil {
+				s.log.Log("level", "error", "msg", "Not able to queue scheduled job", "scheduleId", sc.Id, "queue", s.queueName(sc), "error", err.Error())
+				continue
+			}
+			lastRun := run
+			sc.LastRun = &lastRun
+			sc.LastJobId = jobId
+		}
+
+		if next.IsZero() {
+			s.log.Log("level", "info", "msg", "schedule never fires again, removing it", "scheduleId", sc.Id)
+			//A failed write leaves the schedule behind after a restart, where it is removed again.
+			s.remove(sc.Id)
+			delete(s.schedules, sc.Id)
+			continue
+		}
+		sc.NextRun = &next
+		//The jobs are enqueued already, a failed write only risks running them again after a restart.
+		s.save(sc)
+	}
+}
+
+//replay applies a record read back from the write-ahead log, or from the replicated log of a cluster.
+func (s *Scheduler) replay(record walRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch record.Op {
+	case "saveSchedule":
+		if record.Schedule == nil {
+			return errors.New("record saveSchedule has no schedule")
+		}
+		return s.put(*record.Schedule)
+	case "deleteSchedule":
+		delete(s.schedules, record.ScheduleId)
+		return nil
+	}
+	return errors.Errorf("unknown schedule record %s", record.Op)
+}
+
+//restore loads the schedules of a snapshot.
+func (s *Scheduler) restore(schedules []schedule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, sc := range schedules {
+		if err := s.put(sc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//put adds the schedule as it was recorded, without computing its next run again. Caller must hold s.mutex.
+func (s *Scheduler) put(sc schedule) error {
+	parsed, err := parseCron(sc.Cron)
+	if err != nil {
+		return errors.Wrapf(err, "schedule %d", sc.Id)
+	}
+	sc.cron = parsed
+	s.ids.Observe(sc.Id)
+	s.schedules[sc.Id] = &sc
+	return nil
+}
+
+//capture returns every schedule ordered by id. Caller must hold s.mutex.
+func (s *Scheduler) capture() []schedule {
+	arr := make([]schedule, 0, len(s.schedules))
+	for _, sc := range s.schedules {
+		arr = append(arr, *sc)
+	}
+	sort.Slice(arr, func(i, j int) bool { return arr[i].Id < arr[j].Id })
+	return arr
+}
+
+//clear drops every schedule without writing to the journal, the schedules are rebuilt by replaying records afterwards.
+func (s *Scheduler) clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.schedules = make(map[int]*schedule)
+}
+
+func (s *Scheduler) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.runDue()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+//Close stops the scheduler ticker.
+func (s *Scheduler) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+var errScheduleNotFound = errors.New("ScheduleId not present")
+
+func (h *handler) createSchedule(w http.ResponseWriter, r *http.Request) {
+	var req schedule
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Log("level", "error", "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sc, err := h.schedules.Create(&req)
+	if err != nil {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	Respond(w, http.StatusCreated, sc)
+	return
+}
+
+func (h *handler) updateSchedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["schedule_id"]
+	if !ok {
+		h.logger.Log("level", "error", "msg", "could not get ScheduleId from the request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	scheduleID, _ := strconv.Atoi(id)
+
+	var req schedule
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Log("level", "error", "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sc, err := h.schedules.Update(scheduleID, &req)
+	if err == errScheduleNotFound {
+		Respond(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, sc)
+	return
+}
+
+func (h *handler) getSchedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["schedule_id"]
+	if !ok {
+		h.logger.Log("level", "error", "msg", "could not get ScheduleId from the request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	scheduleID, _ := strconv.Atoi(id)
+
+	sc, err := h.schedules.Get(scheduleID)
+	if err != nil {
+		Respond(w, http.StatusNotFound, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, sc)
+	return
+}
+
+func (h *handler) getSchedules(w http.ResponseWriter, r *http.Request) {
+	Respond(w, http.StatusOK, h.schedules.List())
+	return
+}
+
+func (h *handler) deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["schedule_id"]
+	if !ok {
+		h.logger.Log("level", "error", "msg", "could not get ScheduleId from the request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	scheduleID, _ := strconv.Atoi(id)
+
+	err := h.schedules.Delete(scheduleID)
+	if err != nil {
+		Respond(w, http.StatusNotFound, err.Error())
+		return
+	}
+	Respond(w, http.StatusOK, scheduleIdResponse{ScheduleId: scheduleID})
+	return
+}
+
+type scheduleIdResponse struct {
+	ScheduleId int `json:"scheduleId"`
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestScheduler(now *time.Time) (*Scheduler, *JobListQueue) {
+	s, registry := newTestSchedulerRegistry(now)
+	return s, registry.Default()
+}
+
+func newTestSchedulerRegistry(now *time.Time) (*Scheduler, *Registry) {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	config.MaxPayloadBytes = 16
+	registry := NewRegistry(log.NewNopLogger(), config)
+	s := registry.Schedules()
+	s.now = func() time.Time { return *now }
+	return s, registry
+}
+
+func TestScheduler_RunDue(t *testing.T) {
+	now := time.Date(2020, time.October, 8, 10, 7, 0, 0, time.UTC)
+	s, q := newTestScheduler(&now)
+
+	sc, err := s.Create(&schedule{Cron: "*/5 * * * *", Job: job{Type: "TIME_CRITICAL"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "skip", sc.MissedRunPolicy)
+	assert.Equal(t, time.Date(2020, time.October, 8, 10, 10, 0, 0, time.UTC), *sc.NextRun)
+
+	//Not due yet
+	s.runDue()
+	_, err = q.GetJobs()
+	assert.NotNil(t, err)
+
+	now = time.Date(2020, time.October, 8, 10, 10, 0, 0, time.UTC)
+	s.runDue()
+	jobs, _ := q.GetJobs()
+	assert.Equal(t, 1, len(*jobs))
+	assert.Equal(t, "TIME_CRITICAL", (*jobs)[0].Type)
+
+	sc, _ = s.Get(sc.Id)
+	assert.Equal(t, now, *sc.LastRun)
+	assert.Equal(t, (*jobs)[0].Id, sc.LastJobId)
+	assert.Equal(t, time.Date(2020, time.October, 8, 10, 15, 0, 0, time.UTC), *sc.NextRun)
+}
+
+func TestScheduler_MissedRunPolicy(t *testing.T) {
+	now := time.Date(2020, time.October, 8, 10, 7, 0, 0, time.UTC)
+	s, q := newTestScheduler(&now)
+
+	s.Create(&schedule{Cron: "*/5 * * * *", Job: job{Type: "SKIP"}, MissedRunPolicy: "skip"})
+	s.Create(&schedule{Cron: "*/5 * * * *", Job: job{Type: "CATCHUP"}, MissedRunPolicy: "catchup"})
+
+	//Runs at 10:10, 10:15 and 10:20 were missed
+	now = time.Date(2020, time.October, 8, 10, 22, 0, 0, time.UTC)
+	s.runDue()
+
+	jobs, _ := q.GetJobs()
+	counts := map[string]int{}
+	for _, item := range *jobs {
+		counts[item.Type]++
+	}
+	assert.Equal(t, 1, counts["SKIP"])
+	assert.Equal(t, 3, counts["CATCHUP"])
+
+	for _, sc := range s.List() {
+		assert.Equal(t, time.Date(2020, time.October, 8, 10, 20, 0, 0, time.UTC), *sc.LastRun)
+		assert.Equal(t, time.Date(2020, time.October, 8, 10, 25, 0, 0, time.UTC), *sc.NextRun)
+	}
+}
+
+func TestScheduler_NamedQueue(t *testing.T) {
+	now := time.Date(2020, time.October, 8, 10, 7, 0, 0, time.UTC)
+	s, registry := newTestSchedulerRegistry(&now)
+
+	sc, err := s.Create(&schedule{Cron: "*/5 * * * *", Queue: "reports", Job: job{Type: "TIME_CRITICAL"}})
+	assert.Nil(t, err)
+	now = time.Date(2020, time.October, 8, 10, 10, 0, 0, time.UTC)
+	s.runDue()
+	reports, err := registry.Lookup("reports")
+	assert.Nil(t, err)
+	sc, _ = s.Get(sc.Id)
+	item, err := reports.GetJob(sc.LastJobId)
+	assert.Nil(t, err)
+	assert.Equal(t, "TIME_CRITICAL", item.Type)
+	assert.Equal(t, 0, registry.Default().Len())
+
+	//A template its queue would refuse on every run is refused right away.
+	_, err = s.Create(&schedule{Cron: "@hourly", Queue: "not valid", Job: job{Type: "TIME_CRITICAL"}})
+	assert.Equal(t, errInvalidQueueName, err)
+	_, err = s.Create(&schedule{Cron: "@hourly", Job: job{Type: "TIME_CRITICAL", UniqueKey: "k", UniquePolicy: "keep"}})
+	assert.Equal(t, errInvalidUniquePolicy, err)
+	_, err = s.Create(&schedule{Cron: "@hourly", Queue: "reports", Job: job{Type: "TIME_CRITICAL", Payload: json.RawMessage(`{"text":"far too long"}`)}})
+	assert.Equal(t, errPayloadTooLarge, err)
+	_, err = s.Update(sc.Id, &schedule{Cron: "@hourly", Job: job{Type: "TIME_CRITICAL", UniquePolicy: "keep"}})
+	assert.Equal(t, errInvalidUniquePolicy, err)
+}
+
+func TestScheduler_Recovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.wal")
+
+	now := time.Date(2020, time.October, 8, 10, 7, 0, 0, time.UTC)
+	wal, registry := openTestWAL(t, path)
+	s := registry.Schedules()
+	s.now = func() time.Time { return now }
+	hourly, _ := s.Create(&schedule{Cron: "@hourly", Job: job{Type: "HOURLY"}})
+	daily, _ := s.Create(&schedule{Cron: "@daily", Job: job{Type: "DAILY"}})
+	assert.NotEqual(t, hourly.Id, daily.Id)
+	assert.Nil(t, registry.Snapshot())
+
+	//The tail of the log after the snapshot
+	kept, _ := s.Create(&schedule{Cron: "*/5 * * * *", Job: job{Type: "FIVE"}})
+	assert.Nil(t, s.Delete(daily.Id))
+	now = time.Date(2020, time.October, 8, 11, 0, 0, 0, time.UTC)
+	s.runDue()
+	want := s.List()
+	registry.Close()
+	wal.Close()
+
+	wal, registry = openTestWAL(t, path)
+	defer wal.Close()
+	defer registry.Close()
+	s = registry.Schedules()
+	s.now = func() time.Time { return now }
+	got := s.List()
+	assert.Equal(t, len(want), len(got))
+	for i := range want {
+		assert.Equal(t, want[i].Id, got[i].Id)
+		assert.Equal(t, want[i].Job.Type, got[i].Job.Type)
+		assert.Equal(t, *want[i].NextRun, *got[i].NextRun)
+		assert.Equal(t, want[i].LastJobId, got[i].LastJobId)
+	}
+	_, err = s.Get(daily.Id)
+	assert.Equal(t, errScheduleNotFound, err)
+
+	//The recovered schedules still fire, and new ids come after theirs
+	now = time.Date(2020, time.October, 8, 11, 5, 0, 0, time.UTC)
+	s.runDue()
+	sc, _ := s.Get(kept.Id)
+	assert.Equal(t, now, *sc.LastRun)
+	created, _ := s.Create(&schedule{Cron: "@hourly", Job: job{Type: "HOURLY"}})
+	assert.True(t, created.Id > kept.Id)
+}
+
+func TestScheduleHandlers(t *testing.T) {
+	now := time.Now()
+	s, q := newTestScheduler(&now)
+	h := newHandler(q, log.NewNopLogger())
+	h.schedules = s
+
+	rr, _ := do(h, http.MethodPost, "/schedules", http.Header{}, schedule{Cron: "not a cron"})
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+
+	rr, _ = do(h, http.MethodPost, "/schedules", http.Header{}, schedule{Cron: "@hourly", Job: job{Type: "TIME_CRITICAL"}})
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+	var created schedule
+	err := json.Unmarshal(rr.Body.Bytes(), &created)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if created.NextRun == nil {
+		t.Errorf("nextRun should be set on a new schedule")
+	}
+
+	url := "/schedules/" + strconv.Itoa(created.Id)
+	rr, _ = do(h, http.MethodPut, url, http.Header{}, schedule{Cron: "@daily", Job: job{Type: "TIME_CRITICAL"}})
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	rr, _ = do(h, http.MethodDelete, url, http.Header{}, nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	rr, _ = do(h, http.MethodGet, url, http.Header{}, nil)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//shardHeader marks requests sent by the shard router of another shard. They are served where they arrive.
+const shardHeader = "X-Queue-Shard"
+
+//ringReplicas is the number of points of every shard on the hash ring.
+const ringReplicas = 128
+
+var errShardNotFound = errors.New("Shard not present")
+var errNotPeerShard = errors.New("Only another shard can import a queue")
+var errNotShardMember = errors.New("Only the nodes of the shards, or a client sending the shards secret, can change the layout")
+
+//hashRing places the shards on a consistent hash ring. Every shard has ringReplicas points on it, so the queues
+//spread evenly and adding or removing a shard only moves the queues next to its points.
+type hashRing struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash  uint32
+	shard string
+}
+
+func newHashRing(shards []string) *hashRing {
+	r := &hashRing{points: make([]ringPoint, 0, len(shards)*ringReplicas)}
+	for _, shard := range shards {
+		for i := 0; i < ringReplicas; i++ {
+			r.points = append(r.points, ringPoint{hash: hashKey(fmt.Sprintf("%s#%d", shard, i)), shard: shard})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].shard < r.points[j].shard
+	})
+	return r
+}
+
+//hashKey spreads similar keys, like queue-1 and queue-2, all over the ring.
+func hashKey(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+//owner returns the shard owning key, the one with the first point at or after the hash of key.
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+//shardLayout maps the id of every shard to the URLs of its nodes. A shard is a single server or a cluster,
+//whose followers forward to its leader.
+type shardLayout map[string][]string
+
+func (l shardLayout) ids() []string {
+	ids := make([]string, 0, len(l))
+	for id := range l {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+//add adds the shards and nodes of other to the layout.
+func (l shardLayout) add(other shardLayout) {
+	for id, urls := range other {
+		for _, target := range urls {
+			known := false
+			for _, u := range l[id] {
+				known = known || u == target
+			}
+			if !known {
+				l[id] = append(l[id], target)
+			}
+		}
+	}
+}
+
+//Shards partitions the queues between shards by the hash of their name. Requests for a queue owned by another
+//shard are forwarded to it. The /jobs, /deadletters and /schedules routes belong to the default queue.
+//Queues this shard does not own any more, after the layout changed, are handed over to their owner. Only the shards
+//of the current and the earlier layouts may import a queue, so a shard which left can still hand over its queues.
+//The layout is only changed by their nodes, or by a client sending the secret of the shards.
+type Shards struct {
+	self      string
+	secret    string
+	registry  *Registry
+	log       log.Logger
+	client    *http.Client
+	interval  time.Duration
+	mutex     sync.Mutex
+	idle      *sync.Cond
+	layout    shardLayout
+	members   shardLayout
+	ring      *hashRing
+	active    func() bool
+	moving    map[string]bool
+	inflight  map[string]int
+	trigger   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	waitGroup sync.WaitGroup
+}
+
+//NewShards routes the requests of shard self, and checks every interval for queues to hand over. Clients change
+//the layout by sending secret as a bearer token, none can when it is empty.
+func NewShards(self string, layout shardLayout, secret string, registry *Registry, logger log.Logger, interval time.Duration) (*Shards, error) {
+	if _, ok := layout[self]; !ok {
+		return nil, errors.Wrapf(errShardNotFound, "shard %s", self)
+	}
+	s := &Shards{
+		self:     self,
+		secret:   secret,
+		registry: registry,
+		log:      log.With(logger, "shard", self),
+		client:   &http.Client{Timeout: 30 * time.Second},
+		interval: interval,
+		layout:   layout,
+		members:  make(shardLayout),
+		ring:     newHashRing(layout.ids()),
+		moving:   make(map[string]bool),
+		inflight: make(map[string]int),
+		trigger:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	s.idle = sync.NewCond(&s.mutex)
+	s.members.add(layout)
+
+	s.waitGroup.Add(1)
+	go s.run()
+	return s, nil
+}
+
+//SetActive makes the shard hand over queues only while active returns true, in a cluster only on the leader.
+func (s *Shards) SetActive(active func() bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.active = active
+}
+
+//Owner returns the shard owning the queue.
+func (s *Shards) Owner(queue string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.ring.owner(queue)
+}
+
+//Owns reports whether this shard owns the queue.
+func (s *Shards) Owns(queue string) bool {
+	return s.Owner(queue) == s.self
+}
+
+//SetLayout replaces the layout and hands over the queues which moved to another shard.
+func (s *Shards) SetLayout(layout shardLayout) error {
+	if len(layout) == 0 {
+		return errors.New("A layout needs at least one shard")
+	}
+	s.mutex.Lock()
+	s.layout = layout
+	s.members.add(layout)
+	s.ring = newHashRing(layout.ids())
+	s.mutex.Unlock()
+
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Shards) run() {
+	defer s.waitGroup.Done()
+
+	var tick <-chan time.Time
+	if s.interval > 0 {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			s.rebalance()
+		case <-s.trigger:
+			s.rebalance()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+//rebalance hands over every queue owned by another shard. The default queue is only handed over when it holds jobs.
+func (s *Shards) rebalance() {
+	s.mutex.Lock()
+	active := s.active == nil || s.active()
+	s.mutex.Unlock()
+	if !active {
+		return
+	}
+
+	for _, name := range s.registry.Names() {
+		owner := s.Owner(name)
+		if owner == s.self {
+			continue
+		}
+		if name == defaultQueueName {
+			q, err := s.registry.Lookup(name)
+			if err != nil || (q.Len() == 0 && len(q.ListDeadLetters()) == 0) {
+				continue
+			}
+		}
+		if err := s.handOver(name, owner); err != nil {
+			s.log.Log("level", "error", "msg", "failed to hand over queue", "queue", name, "owner", owner, "error", err.Error())
+		}
+	}
+}
+
+//handOver moves the queue to its owner in two steps: the queue is copied to the owner, and released only once the
+//owner confirmed it took the copy. Requests for the queue are refused while it moves, and the ones in progress are
+//waited for, so nothing changes between the copy and the release.
+//If the shard stops before the release the queue is handed over again, and the owner skips the jobs it already holds.
+func (s *Shards) handOver(name string, owner string) error {
+	s.mutex.Lock()
+	s.moving[name] = true
+	for s.inflight[name] > 0 {
+		s.idle.Wait()
+	}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.moving, name)
+		s.mutex.Unlock()
+	}()
+
+	snapshot, err := s.registry.Copy(name)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	res, err := s.send(owner, http.MethodPost, "/queues/"+name+"/import", nil, body)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("shard %s answered %s", owner, res.Status)
+	}
+	if _, err := s.registry.Release(name); err != nil {
+		return errors.Wrapf(err, "shard %s took the queue, releasing it", owner)
+	}
+	s.log.Log("level", "info", "msg", "handed over queue", "queue", name, "owner", owner, "jobs", len(snapshot.Jobs))
+	return nil
+}
+
+//enter registers a request for a local queue, unless the queue is being handed over.
+func (s *Shards) enter(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.moving[name] {
+		return false
+	}
+	s.inflight[name]++
+	return true
+}
+
+func (s *Shards) leave(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.inflight[name]--
+	if s.inflight[name] == 0 {
+		delete(s.inflight, name)
+		s.idle.Broadcast()
+	}
+}
+
+//send sends the request to the nodes of the shard in turn, until one of them answers with anything but 503.
+func (s *Shards) send(shard string, method string, uri string, header http.Header, body []byte) (*http.Response, error) {
+	s.mutex.Lock()
+	urls := s.layout[shard]
+	s.mutex.Unlock()
+	if len(urls) == 0 {
+		return nil, errors.Wrapf(errShardNotFound, "shard %s", shard)
+	}
+
+	var lastErr error
+	for i, target := range urls {
+		req, err := http.NewRequest(method, strings.TrimSuffix(target, "/")+uri, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		req.Header.Set(shardHeader, s.self)
+		res, err := s.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if res.StatusCode == http.StatusServiceUnavailable && i < len(urls)-1 {
+			res.Body.Close()
+			continue
+		}
+		return res, nil
+	}
+	return nil, lastErr
+}
+
+//Handler serves the layout of the shards, and routes every other request to the shard owning its queue.
+func (s *Shards) Handler(next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/shards", s.shards)
+	mux.Handle("/", s.route(next))
+	return mux
+}
+
+func (s *Shards) route(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isImport(r) && !s.fromPeer(r) {
+			Respond(w, http.StatusForbidden, errNotPeerShard.Error())
+			return
+		}
+		name, ok := s.queueOf(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if name == "" {
+			if r.Header.Get(shardHeader) != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			s.getQueues(w, r, next)
+			return
+		}
+
+		//A stream would hold the queue for as long as it is connected, so it could never move.
+		if isWebSocketUpgrade(r) {
+			Respond(w, http.StatusNotImplemented, errWebSocketNotServed.Error())
+			return
+		}
+		owner := s.Owner(name)
+		if owner == s.self || r.Header.Get(shardHeader) != "" {
+			if !s.enter(name) {
+				w.Header().Set("Retry-After", "1")
+				Respond(w, http.StatusServiceUnavailable, "The queue is moving to another shard, try again later")
+				return
+			}
+			defer s.leave(name)
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.forward(w, r, owner)
+		return
+	})
+}
+
+//isImport reports whether the request imports a queue handed over by another shard.
+func isImport(r *http.Request) bool {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	return len(parts) == 3 && parts[0] == "queues" && parts[2] == "import"
+}
+
+//fromPeer reports whether the request was sent by another shard: it names a member shard other than this one in
+//shardHeader, and comes from the host of a member node. The nodes of this shard count, the followers of a cluster
+//forward to its leader.
+func (s *Shards) fromPeer(r *http.Request) bool {
+	sender, ok := s.fromMember(r)
+	return ok && sender != s.self
+}
+
+//fromMember returns the shard named in shardHeader, and whether the request was sent by a node of the shards: the
+//shard is a member, and the request comes from the host of a member node.
+func (s *Shards) fromMember(r *http.Request) (string, bool) {
+	sender := r.Header.Get(shardHeader)
+	s.mutex.Lock()
+	_, known := s.members[sender]
+	urls := make([]string, 0)
+	for _, nodes := range s.members {
+		urls = append(urls, nodes...)
+	}
+	s.mutex.Unlock()
+	if !known {
+		return sender, false
+	}
+	return sender, fromHost(r, urls)
+}
+
+//mayChangeLayout reports whether the request may replace the layout: it was sent by a node of the shards, or
+//carries their secret as a bearer token.
+func (s *Shards) mayChangeLayout(r *http.Request) bool {
+	if _, ok := s.fromMember(r); ok {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if s.secret == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.secret)) == 1
+}
+
+//fromHost reports whether the request comes from the host of one of the urls.
+func fromHost(r *http.Request, urls []string) bool {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	remoteIP := net.ParseIP(remote)
+	for _, target := range urls {
+		u, err := url.Parse(target)
+		if err != nil {
+			continue
+		}
+		addrs, err := net.LookupHost(u.Hostname())
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil && ip.Equal(remoteIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//queueOf returns the queue the request operates on, and false for the requests which are not about a single queue.
+//Listing the queues is about all of them, the name is empty. Creating a queue names it in the body, which is put
+//back for the handler.
+func (s *Shards) queueOf(r *http.Request) (string, bool) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch parts[0] {
+	case "jobs", "deadletters", "schedules":
+		return defaultQueueName, true
+	case "queues":
+		if len(parts) > 1 {
+			return parts[1], true
+		}
+		if r.Method == http.MethodGet {
+			return "", true
+		}
+		if r.Method != http.MethodPost {
+			return "", false
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return "", false
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var req queueRequest
+		json.Unmarshal(body, &req)
+		return req.Name, req.Name != ""
+	}
+	return "", false
+}
+
+//forward sends the request to the owning shard and copies back its response.
+func (s *Shards) forward(w http.ResponseWriter, r *http.Request, owner string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res, err := s.send(owner, r.Method, r.URL.RequestURI(), r.Header, body)
+	if err != nil {
+		w.Header().Set("Retry-After", "1")
+		Respond(w, http.StatusServiceUnavailable, fmt.Sprintf("Shard %s is not available: %s", owner, err.Error()))
+		return
+	}
+	defer res.Body.Close()
+	for key, values := range res.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+//getQueues lists the queues of every shard, each queue as seen by its owner.
+func (s *Shards) getQueues(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	s.mutex.Lock()
+	ids := s.layout.ids()
+	s.mutex.Unlock()
+
+	arr := make([]queueInfo, 0)
+	for _, id := range ids {
+		var queues []queueInfo
+		if id == s.self {
+			buffered := newBufferedResponse()
+			next.ServeHTTP(buffered, r)
+			if buffered.status != http.StatusOK {
+				buffered.flush(w)
+				return
+			}
+			json.Unmarshal(buffered.body.Bytes(), &queues)
+		} else {
+			res, err := s.send(id, http.MethodGet, "/queues", nil, nil)
+			if err != nil {
+				w.Header().Set("Retry-After", "1")
+				Respond(w, http.StatusServiceUnavailable, fmt.Sprintf("Shard %s is not available: %s", id, err.Error()))
+				return
+			}
+			err = json.NewDecoder(res.Body).Decode(&queues)
+			res.Body.Close()
+			if err != nil {
+				Respond(w, http.StatusBadGateway, fmt.Sprintf("Shard %s answered: %s", id, err.Error()))
+				return
+			}
+		}
+		for _, info := range queues {
+			if s.Owner(info.Name) == id {
+				arr = append(arr, info)
+			}
+		}
+	}
+	sort.Slice(arr, func(i, j int) bool { return arr[i].Name < arr[j].Name })
+	Respond(w, http.StatusOK, arr)
+	return
+}
+
+type shardsInfo struct {
+	Self   string      `json:"self"`
+	Shards shardLayout `json:"shards"`
+	Moving []string    `json:"moving"`
+}
+
+type shardsRequest struct {
+	Shards shardLayout `json:"shards"`
+}
+
+//shards shows the layout, or replaces it. A new layout sent by a client is passed on to every node of the old
+//and the new shards, with the secret of the client for the nodes which do not know this one yet.
+func (s *Shards) shards(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mutex.Lock()
+		info := shardsInfo{Self: s.self, Shards: s.layout, Moving: make([]string, 0)}
+		for name := range s.moving {
+			info.Moving = append(info.Moving, name)
+		}
+		s.mutex.Unlock()
+		sort.Strings(info.Moving)
+		Respond(w, http.StatusOK, info)
+		return
+	case http.MethodPut:
+		if !s.mayChangeLayout(r) {
+			Respond(w, http.StatusForbidden, errNotShardMember.Error())
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req shardsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := req.Shards[s.self]; !ok && r.Header.Get(shardHeader) == "" {
+		Respond(w, http.StatusBadRequest, "The layout must be sent to a node of a shard which stays")
+		return
+	}
+
+	s.mutex.Lock()
+	nodes := make(map[string]bool)
+	for _, layout := range []shardLayout{s.layout, req.Shards} {
+		for _, urls := range layout {
+			for _, target := range urls {
+				nodes[target] = true
+			}
+		}
+	}
+	s.mutex.Unlock()
+	if err := s.SetLayout(req.Shards); err != nil {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if r.Header.Get(shardHeader) == "" {
+		body, _ := json.Marshal(req)
+		for target := range nodes {
+			put, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(target, "/")+"/shards", bytes.NewReader(body))
+			if err != nil {
+				s.log.Log("level", "error", "msg", "failed to send layout", "node", target, "error", err.Error())
+				continue
+			}
+			put.Header.Set(shardHeader, s.self)
+			if auth := r.Header.Get("Authorization"); auth != "" {
+				put.Header.Set("Authorization", auth)
+			}
+			res, err := s.client.Do(put)
+			if err != nil {
+				s.log.Log("level", "error", "msg", "failed to send layout", "node", target, "error", err.Error())
+				continue
+			}
+			res.Body.Close()
+		}
+	}
+	Respond(w, http.StatusOK, shardsRequest{Shards: req.Shards})
+	return
+}
+
+//Close stops handing over queues.
+func (s *Shards) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.waitGroup.Wait()
+}
+
+//parseShards parses the -shards flag, a comma separated list of id=url, the urls of the nodes of a shard
+//separated by |.
+func parseShards(value string) (shardLayout, error) {
+	layout := make(shardLayout)
+	for _, part := range strings.Split(value, ",") {
+		pair := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, errors.Errorf("invalid shard %q, expected id=url|url", part)
+		}
+		layout[pair[0]] = append(layout[pair[0]], strings.Split(pair[1], "|")...)
+	}
+	return layout, nil
+}
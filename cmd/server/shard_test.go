@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHashRing_SpreadsAndMovesLittle(t *testing.T) {
+	ring := newHashRing([]string{"a", "b", "c"})
+	counts := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("queue-%d", i)
+		owners[key] = ring.owner(key)
+		counts[owners[key]]++
+	}
+	for _, shard := range []string{"a", "b", "c"} {
+		assert.True(t, counts[shard] > 700 && counts[shard] < 1300, "shard %s owns %d of 3000", shard, counts[shard])
+	}
+
+	//A new shard only takes queues, the others keep theirs.
+	ring = newHashRing([]string{"a", "b", "c", "d"})
+	moved := 0
+	for key, owner := range owners {
+		if now := ring.owner(key); now != owner {
+			assert.Equal(t, "d", now)
+			moved++
+		}
+	}
+	assert.True(t, moved > 450 && moved < 1050, "%d of 3000 queues moved", moved)
+}
+
+func TestParseShards(t *testing.T) {
+	layout, err := parseShards("s1=http://a:8080|http://b:8080,s2=http://c:8080")
+	assert.Nil(t, err)
+	assert.Equal(t, shardLayout{"s1": {"http://a:8080", "http://b:8080"}, "s2": {"http://c:8080"}}, layout)
+
+	_, err = parseShards("s1")
+	assert.NotNil(t, err)
+}
+
+//testShardsSecret lets the tests change the layout.
+const testShardsSecret = "secret"
+
+//testShard is a standalone server holding one shard.
+type testShard struct {
+	id       string
+	server   *httptest.Server
+	registry *Registry
+	shards   *Shards
+}
+
+func (s *testShard) close() {
+	s.server.Close()
+	s.shards.Close()
+	s.registry.Close()
+}
+
+//startTestShards starts a server for every id, each with a layout made of the shards in layout.
+func startTestShards(t *testing.T, ids []string, layout []string) (map[string]*testShard, map[string]string) {
+	handlers := make(map[string]http.Handler)
+	ready := make(chan struct{})
+	urls := make(map[string]string)
+	shards := make(map[string]*testShard)
+	for _, id := range ids {
+		id := id
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-ready
+			handlers[id].ServeHTTP(w, r)
+		}))
+		urls[id] = server.URL
+		shards[id] = &testShard{id: id, server: server, registry: NewRegistry(log.NewNopLogger(), testConfig())}
+	}
+
+	for _, id := range ids {
+		s := shards[id]
+		l := make(shardLayout)
+		for _, member := range append(layout, id) {
+			l[member] = []string{urls[member]}
+		}
+		var err error
+		s.shards, err = NewShards(id, l, testShardsSecret, s.registry, log.NewNopLogger(), 20*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := newHandler(s.registry.Default(), log.NewNopLogger())
+		h.queues = s.registry
+		h.shards = s.shards
+		handlers[id] = s.shards.Handler(newRouter(&h))
+	}
+	close(ready)
+	return shards, urls
+}
+
+//queueOwnedBy returns a queue name the ring of shards gives to owner.
+func queueOwnedBy(shards []string, owner string) string {
+	ring := newHashRing(shards)
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("queue-%d", i)
+		if ring.owner(name) == owner {
+			return name
+		}
+	}
+}
+
+//putLayout sends a new layout to the node at url as a client with the secret, and returns the status it answered.
+func putLayout(t *testing.T, url string, secret string, layout shardLayout) int {
+	body, _ := json.Marshal(shardsRequest{Shards: layout})
+	req, _ := http.NewRequest(http.MethodPut, url+"/shards", bytes.NewReader(body))
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestShards_ForwardsToOwner(t *testing.T) {
+	shards, urls := startTestShards(t, []string{"s1", "s2"}, []string{"s1", "s2"})
+	for _, s := range shards {
+		defer s.close()
+	}
+	name := queueOwnedBy([]string{"s1", "s2"}, "s2")
+
+	res := call(t, http.MethodPost, urls["s1"]+"/queues/"+name+"/jobs/enqueue", "", job{Type: "TIME_CRITICAL"})
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	var enqueued jobIdResponse
+	json.NewDecoder(res.Body).Decode(&enqueued)
+	res.Body.Close()
+
+	_, err := shards["s1"].registry.Lookup(name)
+	assert.Equal(t, errQueueNotFound, err)
+	q, err := shards["s2"].registry.Lookup(name)
+	assert.Nil(t, err)
+	_, err = q.GetJob(enqueued.JobId)
+	assert.Nil(t, err)
+
+	//Lookups by job id reach the owner from any shard.
+	for _, id := range []string{"s1", "s2"} {
+		res = call(t, http.MethodGet, fmt.Sprintf("%s/queues/%s/jobs/%d", urls[id], name, enqueued.JobId), "", nil)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		res.Body.Close()
+	}
+
+	//Creating a queue goes by the name in the body.
+	created := queueOwnedBy([]string{"s1", "s2"}, "s1")
+	res = call(t, http.MethodPost, urls["s2"]+"/queues", "", queueRequest{Name: created})
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res.Body.Close()
+	_, err = shards["s1"].registry.Lookup(created)
+	assert.Nil(t, err)
+
+	res = call(t, http.MethodGet, urls["s1"]+"/queues", "", nil)
+	var queues []queueInfo
+	json.NewDecoder(res.Body).Decode(&queues)
+	res.Body.Close()
+	names := make([]string, 0)
+	for _, info := range queues {
+		names = append(names, info.Name)
+	}
+	assert.ElementsMatch(t, []string{defaultQueueName, name, created}, names)
+}
+
+func TestShards_RebalanceOnJoinAndLeave(t *testing.T) {
+	shards, urls := startTestShards(t, []string{"s1", "s2"}, []string{"s1"})
+	for _, s := range shards {
+		defer s.close()
+	}
+	//s1 owns every queue until s2 joins.
+	moving := queueOwnedBy([]string{"s1", "s2"}, "s2")
+	staying := queueOwnedBy([]string{"s1", "s2"}, "s1")
+	ids := make(map[string]int)
+	for _, name := range []string{moving, staying} {
+		res := call(t, http.MethodPost, urls["s1"]+"/queues/"+name+"/jobs/enqueue", "", job{Type: "TIME_CRITICAL"})
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		var enqueued jobIdResponse
+		json.NewDecoder(res.Body).Decode(&enqueued)
+		res.Body.Close()
+		ids[name] = enqueued.JobId
+	}
+	res := call(t, http.MethodGet, urls["s1"]+"/queues/"+moving+"/jobs/dequeue", "cId1", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, putLayout(t, urls["s1"], testShardsSecret, shardLayout{"s1": {urls["s1"]}, "s2": {urls["s2"]}}))
+	waitFor(t, "the queue to move to s2", func() bool {
+		_, err := shards["s1"].registry.Lookup(moving)
+		return err == errQueueNotFound
+	})
+
+	q, err := shards["s2"].registry.Lookup(moving)
+	assert.Nil(t, err)
+	item, err := q.GetJob(ids[moving])
+	assert.Nil(t, err)
+	assert.Equal(t, "IN_PROGRESS", item.Status)
+	assert.Equal(t, "cId1", item.ConsumerId)
+	_, err = shards["s1"].registry.Lookup(staying)
+	assert.Nil(t, err)
+
+	//The lease is concluded on the new owner, through the old one.
+	res = call(t, http.MethodPost, fmt.Sprintf("%s/queues/%s/jobs/%d/conclude", urls["s1"], moving, ids[moving]), "cId1", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+
+	//s2 leaves and hands its queues back.
+	assert.Equal(t, http.StatusOK, putLayout(t, urls["s1"], testShardsSecret, shardLayout{"s1": {urls["s1"]}}))
+	waitFor(t, "the queue to move back to s1", func() bool {
+		_, err := shards["s2"].registry.Lookup(moving)
+		return err == errQueueNotFound
+	})
+	q, err = shards["s1"].registry.Lookup(moving)
+	assert.Nil(t, err)
+	item, err = q.GetJob(ids[moving])
+	assert.Nil(t, err)
+	assert.Equal(t, "CONCLUDED", item.Status)
+}
+
+func TestRegistry_ReleaseAndImport(t *testing.T) {
+	registry := NewRegistry(log.NewNopLogger(), testConfig())
+	defer registry.Close()
+	q, _ := registry.Get("reports")
+	id, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	registry.Default().Enqueue(&job{Type: "TIME_CRITICAL"})
+
+	s, err := registry.Release("reports")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(s.Jobs))
+	_, err = registry.Lookup("reports")
+	assert.Equal(t, errQueueNotFound, err)
+
+	//The default queue is emptied rather than dropped.
+	d, err := registry.Release(defaultQueueName)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(d.Jobs))
+	assert.Equal(t, 0, registry.Default().Len())
+
+	q, err = registry.Import(s)
+	assert.Nil(t, err)
+	item, err := q.GetJob(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "QUEUED", item.Status)
+	dequeued, err := q.Dequeue("cId1")
+	assert.Nil(t, err)
+	assert.Equal(t, id, dequeued.Id)
+
+	//A queue handed over again keeps the jobs it holds.
+	q, err = registry.Import(s)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, q.Len())
+	item, _ = q.GetJob(id)
+	assert.Equal(t, "IN_PROGRESS", item.Status)
+}
+
+func TestShards_HandOverKeepsQueueUntilTaken(t *testing.T) {
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer refusing.Close()
+	registry := NewRegistry(log.NewNopLogger(), testConfig())
+	defer registry.Close()
+	name := queueOwnedBy([]string{"s1", "s2"}, "s2")
+	q, _ := registry.Get(name)
+	id, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+
+	shards, err := NewShards("s1", shardLayout{"s1": {"http://127.0.0.1:1"}, "s2": {refusing.URL}}, "", registry, log.NewNopLogger(), 0)
+	assert.Nil(t, err)
+	defer shards.Close()
+	assert.NotNil(t, shards.handOver(name, "s2"))
+	q, err = registry.Lookup(name)
+	assert.Nil(t, err)
+	_, err = q.GetJob(id)
+	assert.Nil(t, err)
+}
+
+func TestShards_ImportOnlyFromPeers(t *testing.T) {
+	shards, urls := startTestShards(t, []string{"s1", "s2"}, []string{"s1", "s2"})
+	for _, s := range shards {
+		defer s.close()
+	}
+	name := queueOwnedBy([]string{"s1", "s2"}, "s1")
+	other := NewRegistry(log.NewNopLogger(), testConfig())
+	defer other.Close()
+	q, _ := other.Get(name)
+	id, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	snapshot, _ := other.Copy(name)
+	body, _ := json.Marshal(snapshot)
+
+	importFrom := func(sender string) int {
+		req, _ := http.NewRequest(http.MethodPost, urls["s1"]+"/queues/"+name+"/import", bytes.NewReader(body))
+		if sender != "" {
+			req.Header.Set(shardHeader, sender)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusForbidden, importFrom(""))
+	assert.Equal(t, http.StatusForbidden, importFrom("s1"))
+	assert.Equal(t, http.StatusForbidden, importFrom("s9"))
+	_, err := shards["s1"].registry.Lookup(name)
+	assert.Equal(t, errQueueNotFound, err)
+
+	assert.Equal(t, http.StatusOK, importFrom("s2"))
+	assert.Equal(t, http.StatusOK, importFrom("s2"))
+	q, err = shards["s1"].registry.Lookup(name)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, q.Len())
+	_, err = q.GetJob(id)
+	assert.Nil(t, err)
+}
+
+func TestShards_LayoutOnlyFromMembersOrWithSecret(t *testing.T) {
+	shards, urls := startTestShards(t, []string{"s1", "s2"}, []string{"s1", "s2"})
+	for _, s := range shards {
+		defer s.close()
+	}
+	name := queueOwnedBy([]string{"s1", "s2"}, "s1")
+	q, _ := shards["s1"].registry.Get(name)
+	q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	elsewhere := shardLayout{"s1": {urls["s1"]}, "s9": {"http://127.0.0.1:1"}}
+
+	assert.Equal(t, http.StatusForbidden, putLayout(t, urls["s1"], "", elsewhere))
+	assert.Equal(t, http.StatusForbidden, putLayout(t, urls["s1"], "guess", elsewhere))
+	res := call(t, http.MethodGet, urls["s1"]+"/shards", "", nil)
+	var info shardsInfo
+	json.NewDecoder(res.Body).Decode(&info)
+	res.Body.Close()
+	assert.Equal(t, shardLayout{"s1": {urls["s1"]}, "s2": {urls["s2"]}}, info.Shards)
+
+	//A node of the shards passes the layout on without the secret.
+	body, _ := json.Marshal(shardsRequest{Shards: shardLayout{"s1": {urls["s1"]}}})
+	req, _ := http.NewRequest(http.MethodPut, urls["s1"]+"/shards", bytes.NewReader(body))
+	req.Header.Set(shardHeader, "s2")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	_, err = shards["s1"].registry.Lookup(name)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+//snapshot is the state of every queue and schedule after the write-ahead log record LastSeq. Recovery restores the snapshot
+//and replays only the records written after it, so the log can be cut off once the snapshot is on disk.
+type snapshot struct {
+	LastSeq   uint64          `json:"lastSeq"`
+	Time      time.Time       `json:"time"`
+	Queues    []queueSnapshot `json:"queues"`
+	Schedules []schedule      `json:"schedules,omitempty"`
+}
+
+//queueSnapshot holds the jobs of a queue in list order. The index map, ready heap, delay heap and consumer
+//assignments are rebuilt from the jobs. The idempotency keys are kept apart, they outlive their jobs.
+type queueSnapshot struct {
+	Name            string           `json:"name"`
+	Config          queueSettings    `json:"config"`
+	Jobs            []jobSnapshot    `json:"jobs"`
+	DeadLetters     []job            `json:"deadLetters"`
+	IdempotencyKeys []idempotencyKey `json:"idempotencyKeys,omitempty"`
+}
+
+type jobSnapshot struct {
+	Job      job        `json:"job"`
+	ReadyAt  *time.Time `json:"readyAt,omitempty"`
+	LeasedAt *time.Time `json:"leasedAt,omitempty"`
+}
+
+//snapshotOf returns the state of the element. Caller must hold q.mutex.
+func snapshotOf(e *Element) jobSnapshot {
+	s := jobSnapshot{Job: e.Value}
+	if e.readyIndex >= 0 {
+		readyAt := e.readyAt
+		s.ReadyAt = &readyAt
+	}
+	if e.Value.Status == "IN_PROGRESS" {
+		leasedAt := e.Value.leasedAt
+		s.LeasedAt = &leasedAt
+	}
+	return s
+}
+
+//capture returns the state of the queue. Caller must hold q.mutex.
+func (q *JobListQueue) capture(name string) queueSnapshot {
+	s := queueSnapshot{Name: name, Config: settingsOf(q.config), Jobs: make([]jobSnapshot, 0, q.store.Len())}
+	q.store.Each(func(e *Element) bool {
+		s.Jobs = append(s.Jobs, snapshotOf(e))
+		return true
+	})
+	s.DeadLetters = q.deadLetters.List()
+	s.IdempotencyKeys = q.idempotencyKeys.list(q.now())
+	return s
+}
+
+//restore loads the jobs of the snapshot into the empty queue. Like replay it leaves the indexes to rebuildIndexes.
+//A store which keeps state saves the settings, dead letters and idempotency keys of an imported queue.
+//Jobs and dead letters already in the queue are kept as they are, so a queue handed over twice is imported once.
+func (q *JobListQueue) restore(s queueSnapshot) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.config = s.Config.apply(q.config)
+	q.ready.agingInterval = q.config.AgingInterval
+	settings := settingsOf(q.config)
+	if err := q.saveState(walRecord{Op: "configure", Config: &settings}); err != nil {
+		return err
+	}
+	for _, js := range s.Jobs {
+		if q.holds(js.Job.Id) {
+			continue
+		}
+		e := &Element{Value: js.Job}
+		if js.LeasedAt != nil {
+			e.Value.leasedAt = *js.LeasedAt
+		}
+		if js.ReadyAt != nil {
+			e.readyAt = *js.ReadyAt
+		}
+		if err := q.pushBack(e); err != nil {
+			return err
+		}
+	}
+	for _, item := range s.DeadLetters {
+		if q.holds(item.Id) {
+			continue
+		}
+		q.ids().Observe(item.Id)
+		q.deadLetters.Add(item)
+		if err := q.saveState(walRecord{Op: "deadletter", JobId: item.Id, Job: &item}); err != nil {
+			return err
+		}
+	}
+	for _, entry := range s.IdempotencyKeys {
+		q.idempotencyKeys.put(entry, q.now())
+		if err := q.saveKey(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//holds reports whether the job is in the queue or its dead letters. Caller must hold q.mutex.
+func (q *JobListQueue) holds(jobID int) bool {
+	if _, ok := q.store.Get(jobID); ok {
+		return true
+	}
+	_, err := q.deadLetters.Get(jobID)
+	return err == nil
+}
+
+//capture returns the state of every queue and schedule. The scheduler and all the queues are locked while they are
+//copied, so no record can be written in between, mark notes the position of the log the snapshot covers meanwhile.
+func (r *Registry) capture(mark func(s *snapshot)) *snapshot {
+	r.schedules.mutex.Lock()
+	defer r.schedules.mutex.Unlock()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	names := make([]string, 0, len(r.queues))
+	for name, q := range r.queues {
+		names = append(names, name)
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+	}
+	sort.Strings(names)
+
+	s := &snapshot{Time: time.Now(), Queues: make([]queueSnapshot, 0, len(names))}
+	mark(s)
+	for _, name := range names {
+		s.Queues = append(s.Queues, r.queues[name].capture(name))
+	}
+	s.Schedules = r.schedules.capture()
+	return s
+}
+
+//restore loads the queues and schedules of the snapshot into the registry. Like replay it leaves the indexes to
+//rebuildIndexes.
+func (r *Registry) restore(s *snapshot) error {
+	r.mutex.Lock()
+	for _, qs := range s.Queues {
+		q, ok := r.queues[qs.Name]
+		if !ok {
+			var err error
+			q, err = r.newQueue(qs.Name, r.defaultConfig)
+			if err != nil {
+				r.mutex.Unlock()
+				return err
+			}
+			r.queues[qs.Name] = q
+		}
+		if err := q.restore(qs); err != nil {
+			r.mutex.Unlock()
+			return err
+		}
+	}
+	r.mutex.Unlock()
+	return r.schedules.restore(s.Schedules)
+}
+
+//Snapshot writes the state of every queue to the snapshot file and cuts the records it covers off the log.
+func (r *Registry) Snapshot() error {
+	if r.wal == nil {
+		return errors.New("snapshots need a write-ahead log")
+	}
+
+	r.snapshotMutex.Lock()
+	defer r.snapshotMutex.Unlock()
+
+	var offset int64
+	s := r.capture(func(s *snapshot) {
+		s.LastSeq, offset = r.wal.position()
+	})
+	if s.LastSeq == r.snapshotSeq {
+		//Nothing changed since the last snapshot.
+		return nil
+	}
+	err := writeSnapshot(r.wal.SnapshotPath(), s)
+	if err != nil {
+		return err
+	}
+	r.snapshotSeq = s.LastSeq
+	return r.wal.Compact(offset)
+}
+
+//writeSnapshot writes the snapshot to a temporary file and renames it over path, so a crash leaves either the
+//old or the new snapshot behind.
+func writeSnapshot(path string, s *snapshot) error {
+	line, err := encodeLine(s)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode snapshot")
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to write snapshot")
+	}
+	_, err = file.Write(line)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "failed to write snapshot")
+	}
+	syncDir(path)
+	return nil
+}
+
+//readSnapshot reads the snapshot at path. It returns nil if there is none yet.
+func readSnapshot(path string) (*snapshot, error) {
+	line, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read snapshot")
+	}
+	var s snapshot
+	err = decodeLine(line, &s)
+	if err != nil {
+		return nil, errors.Wrap(err, "corrupt snapshot")
+	}
+	return &s, nil
+}
+
+//Snapshotter takes a snapshot of the registry every interval, and whenever the write-ahead log grew past walBytes.
+type Snapshotter struct {
+	registry  *Registry
+	log       log.Logger
+	done      chan struct{}
+	closeOnce sync.Once
+	waitGroup sync.WaitGroup
+}
+
+//NewSnapshotter starts taking snapshots of the registry. Zero disables the interval or the size threshold.
+func NewSnapshotter(registry *Registry, logger log.Logger, interval time.Duration, walBytes int64) *Snapshotter {
+	s := &Snapshotter{registry: registry, log: logger, done: make(chan struct{})}
+
+	var full <-chan struct{}
+	if walBytes > 0 {
+		full = registry.wal.NotifyAt(walBytes)
+	}
+	s.waitGroup.Add(1)
+	go s.run(interval, full)
+	return s
+}
+
+func (s *Snapshotter) run(interval time.Duration, full <-chan struct{}) {
+	defer s.waitGroup.Done()
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-full:
+		case <-s.done:
+			return
+		}
+		start := time.Now()
+		err := s.registry.Snapshot()
+		if err != nil {
+			s.log.Log("level", "error", "msg", "failed to take snapshot", "error", err.Error())
+			continue
+		}
+		s.log.Log("level", "debug", "msg", "snapshot taken", "took", time.Since(start))
+	}
+}
+
+//Close stops taking snapshots and waits for a running one to finish.
+func (s *Snapshotter) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.waitGroup.Wait()
+}
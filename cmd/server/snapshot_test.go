@@ -0,0 +1,152 @@
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshot_RecoverFromSnapshotAndTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.wal")
+
+	wal, registry := openTestWAL(t, path)
+	q := registry.Default()
+	ids := make([]int, 0)
+	for i := 0; i < 4; i++ {
+		item := job{Type: "TIME_CRITICAL"}
+		id, _ := q.Enqueue(&item)
+		ids = append(ids, id)
+	}
+	q.Dequeue("cId1")
+	dead := job{Type: "TIME_CRITICAL", MaxAttempts: 1}
+	deadId, _ := q.Enqueue(&dead)
+	registry.Get("reports")
+
+	assert.Nil(t, registry.Snapshot())
+	info, _ := os.Stat(path)
+	assert.Equal(t, int64(0), info.Size())
+	first, _ := readSnapshot(wal.SnapshotPath())
+
+	//The tail of the log after the snapshot
+	q.Dequeue("cId2")
+	q.Conclude(ids[1], "cId2")
+	assert.Nil(t, q.Cancel(ids[2]))
+	q.Dequeue("cId3")
+	q.Dequeue("cId4")
+	q.Fail(deadId, "cId4", "fatal")
+	wantJobs, _ := q.GetJobs()
+	registry.Close()
+	wal.Close()
+
+	wal, registry = openTestWAL(t, path)
+	defer wal.Close()
+	defer registry.Close()
+	q = registry.Default()
+
+	gotJobs, _ := q.GetJobs()
+	assert.Equal(t, len(*wantJobs), len(*gotJobs))
+	for i := range *wantJobs {
+		assert.Equal(t, (*wantJobs)[i].Id, (*gotJobs)[i].Id)
+		assert.Equal(t, (*wantJobs)[i].Status, (*gotJobs)[i].Status)
+		assert.Equal(t, (*wantJobs)[i].ConsumerId, (*gotJobs)[i].ConsumerId)
+	}
+	assert.Equal(t, 1, len(q.ListDeadLetters()))
+	assert.Equal(t, []string{"default", "reports"}, registry.Names())
+	assert.Nil(t, q.Conclude(ids[0], "cId1"))
+	assert.Nil(t, q.Conclude(ids[3], "cId3"))
+
+	//Numbering continues after the records of the previous run
+	item := job{Type: "TIME_CRITICAL"}
+	q.Enqueue(&item)
+	assert.Nil(t, registry.Snapshot())
+	s, err := readSnapshot(wal.SnapshotPath())
+	assert.Nil(t, err)
+	assert.True(t, s.LastSeq > first.LastSeq+7)
+}
+
+func TestSnapshot_CrashBeforeCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.wal")
+
+	wal, registry := openTestWAL(t, path)
+	q := registry.Default()
+	for i := 0; i < 3; i++ {
+		item := job{Type: "TIME_CRITICAL"}
+		q.Enqueue(&item)
+	}
+	//Write the snapshot but leave the log as it is
+	s := registry.capture(func(s *snapshot) {
+		s.LastSeq, _ = wal.position()
+	})
+	assert.Nil(t, writeSnapshot(wal.SnapshotPath(), s))
+	item := job{Type: "NOT_TIME_CRITICAL"}
+	q.Enqueue(&item)
+	registry.Close()
+	wal.Close()
+
+	//The records covered by the snapshot are not applied twice
+	wal, registry = openTestWAL(t, path)
+	defer wal.Close()
+	defer registry.Close()
+	assert.Equal(t, 4, registry.Default().Len())
+}
+
+func TestSnapshot_CorruptSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.wal")
+
+	ioutil.WriteFile(path+".snapshot", []byte("00000000 {}\n"), 0644)
+	wal, err := OpenWAL(path, fsyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	_, err = NewRegistryWithWAL(log.NewNopLogger(), DefaultQueueConfig(), wal)
+	assert.NotNil(t, err)
+}
+
+func TestSnapshotter_WALSizeThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.wal")
+
+	wal, registry := openTestWAL(t, path)
+	defer wal.Close()
+	defer registry.Close()
+	snapshotter := NewSnapshotter(registry, log.NewNopLogger(), 0, 1024)
+	defer snapshotter.Close()
+
+	for i := 0; i < 10; i++ {
+		item := job{Type: "TIME_CRITICAL"}
+		registry.Default().Enqueue(&item)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if s, _ := readSnapshot(wal.SnapshotPath()); s != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("no snapshot taken after the write-ahead log grew past the threshold")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//Store keeps the jobs of a queue in the order they were enqueued and looks them up by id.
+//JobListQueue holds its mutex around every call, so implementations need no locking of their own.
+type Store interface {
+	//Append adds a new job at the end of the queue. A job whose id is already in the store is refused with errJobIdTaken.
+	Append(e *Element) error
+	//Save persists the changes made to a job. Jobs which are no longer in the store are ignored.
+	Save(e *Element) error
+	//Remove drops the job from the store.
+	Remove(e *Element) error
+	//Get returns the job with the id.
+	Get(jobID int) (*Element, bool)
+	//First returns the job enqueued first, nil if the store is empty.
+	First() *Element
+	//Each calls fn for every job in enqueue order until fn returns false.
+	Each(fn func(e *Element) bool)
+	Len() int
+	Close() error
+}
+
+//StateStore is implemented by stores which keep the settings, the dead letters, the idempotency keys of removed jobs
+//and, for the default queue, the schedules of their queue next to the jobs, so all of it outlives the process without
+//a write-ahead log.
+//Like Store it is called under the mutex of the queue.
+type StateStore interface {
+	//SaveConfig persists the settings of the queue.
+	SaveConfig(settings queueSettings) error
+	//SaveDeadLetter persists a job moved to the dead-letter queue.
+	SaveDeadLetter(item job) error
+	//RemoveDeadLetter drops a redriven or purged dead letter, 0 drops all of them.
+	RemoveDeadLetter(jobID int) error
+	//SaveSchedule persists a new or changed schedule.
+	SaveSchedule(sc schedule) error
+	//RemoveSchedule drops a deleted schedule.
+	RemoveSchedule(id int) error
+	//SaveIdempotencyKey keeps the key of a job which left the queue until the key expires.
+	SaveIdempotencyKey(entry idempotencyKey) error
+	//State returns what an earlier run left in the store.
+	State() queueState
+}
+
+//queueState is what a StateStore keeps of its queue besides the jobs. Config is nil if the queue was never configured.
+type queueState struct {
+	Config          *queueSettings
+	DeadLetters     []job
+	Schedules       []schedule
+	IdempotencyKeys []idempotencyKey
+}
+
+//listStore keeps the jobs in memory, in a doubly linked list indexed by a map of jobId to the address of the element.
+type listStore struct {
+	head  *Element
+	tail  *Element
+	count int
+	m     map[int]*Element
+}
+
+func newListStore() *listStore {
+	return &listStore{m: make(map[int]*Element)}
+}
+
+func (s *listStore) Append(e *Element) error {
+	if _, ok := s.m[e.Value.Id]; ok {
+		return errJobIdTaken
+	}
+	e.Prev = nil
+	e.Next = nil
+	if s.head == nil {
+		s.head = e
+		s.tail = e
+	} else {
+		e.Prev = s.tail
+		s.tail.Next = e
+		s.tail = e
+	}
+	s.m[e.Value.Id] = e
+	s.count++
+	return nil
+}
+
+//Save has nothing to do, the elements are the jobs.
+func (s *listStore) Save(e *Element) error {
+	return nil
+}
+
+func (s *listStore) Remove(e *Element) error {
+	if s.m[e.Value.Id] != e {
+		return nil
+	}
+	if e.Prev != nil {
+		e.Prev.Next = e.Next
+	} else {
+		s.head = e.Next
+	}
+	if e.Next != nil {
+		e.Next.Prev = e.Prev
+	} else {
+		s.tail = e.Prev
+	}
+	e.Prev = nil
+	e.Next = nil
+	delete(s.m, e.Value.Id)
+	s.count--
+	return nil
+}
+
+func (s *listStore) Get(jobID int) (*Element, bool) {
+	e, ok := s.m[jobID]
+	return e, ok
+}
+
+func (s *listStore) First() *Element {
+	return s.head
+}
+
+func (s *listStore) Each(fn func(e *Element) bool) {
+	for e := s.head; e != nil; {
+		//Read the next element first, fn may remove the current one.
+		next := e.Next
+		if !fn(e) {
+			return
+		}
+		e = next
+	}
+}
+
+func (s *listStore) Len() int {
+	return s.count
+}
+
+func (s *listStore) Close() error {
+	return nil
+}
+
+//StoreFactory opens the stores of the queues in a registry.
+type StoreFactory interface {
+	//Open returns the store of the named queue, with the jobs it kept if it already existed.
+	Open(name string) (Store, error)
+	//Names lists the queues which have a store from an earlier run.
+	Names() ([]string, error)
+	//Drop deletes the store of a deleted queue. The store is closed already.
+	Drop(name string) error
+}
+
+//memoryStores keeps every queue in a listStore. Nothing outlives the process.
+type memoryStores struct{}
+
+func (memoryStores) Open(name string) (Store, error) {
+	return newListStore(), nil
+}
+
+func (memoryStores) Names() ([]string, error) {
+	return nil, nil
+}
+
+func (memoryStores) Drop(name string) error {
+	return nil
+}
+
+//fileStoreExtension is the extension of the files of a fileStores directory.
+const fileStoreExtension = ".jobs"
+
+//fileStores keeps every queue in a fileStore named after the queue in dir.
+type fileStores struct {
+	dir string
+}
+
+func (f fileStores) path(name string) string {
+	return filepath.Join(f.dir, name+fileStoreExtension)
+}
+
+func (f fileStores) Open(name string) (Store, error) {
+	return OpenFileStore(f.path(name))
+}
+
+func (f fileStores) Names() ([]string, error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list stores")
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), fileStoreExtension) {
+			names = append(names, strings.TrimSuffix(file.Name(), fileStoreExtension))
+		}
+	}
+	return names, nil
+}
+
+func (f fileStores) Drop(name string) error {
+	err := os.Remove(f.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//NewStoreFactory returns the stores of the given kind, memory or file. File stores are kept in dir.
+func NewStoreFactory(kind string, dir string) (StoreFactory, error) {
+	switch kind {
+	case "memory":
+		return memoryStores{}, nil
+	case "file":
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, errors.Wrap(err, "failed to create store directory")
+		}
+		return fileStores{dir: dir}, nil
+	}
+	return nil, errors.Errorf("unknown store %q, expected memory or file", kind)
+}
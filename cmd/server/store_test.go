@@ -0,0 +1,328 @@
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//fakeStore keeps the jobs in a slice, records the calls made to it and fails the ones named in failOn.
+type fakeStore struct {
+	elements []*Element
+	calls    []string
+	failOn   map[string]bool
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{failOn: make(map[string]bool)}
+}
+
+func (s *fakeStore) call(name string) error {
+	s.calls = append(s.calls, name)
+	if s.failOn[name] {
+		return errors.Errorf("%s failed", name)
+	}
+	return nil
+}
+
+func (s *fakeStore) Append(e *Element) error {
+	if err := s.call("Append"); err != nil {
+		return err
+	}
+	s.elements = append(s.elements, e)
+	return nil
+}
+
+func (s *fakeStore) Save(e *Element) error {
+	return s.call("Save")
+}
+
+func (s *fakeStore) Remove(e *Element) error {
+	if err := s.call("Remove"); err != nil {
+		return err
+	}
+	for i, element := range s.elements {
+		if element == e {
+			s.elements = append(s.elements[:i], s.elements[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) Get(jobID int) (*Element, bool) {
+	for _, e := range s.elements {
+		if e.Value.Id == jobID {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+func (s *fakeStore) First() *Element {
+	if len(s.elements) == 0 {
+		return nil
+	}
+	return s.elements[0]
+}
+
+func (s *fakeStore) Each(fn func(e *Element) bool) {
+	for _, e := range append([]*Element(nil), s.elements...) {
+		if !fn(e) {
+			return
+		}
+	}
+}
+
+func (s *fakeStore) Len() int {
+	return len(s.elements)
+}
+
+func (s *fakeStore) Close() error {
+	return s.call("Close")
+}
+
+func testConfig() QueueConfig {
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	return config
+}
+
+func TestQueue_FakeStore(t *testing.T) {
+	store := newFakeStore()
+	q := NewQueueWithStore(log.NewNopLogger(), testConfig(), store)
+
+	item1 := job{Type: "NOT_TIME_CRITICAL"}
+	id1, _ := q.Enqueue(&item1)
+	item2 := job{Type: "TIME_CRITICAL"}
+	id2, _ := q.Enqueue(&item2)
+
+	item, err := q.Dequeue("cId1")
+	assert.Nil(t, err)
+	assert.Equal(t, id2, item.Id)
+	assert.Nil(t, q.Conclude(id2, "cId1"))
+	removed, _ := q.Remove()
+	assert.Equal(t, id1, removed)
+	assert.Equal(t, 1, q.Len())
+
+	q.Close()
+	assert.Equal(t, []string{"Append", "Save", "Append", "Save", "Save", "Save", "Remove", "Save", "Close"}, store.calls)
+}
+
+func TestQueue_StoreErrors(t *testing.T) {
+	store := newFakeStore()
+	q := NewQueueWithStore(log.NewNopLogger(), testConfig(), store)
+	defer q.Close()
+
+	store.failOn["Append"] = true
+	item := job{Type: "TIME_CRITICAL"}
+	_, err := q.Enqueue(&item)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, q.Len())
+
+	store.failOn["Append"] = false
+	id, _ := q.Enqueue(&item)
+	store.failOn["Remove"] = true
+	assert.NotNil(t, q.Cancel(id))
+	store.failOn["Save"] = true
+	_, err = q.Dequeue("cId1")
+	assert.NotNil(t, err)
+}
+
+func TestQueue_OpenStoreWithJobs(t *testing.T) {
+	store := newFakeStore()
+	queued := &Element{Value: job{Id: 1, Type: "TIME_CRITICAL", Status: "QUEUED", Priority: newPriority(10)}}
+	leased := &Element{Value: job{Id: 2, Type: "TIME_CRITICAL", Status: "IN_PROGRESS", ConsumerId: "cId1"}}
+	store.elements = []*Element{queued, leased}
+
+	q := NewQueueWithStore(log.NewNopLogger(), testConfig(), store)
+	defer q.Close()
+	item, err := q.Dequeue("cId2")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, item.Id)
+	assert.Nil(t, q.Conclude(2, "cId1"))
+}
+
+func TestFileStore_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stores, _ := NewStoreFactory("file", dir)
+
+	registry, err := NewRegistryWithStores(log.NewNopLogger(), testConfig(), stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := registry.Default()
+	ids := make([]int, 0)
+	for i := 0; i < 4; i++ {
+		item := job{Type: "TIME_CRITICAL", Payload: []byte(`{"n":1}`)}
+		id, _ := q.Enqueue(&item)
+		ids = append(ids, id)
+	}
+	q.Dequeue("cId1")
+	q.Dequeue("cId2")
+	q.Fail(ids[1], "cId2", "boom")
+	q.Cancel(ids[2])
+	reports, _ := registry.Get("reports")
+	report := job{Type: "REPORT"}
+	reportId, _ := reports.Enqueue(&report)
+	wantJobs, _ := q.GetJobs()
+	registry.Close()
+
+	registry, err = NewRegistryWithStores(log.NewNopLogger(), testConfig(), stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.Close()
+	q = registry.Default()
+	gotJobs, _ := q.GetJobs()
+	assert.Equal(t, len(*wantJobs), len(*gotJobs))
+	for i := range *wantJobs {
+		assert.Equal(t, (*wantJobs)[i].Id, (*gotJobs)[i].Id)
+		assert.Equal(t, (*wantJobs)[i].Status, (*gotJobs)[i].Status)
+		assert.Equal(t, (*wantJobs)[i].Attempts, (*gotJobs)[i].Attempts)
+		assert.Equal(t, string((*wantJobs)[i].Payload), string((*gotJobs)[i].Payload))
+	}
+	assert.Nil(t, q.Conclude(ids[0], "cId1"))
+	item, _ := q.Dequeue("cId3")
+	assert.Equal(t, ids[3], item.Id)
+
+	assert.Equal(t, []string{"default", "reports"}, registry.Names())
+	reports, _ = registry.Lookup("reports")
+	item, _ = reports.Dequeue("cId4")
+	assert.Equal(t, reportId, item.Id)
+
+	assert.Nil(t, registry.Delete("reports"))
+	_, err = os.Stat(filepath.Join(dir, "reports"+fileStoreExtension))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileStore_QueueState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stores := fileStores{dir: dir}
+
+	registry, err := NewRegistryWithStores(log.NewNopLogger(), testConfig(), stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	config.MaxAttempts = 7
+	registry.Create("reports", config)
+	q := registry.Default()
+	for i := 0; i < 3; i++ {
+		item := job{Type: "TIME_CRITICAL", MaxAttempts: 1}
+		id, _ := q.Enqueue(&item)
+		q.Dequeue("cId1")
+		q.Fail(id, "cId1", "boom")
+	}
+	dead := q.ListDeadLetters()
+	assert.Nil(t, q.PurgeDeadLetter(dead[0].Id))
+	q.Redrive(dead[1].Id)
+	sc, _ := registry.Schedules().Create(&schedule{Cron: "@hourly", Job: job{Type: "HOURLY"}})
+	//Compaction keeps the state of the queue
+	q.mutex.Lock()
+	assert.Nil(t, q.store.(*fileStore).compact())
+	q.mutex.Unlock()
+	registry.Close()
+
+	registry, err = NewRegistryWithStores(log.NewNopLogger(), testConfig(), stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = registry.Default()
+	reports, _ := registry.Lookup("reports")
+	assert.Equal(t, 7, reports.Config().MaxAttempts)
+	assert.Equal(t, testConfig().MaxAttempts, q.Config().MaxAttempts)
+	assert.Equal(t, 1, q.Len())
+	deadLetters := q.ListDeadLetters()
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, dead[2].Id, deadLetters[0].Id)
+	assert.Equal(t, "boom", deadLetters[0].LastError)
+	got, err := registry.Schedules().Get(sc.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "HOURLY", got.Job.Type)
+
+	//The changes after a restart are kept as well
+	assert.Equal(t, 1, q.PurgeDeadLetters())
+	assert.Nil(t, registry.Schedules().Delete(sc.Id))
+	registry.Close()
+	registry, err = NewRegistryWithStores(log.NewNopLogger(), testConfig(), stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.Close()
+	assert.Empty(t, registry.Default().ListDeadLetters())
+	assert.Empty(t, registry.Schedules().List())
+}
+
+func TestFileStore_Compaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "default"+fileStoreExtension)
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewQueueWithStore(log.NewNopLogger(), testConfig(), store)
+	item := job{Type: "TIME_CRITICAL"}
+	id, _ := q.Enqueue(&item)
+	q.Dequeue("cId1")
+	for i := 0; i <= compactMinGarbage; i++ {
+		progress := i
+		q.Heartbeat(id, "cId1", &progress)
+	}
+	assert.True(t, store.records < compactMinGarbage)
+	q.Close()
+
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	assert.Equal(t, 1, store.Len())
+	assert.Equal(t, "IN_PROGRESS", store.First().Value.Status)
+}
+
+func TestFileStore_TornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "default"+fileStoreExtension)
+
+	store, _ := OpenFileStore(path)
+	q := NewQueueWithStore(log.NewNopLogger(), testConfig(), store)
+	item := job{Type: "TIME_CRITICAL"}
+	q.Enqueue(&item)
+	q.Close()
+
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`1234abcd {"op":"pu`)
+	file.Close()
+
+	store, err = OpenFileStore(path)
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestNewStoreFactory_Unknown(t *testing.T) {
+	_, err := NewStoreFactory("tape", "")
+	assert.NotNil(t, err)
+}
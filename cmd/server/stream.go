@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errPrefetch        = errors.Errorf("prefetch must be between 1 and %d", maxBatchSize)
+	errUnknownStreamOp = errors.New("op must be prefetch, conclude, fail or heartbeat")
+)
+
+//streamMessage is a message of the /jobs/stream protocol, sent as JSON text in both directions.
+//The server sends the jobs as op job, and answers every message of the consumer with op ack, carrying the op it
+//answers and the status code the HTTP route of that op would have answered with.
+type streamMessage struct {
+	Op       string          `json:"op"`
+	JobId    int             `json:"jobId,omitempty"`
+	Prefetch int             `json:"prefetch,omitempty"`
+	Progress *int            `json:"progress,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Ack      string          `json:"ack,omitempty"`
+	Status   int             `json:"status,omitempty"`
+	Job      *job            `json:"job,omitempty"`
+}
+
+//stream pushes jobs to a consumer connected over a WebSocket. At most prefetch jobs are in flight: pushed and not
+//yet concluded or failed over the stream, and still leased to the consumer. Jobs left in flight when the connection
+//ends are handed out again once their lease runs out. On the leader of a cluster a message is only sent once the changes behind it are committed.
+type stream struct {
+	conn       *wsConn
+	queue      Queue
+	consumerId string
+	log        log.Logger
+	committed  func() error
+	mutex      sync.Mutex
+	prefetch   int
+	//inFlight holds the lease deadlines of the jobs in flight.
+	inFlight map[int]time.Time
+	//credit is signalled when the window may have room again.
+	credit chan struct{}
+}
+
+func (h *handler) stream(w http.ResponseWriter, r *http.Request) {
+	cId := r.Header.Get("CONSUMER_ID")
+
+	prefetch := 1
+	if value := r.URL.Query().Get("prefetch"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxBatchSize {
+			Respond(w, http.StatusBadRequest, errPrefetch.Error())
+			return
+		}
+		prefetch = n
+	}
+
+	conn, err := upgradeWebSocket(w, r)
+	if err == errNotWebSocket {
+		Respond(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err == errHijackUnsupported {
+		Respond(w, http.StatusNotImplemented, errWebSocketNotServed.Error())
+		return
+	}
+	if err != nil {
+		h.logger.Log("level", "error", "msg", "failed to open stream", "error", err.Error())
+		return
+	}
+
+	s := &stream{
+		conn:       conn,
+		queue:      h.queueFor(r),
+		consumerId: cId,
+		log:        h.logger,
+		committed:  h.committed,
+		prefetch:   prefetch,
+		inFlight:   make(map[int]time.Time),
+		credit:     make(chan struct{}, 1),
+	}
+	s.serve()
+	return
+}
+
+//serve pushes jobs until the consumer goes away.
+func (s *stream) serve() {
+	ctx, cancel := context.WithCancel(context.Background())
+	pushed := make(chan struct{})
+	go func() {
+		defer close(pushed)
+		s.push(ctx)
+	}()
+
+	err := s.read()
+	cancel()
+	<-pushed
+	switch err {
+	case nil:
+		s.conn.CloseWithStatus(wsCloseNormal, "")
+	case errWebSocketProtocol:
+		s.conn.CloseWithStatus(wsCloseProtocolError, err.Error())
+	case errWebSocketTooLarge:
+		s.conn.CloseWithStatus(wsCloseTooLarge, err.Error())
+	default:
+		s.conn.Close()
+	}
+}
+
+//push leases the jobs to the consumer as they become available, as many as the window has room for. A job whose
+//lease ran out leaves the window, the consumer may never answer for it.
+func (s *stream) push(ctx context.Context) {
+	for {
+		s.dropExpired()
+		room, expiry := s.room()
+		if room == 0 {
+			timer := time.NewTimer(time.Until(expiry))
+			select {
+			case <-s.credit:
+				timer.Stop()
+				continue
+			case <-timer.C:
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		jobs, err := s.queue.DequeueWait(ctx, s.consumerId, room, maxDequeueWait)
+		if err == errWaitElapsed {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				s.log.Log("level", "error", "msg", "stream stopped", "consumerId", s.consumerId, "error", err.Error())
+				s.conn.CloseWithStatus(wsCloseInternalError, err.Error())
+			}
+			return
+		}
+		for i := range jobs {
+			s.track(jobs[i])
+			if err := s.send(streamMessage{Op: "job", JobId: jobs[i].Id, Job: &jobs[i]}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+//room returns how many more jobs the window takes, and when the first lease of the jobs in flight runs out.
+func (s *stream) room() (int, time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var expiry time.Time
+	for _, deadline := range s.inFlight {
+		if expiry.IsZero() || deadline.Before(expiry) {
+			expiry = deadline
+		}
+	}
+	if len(s.inFlight) >= s.prefetch {
+		return 0, expiry
+	}
+	return s.prefetch - len(s.inFlight), expiry
+}
+
+//track puts the job leased to the consumer in the window.
+func (s *stream) track(item job) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if item.LeaseDeadline != nil {
+		s.inFlight[item.Id] = *item.LeaseDeadline
+	}
+}
+
+//extend moves the lease deadline of a job in the window after a heartbeat.
+func (s *stream) extend(item job) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.inFlight[item.Id]; ok && item.LeaseDeadline != nil {
+		s.inFlight[item.Id] = *item.LeaseDeadline
+	}
+}
+
+//dropExpired takes the jobs whose lease ran out out of the window, unless the consumer still holds it. The lease
+//may have been extended by a heartbeat sent over HTTP.
+func (s *stream) dropExpired() {
+	now := time.Now()
+	s.mutex.Lock()
+	expired := make([]int, 0)
+	for id, deadline := range s.inFlight {
+		if !deadline.After(now) {
+			expired = append(expired, id)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, id := range expired {
+		item, err := s.queue.GetJob(id)
+		s.mutex.Lock()
+		if _, ok := s.inFlight[id]; ok {
+			if err == nil && item.Status == "IN_PROGRESS" && item.ConsumerId == s.consumerId && item.LeaseDeadline != nil && item.LeaseDeadline.After(now) {
+				s.inFlight[id] = *item.LeaseDeadline
+			} else {
+				delete(s.inFlight, id)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+//read handles the messages of the consumer until it closes the connection.
+func (s *stream) read() error {
+	for {
+		opcode, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if opcode == wsClose {
+			return nil
+		}
+		var msg streamMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			if err := s.send(streamMessage{Op: "ack", Status: http.StatusBadRequest, Error: err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.send(s.handle(msg)); err != nil {
+			return err
+		}
+	}
+}
+
+//handle applies a message of the consumer and returns the ack answering it.
+func (s *stream) handle(msg streamMessage) streamMessage {
+	ack := streamMessage{Op: "ack", Ack: msg.Op, JobId: msg.JobId, Status: http.StatusOK}
+	var err error
+	switch msg.Op {
+	case "prefetch":
+		if msg.Prefetch < 1 || msg.Prefetch > maxBatchSize {
+			err = errPrefetch
+			break
+		}
+		s.mutex.Lock()
+		s.prefetch = msg.Prefetch
+		s.mutex.Unlock()
+		s.signalCredit()
+	case "conclude":
+		err = s.queue.ConcludeWithResult(msg.JobId, s.consumerId, msg.Result)
+		s.release(msg.JobId)
+	case "fail":
+		_, err = s.queue.Fail(msg.JobId, s.consumerId, msg.Error)
+		s.release(msg.JobId)
+	case "heartbeat":
+		if msg.Progress != nil && (*msg.Progress < 0 || *msg.Progress > 100) {
+			err = errInvalidProgress
+			break
+		}
+		var item *job
+		item, err = s.queue.Heartbeat(msg.JobId, s.consumerId, msg.Progress)
+		//The lease ran out and the job went to another consumer.
+		if err == errNotLeaseHolder {
+			s.release(msg.JobId)
+		}
+		if err == nil {
+			s.extend(*item)
+		}
+	default:
+		err = errUnknownStreamOp
+	}
+	if err != nil {
+		ack.Status = streamErrorStatus(err)
+		ack.Error = err.Error()
+	}
+	return ack
+}
+
+//release takes the job out of the window. A job is released once the consumer concluded or failed it over the
+//stream, whether that succeeded or not.
+func (s *stream) release(jobID int) {
+	s.mutex.Lock()
+	_, ok := s.inFlight[jobID]
+	delete(s.inFlight, jobID)
+	s.mutex.Unlock()
+	if ok {
+		s.signalCredit()
+	}
+}
+
+func (s *stream) signalCredit() {
+	select {
+	case s.credit <- struct{}{}:
+	default:
+	}
+}
+
+//send waits for the changes behind the message to be committed, and sends it. The stream is closed when they may
+//be lost.
+func (s *stream) send(msg streamMessage) error {
+	if s.committed != nil {
+		if err := s.committed(); err != nil {
+			s.conn.CloseWithStatus(wsCloseInternalError, err.Error())
+			return err
+		}
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(data)
+}
+
+//streamErrorStatus maps an error of a stream op to the status code the HTTP routes answer it with.
+func streamErrorStatus(err error) int {
+	switch err {
+	case errPrefetch, errUnknownStreamOp, errInvalidProgress:
+		return http.StatusBadRequest
+	case errNotLeaseHolder:
+		return http.StatusForbidden
+	case errResultTooLarge:
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//dialStream opens /jobs/stream on the server as the consumer.
+func dialStream(t *testing.T, serverURL string, query string, consumerId string) *wsConn {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, serverURL+"/jobs/stream"+query, nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("CONSUMER_ID", consumerId)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake answered %d", res.StatusCode)
+	}
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"))
+	return &wsConn{conn: conn, reader: reader, writer: bufio.NewWriter(conn), client: true}
+}
+
+func sendStream(t *testing.T, c *wsConn, msg streamMessage) {
+	data, _ := json.Marshal(msg)
+	if err := c.WriteMessage(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//receiveStream returns the next message of the server, and false if none came within the timeout.
+func receiveStream(t *testing.T, c *wsConn, timeout time.Duration) (streamMessage, bool) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	opcode, data, err := c.ReadMessage()
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return streamMessage{}, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, wsText, opcode)
+	var msg streamMessage
+	json.Unmarshal(data, &msg)
+	return msg, true
+}
+
+func TestHandler_Stream(t *testing.T) {
+	config := testConfig()
+	config.RetryBackoff = time.Minute
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+	h := newHandler(q, log.NewNopLogger())
+	server := httptest.NewServer(newRouter(&h))
+	defer server.Close()
+
+	first, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	second, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	third, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+
+	c := dialStream(t, server.URL, "?prefetch=2", "cId1")
+	defer c.Close()
+	for _, id := range []int{first, second} {
+		msg, ok := receiveStream(t, c, time.Second)
+		assert.True(t, ok)
+		assert.Equal(t, "job", msg.Op)
+		assert.Equal(t, id, msg.Job.Id)
+		assert.Equal(t, "cId1", msg.Job.ConsumerId)
+	}
+	//The window is full.
+	_, ok := receiveStream(t, c, 100*time.Millisecond)
+	assert.False(t, ok)
+
+	//Concluding a job makes room for the next one.
+	sendStream(t, c, streamMessage{Op: "conclude", JobId: first, Result: json.RawMessage(`{"ok":true}`)})
+	received := map[string]streamMessage{}
+	for i := 0; i < 2; i++ {
+		msg, ok := receiveStream(t, c, time.Second)
+		assert.True(t, ok)
+		received[msg.Op] = msg
+	}
+	assert.Equal(t, streamMessage{Op: "ack", Ack: "conclude", JobId: first, Status: http.StatusOK}, received["ack"])
+	assert.Equal(t, third, received["job"].Job.Id)
+	item, _ := q.GetJob(first)
+	assert.Equal(t, "CONCLUDED", item.Status)
+
+	progress := 120
+	sendStream(t, c, streamMessage{Op: "heartbeat", JobId: second, Progress: &progress})
+	msg, _ := receiveStream(t, c, time.Second)
+	assert.Equal(t, http.StatusBadRequest, msg.Status)
+	sendStream(t, c, streamMessage{Op: "fail", JobId: second, Error: "boom"})
+	msg, _ = receiveStream(t, c, time.Second)
+	assert.Equal(t, streamMessage{Op: "ack", Ack: "fail", JobId: second, Status: http.StatusOK}, msg)
+	item, _ = q.GetJob(second)
+	assert.Equal(t, "boom", item.LastError)
+	sendStream(t, c, streamMessage{Op: "skip", JobId: third})
+	msg, _ = receiveStream(t, c, time.Second)
+	assert.Equal(t, http.StatusBadRequest, msg.Status)
+
+	//A job enqueued while the consumer is connected is pushed right away.
+	fourth, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	msg, ok = receiveStream(t, c, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, fourth, msg.Job.Id)
+
+	c.CloseWithStatus(wsCloseNormal, "")
+}
+
+func TestHandler_StreamResumesAfterLeaseExpired(t *testing.T) {
+	config := testConfig()
+	config.LeaseTimeout = 100 * time.Millisecond
+	config.ReapInterval = 20 * time.Millisecond
+	config.RetryBackoff = time.Minute
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+	h := newHandler(q, log.NewNopLogger())
+	server := httptest.NewServer(newRouter(&h))
+	defer server.Close()
+
+	first, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	second, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	c := dialStream(t, server.URL, "?prefetch=1", "cId1")
+	defer c.Close()
+	msg, ok := receiveStream(t, c, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, first, msg.JobId)
+
+	//The consumer never answers for the first job, its lease runs out and it leaves the window. Requeued, it is
+	//pushed again.
+	msg, ok = receiveStream(t, c, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, first, msg.JobId)
+	sendStream(t, c, streamMessage{Op: "conclude", JobId: first})
+	received := map[string]streamMessage{}
+	for i := 0; i < 2; i++ {
+		msg, ok := receiveStream(t, c, time.Second)
+		assert.True(t, ok)
+		received[msg.Op] = msg
+	}
+	assert.Equal(t, http.StatusOK, received["ack"].Status)
+	assert.Equal(t, second, received["job"].JobId)
+
+	c.CloseWithStatus(wsCloseNormal, "")
+}
+
+func TestHandler_StreamRefused(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+	h := newHandler(q, log.NewNopLogger())
+
+	rr, _ := do(h, http.MethodGet, "/jobs/stream", http.Header{}, nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr, _ = do(h, http.MethodGet, "/jobs/stream?prefetch=0", http.Header{}, nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	//The recorder cannot be taken over.
+	header := http.Header{}
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "keep-alive, Upgrade")
+	header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	header.Set("Sec-WebSocket-Version", "13")
+	rr, _ = do(h, http.MethodGet, "/jobs/stream", header, nil)
+	assert.Equal(t, http.StatusNotImplemented, rr.Code)
+}
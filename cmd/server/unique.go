@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+//Policies for a job whose uniqueKey is taken by a job which is queued, scheduled, waiting for a retry or in progress.
+const (
+	//uniqueReject refuses the new job. It is the default.
+	uniqueReject = "reject"
+	//uniqueReplace cancels the waiting job and enqueues the new one. A job in progress cannot be replaced.
+	uniqueReplace = "replace"
+	//uniqueReturnExisting returns the id of the job holding the key instead of enqueueing the new one.
+	uniqueReturnExisting = "returnExisting"
+)
+
+var (
+	errUniqueKeyTaken      = errors.New("A job with the same uniqueKey is queued or in progress")
+	errInvalidUniquePolicy = errors.Errorf("uniquePolicy must be %s, %s or %s", uniqueReject, uniqueReplace, uniqueReturnExisting)
+)
+
+//enqueueOutcome tells how an enqueue was answered.
+type enqueueOutcome int
+
+const (
+	//outcomeEnqueued means a new job was enqueued.
+	outcomeEnqueued enqueueOutcome = iota
+	//outcomeReplayed means the idempotency key matched an earlier enqueue, whose job is returned.
+	outcomeReplayed
+	//outcomeExisting means the uniqueKey is held by another job, which is returned.
+	outcomeExisting
+)
+
+//holdsUniqueKey reports whether the job keeps other jobs with its uniqueKey out of the queue.
+func holdsUniqueKey(item job) bool {
+	switch item.Status {
+	case "QUEUED", "SCHEDULED", "RETRY_PENDING", "IN_PROGRESS":
+		return item.UniqueKey != ""
+	}
+	return false
+}
+
+//validUniquePolicy reports whether the policy is known. An empty policy rejects.
+func validUniquePolicy(policy string) bool {
+	switch policy {
+	case "", uniqueReject, uniqueReplace, uniqueReturnExisting:
+		return true
+	}
+	return false
+}
+
+//uniqueHolder returns the job holding the key. Jobs which are concluded, failed or dead-lettered give up their key.
+//Caller must hold q.mutex.
+func (q *JobListQueue) uniqueHolder(key string) (*Element, bool) {
+	id, ok := q.uniqueKeys[key]
+	if !ok {
+		return nil, false
+	}
+	e, ok := q.store.Get(id)
+	if !ok || !holdsUniqueKey(e.Value) {
+		return nil, false
+	}
+	return e, true
+}
+
+//claimUniqueKey applies the uniqueKey policy of the new job. It returns the id of the job to answer with instead,
+//or the job the new one replaces, or an error. The replaced job is only cancelled by enqueueReplacing, once the new
+//one is enqueued. Caller must hold q.mutex.
+func (q *JobListQueue) claimUniqueKey(item *job) (int, bool, *Element, error) {
+	if !validUniquePolicy(item.UniquePolicy) {
+		return 0, false, nil, errInvalidUniquePolicy
+	}
+	if item.UniqueKey == "" {
+		return 0, false, nil, nil
+	}
+	holder, ok := q.uniqueHolder(item.UniqueKey)
+	if !ok {
+		return 0, false, nil, nil
+	}
+
+	switch item.UniquePolicy {
+	case uniqueReturnExisting:
+		return holder.Value.Id, true, nil, nil
+	case uniqueReplace:
+		if holder.Value.Status == "IN_PROGRESS" {
+			return 0, false, nil, errUniqueKeyTaken
+		}
+		return 0, false, holder, nil
+	}
+	return 0, false, nil, errUniqueKeyTaken
+}
+
+//enqueueReplacing enqueues the job, and then cancels the job it replaces, if any. The replaced job keeps its
+//uniqueKey when the new one could not be enqueued. Caller must hold q.mutex.
+func (q *JobListQueue) enqueueReplacing(item *job, idempotencyKey string, replaced *Element) (int, error) {
+	id, err := q.enqueue(item, idempotencyKey)
+	if replaced == nil {
+		return id, err
+	}
+	if err != nil {
+		q.rememberUniqueKey(replaced)
+		return 0, err
+	}
+	if err := q.unlink(replaced); err != nil {
+		return id, err
+	}
+	return id, q.record("cancel", replaced)
+}
+
+//rememberUniqueKey indexes the uniqueKey of the job. Caller must hold q.mutex.
+func (q *JobListQueue) rememberUniqueKey(e *Element) {
+	if holdsUniqueKey(e.Value) {
+		q.uniqueKeys[e.Value.UniqueKey] = e.Value.Id
+	}
+}
+
+//forgetUniqueKey drops the uniqueKey of a job leaving the queue. Caller must hold q.mutex.
+func (q *JobListQueue) forgetUniqueKey(e *Element) {
+	if id, ok := q.uniqueKeys[e.Value.UniqueKey]; ok && id == e.Value.Id {
+		delete(q.uniqueKeys, e.Value.UniqueKey)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueue_UniqueKeyReject(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+
+	id, err := q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	assert.Nil(t, err)
+	_, err = q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	assert.Equal(t, errUniqueKeyTaken, err)
+	_, err = q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-43"})
+	assert.Nil(t, err)
+
+	//The key is held while the job is in progress, and given up once it is concluded.
+	dequeued, _ := q.Dequeue("cId1")
+	assert.Equal(t, id, dequeued.Id)
+	_, err = q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	assert.Equal(t, errUniqueKeyTaken, err)
+	assert.Nil(t, q.Conclude(id, "cId1"))
+	_, err = q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	assert.Nil(t, err)
+}
+
+func TestQueue_UniqueKeyReturnExisting(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+
+	id, _ := q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	existing, outcome, err := q.EnqueueWithKey(&job{Type: "REINDEX", UniqueKey: "customer-42", UniquePolicy: uniqueReturnExisting}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, outcomeExisting, outcome)
+	assert.Equal(t, id, existing)
+	assert.Equal(t, 1, q.Len())
+}
+
+func TestQueue_UniqueKeyReplace(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+
+	old, _ := q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42", Payload: json.RawMessage(`{"v":1}`)})
+	id, err := q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42", UniquePolicy: uniqueReplace, Payload: json.RawMessage(`{"v":2}`)})
+	assert.Nil(t, err)
+	assert.NotEqual(t, old, id)
+	_, err = q.GetJob(old)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, q.Len())
+
+	//A job in progress is not replaced.
+	q.Dequeue("cId1")
+	_, err = q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42", UniquePolicy: uniqueReplace})
+	assert.Equal(t, errUniqueKeyTaken, err)
+}
+
+func TestQueue_UniqueKeyReplaceKeepsHolderOnFailure(t *testing.T) {
+	config := testConfig()
+	config.IDs = fixedIDs{id: 42}
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), config)
+	defer q.Close()
+
+	old, _ := q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	_, err := q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42", UniquePolicy: uniqueReplace})
+	assert.Equal(t, errJobIdTaken, err)
+	item, err := q.GetJob(old)
+	assert.Nil(t, err)
+	assert.Equal(t, "QUEUED", item.Status)
+	_, err = q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	assert.Equal(t, errUniqueKeyTaken, err)
+
+	results, err := q.EnqueueBatch([]*job{{Type: "REINDEX", UniqueKey: "customer-42", UniquePolicy: uniqueReplace}})
+	assert.Equal(t, errJobIdTaken, err)
+	assert.Equal(t, 0, len(results))
+	_, err = q.GetJob(old)
+	assert.Nil(t, err)
+}
+
+func TestQueue_UniqueKeyRedrive(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+
+	dead, _ := q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42", MaxAttempts: 1})
+	q.Dequeue("cId1")
+	q.Fail(dead, "cId1", "fatal")
+	_, err := q.GetDeadLetter(dead)
+	assert.Nil(t, err)
+
+	id, err := q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	assert.Nil(t, err)
+	_, err = q.Redrive(dead)
+	assert.Equal(t, errUniqueKeyTaken, err)
+
+	q.Cancel(id)
+	_, err = q.Redrive(dead)
+	assert.Nil(t, err)
+	_, err = q.Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	assert.Equal(t, errUniqueKeyTaken, err)
+}
+
+func TestHandler_EnqueueUniqueKey(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+	h := newHandler(q, log.NewNopLogger())
+
+	rr, _ := do(h, http.MethodPost, "/jobs/enqueue", http.Header{}, job{Type: "REINDEX", UniqueKey: "customer-42"})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var first jobIdResponse
+	json.Unmarshal(rr.Body.Bytes(), &first)
+
+	rr, _ = do(h, http.MethodPost, "/jobs/enqueue", http.Header{}, job{Type: "REINDEX", UniqueKey: "customer-42"})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr, _ = do(h, http.MethodPost, "/jobs/enqueue", http.Header{}, job{Type: "REINDEX", UniqueKey: "customer-42", UniquePolicy: uniqueReturnExisting})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var existing jobIdResponse
+	json.Unmarshal(rr.Body.Bytes(), &existing)
+	assert.Equal(t, first.JobId, existing.JobId)
+
+	rr, _ = do(h, http.MethodPost, "/jobs/enqueue", http.Header{}, job{Type: "REINDEX", UniqueKey: "customer-42", UniquePolicy: "ignore"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestQueue_UniqueKeySurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unique")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.wal")
+
+	wal, registry := openTestWAL(t, path)
+	_, err = registry.Default().Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	assert.Nil(t, err)
+	registry.Close()
+	wal.Close()
+
+	wal, registry = openTestWAL(t, path)
+	defer wal.Close()
+	defer registry.Close()
+	_, err = registry.Default().Enqueue(&job{Type: "REINDEX", UniqueKey: "customer-42"})
+	assert.Equal(t, errUniqueKeyTaken, err)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+//maxDequeueWait bounds how long a dequeue is parked. It stays below the timeout of requests forwarded between shards.
+const maxDequeueWait = 20 * time.Second
+
+var (
+	errDequeueWait = errors.Errorf("wait must be a duration or a number of seconds, at most %s", maxDequeueWait)
+	errWaitElapsed = errors.New("No job became available while waiting")
+)
+
+//parseWait reads the wait parameter of dequeue, either a duration like 10s or a number of seconds.
+//An empty wait does not wait.
+func parseWait(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, errDequeueWait
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 || wait > maxDequeueWait {
+		return 0, errDequeueWait
+	}
+	return wait, nil
+}
+
+//DequeueWait is DequeueBatch waiting up to wait for a job to become available when there is none, instead of
+//failing right away. It returns errWaitElapsed if no job came in time, and the error of ctx once the request
+//is given up.
+func (q *JobListQueue) DequeueWait(ctx context.Context, consumerId string, max int, wait time.Duration) ([]job, error) {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	for {
+		q.mutex.Lock()
+		jobs, err := q.dequeueBatch(consumerId, max)
+		if err != errQueueEmpty && err != errNoJobAvailable {
+			q.mutex.Unlock()
+			return jobs, err
+		}
+		//The channel is taken under the lock, so a job made ready right after the attempt still wakes the waiter.
+		if q.readyWaiters == nil {
+			q.readyWaiters = make(chan struct{})
+		}
+		ready := q.readyWaiters
+		//Scheduled jobs and retries are promoted by Dequeue once due, without waiting for the reaper. The entries of
+		//jobs which left the queue are dropped first, their due time would wake the waiter over and over.
+		var due <-chan time.Time
+		var timer *time.Timer
+		if next, ok := q.nextDue(); ok {
+			timer = time.NewTimer(next.Sub(q.now()))
+			due = timer.C
+		}
+		q.mutex.Unlock()
+
+		var stop error
+		select {
+		case <-ready:
+		case <-due:
+		case <-deadline.C:
+			stop = errWaitElapsed
+		case <-ctx.Done():
+			stop = ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if stop != nil {
+			return nil, stop
+		}
+	}
+}
+
+//signalReady wakes the dequeues waiting for a job. Caller must hold q.mutex.
+func (q *JobListQueue) signalReady() {
+	if q.readyWaiters != nil {
+		close(q.readyWaiters)
+		q.readyWaiters = nil
+	}
+}
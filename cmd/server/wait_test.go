@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHandler_DequeueWait(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+	h := newHandler(q, log.NewNopLogger())
+	header := http.Header{}
+	header.Set("CONSUMER_ID", "cId1")
+
+	rr, _ := do(h, http.MethodGet, "/jobs/dequeue?wait=50ms", header, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, 0, rr.Body.Len())
+
+	enqueued := make(chan int)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		id, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+		enqueued <- id
+	}()
+	start := time.Now()
+	rr, _ = do(h, http.MethodGet, "/jobs/dequeue?wait=5", header, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	var item job
+	json.Unmarshal(rr.Body.Bytes(), &item)
+	assert.Equal(t, <-enqueued, item.Id)
+	assert.Equal(t, "cId1", item.ConsumerId)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.EnqueueBatch([]*job{{Type: "TIME_CRITICAL"}, {Type: "TIME_CRITICAL"}})
+	}()
+	rr, _ = do(h, http.MethodGet, "/jobs/dequeue?wait=5s&max=5", header, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var jobs []job
+	json.Unmarshal(rr.Body.Bytes(), &jobs)
+	assert.Equal(t, 2, len(jobs))
+
+	for _, wait := range []string{"soon", "-1s", "21s"} {
+		rr, _ = do(h, http.MethodGet, "/jobs/dequeue?wait="+wait, header, nil)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, wait)
+	}
+}
+
+func TestQueue_DequeueWaitForScheduledJob(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+
+	//The reaper is disabled, the waiting dequeue promotes the job itself once it is due.
+	runAt := time.Now().Add(100 * time.Millisecond)
+	id, _ := q.Enqueue(&job{Type: "TIME_CRITICAL", RunAt: &runAt})
+	jobs, err := q.DequeueWait(context.Background(), "cId1", 1, 5*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, id, jobs[0].Id)
+	assert.False(t, time.Now().Before(runAt))
+}
+
+func TestQueue_DequeueWaitStaleDelayedJob(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+
+	//The job is cancelled before it came due, its entry in the delay heap is due by the time the queue is waited on.
+	runAt := time.Now().Add(10 * time.Millisecond)
+	id, _ := q.Enqueue(&job{Type: "TIME_CRITICAL", RunAt: &runAt})
+	assert.Nil(t, q.Cancel(id))
+	time.Sleep(20 * time.Millisecond)
+
+	//The waiter sleeps until the wait elapsed instead of waking up for the stale entry over and over.
+	wakeUps := 0
+	q.now = func() time.Time {
+		wakeUps++
+		return time.Now()
+	}
+	_, err := q.DequeueWait(context.Background(), "cId1", 1, 50*time.Millisecond)
+	assert.Equal(t, errWaitElapsed, err)
+	assert.True(t, wakeUps < 10, wakeUps)
+	assert.Equal(t, 0, q.delayed.Len())
+}
+
+func TestQueue_DequeueWaitGivenUp(t *testing.T) {
+	q := NewLinkedListQueueWithConfig(log.NewNopLogger(), testConfig())
+	defer q.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err := q.DequeueWait(ctx, "cId1", 1, 5*time.Second)
+	assert.Equal(t, context.Canceled, err)
+
+	//The job enqueued once the waiter is gone is left for the next dequeue.
+	id, _ := q.Enqueue(&job{Type: "TIME_CRITICAL"})
+	item, err := q.Dequeue("cId2")
+	assert.Nil(t, err)
+	assert.Equal(t, id, item.Id)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Fsync policies of the write-ahead log.
+const (
+	//Every record is synced to disk before the operation returns.
+	fsyncAlways = "always"
+	//Records are synced in the background every FsyncInterval, a crash of the machine loses at most that much.
+	fsyncInterval = "interval"
+	//Records are handed to the OS and synced whenever it decides to.
+	fsyncNever = "never"
+)
+
+//walRecord is a single entry of the write-ahead log. Job and schedule operations carry the state after the operation,
+//so replaying them does not depend on the clock or on the generated ids. Seq numbers the records in the order
+//they were written, a snapshot covers every record up to its LastSeq.
+type walRecord struct {
+	Seq        uint64         `json:"seq"`
+	Op         string         `json:"op"`
+	Queue      string         `json:"queue"`
+	JobId      int            `json:"jobId,omitempty"`
+	Job        *job           `json:"job,omitempty"`
+	ReadyAt    *time.Time     `json:"readyAt,omitempty"`
+	LeasedAt   *time.Time     `json:"leasedAt,omitempty"`
+	Config     *queueSettings `json:"config,omitempty"`
+	Snapshot   *queueSnapshot `json:"snapshot,omitempty"`
+	ScheduleId int            `json:"scheduleId,omitempty"`
+	Schedule   *schedule      `json:"schedule,omitempty"`
+	Time       time.Time      `json:"time"`
+}
+
+//journal receives the records of a single queue, or of the scheduler.
+type journal interface {
+	Append(record walRecord) error
+}
+
+//WAL is an append-only log of every change to the queues. Each line is the CRC32 of the record followed by the
+//record as JSON, so a record torn by a crash is detected on replay.
+type WAL struct {
+	file          *os.File
+	path          string
+	policy        string
+	dirty         bool
+	seq           uint64
+	size          int64
+	limit         int64
+	full          chan struct{}
+	mutex         sync.Mutex
+	done          chan struct{}
+	closeOnce     sync.Once
+	syncWaitGroup sync.WaitGroup
+}
+
+//OpenWAL opens or creates the log at path. Call Replay before appending to it.
+func OpenWAL(path string, policy string, interval time.Duration) (*WAL, error) {
+	switch policy {
+	case fsyncAlways, fsyncNever:
+	case fsyncInterval:
+		if interval <= 0 {
+			return nil, errors.New("fsync interval must be positive")
+		}
+	default:
+		return nil, errors.Errorf("unknown fsync policy %q, expected always, interval or never", policy)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open write-ahead log")
+	}
+	w := &WAL{file: file, path: path, policy: policy, full: make(chan struct{}, 1), done: make(chan struct{})}
+	if policy == fsyncInterval {
+		w.syncWaitGroup.Add(1)
+		go w.syncEvery(interval)
+	}
+	return w, nil
+}
+
+//SnapshotPath is where the snapshots of the queues in this log are kept.
+func (w *WAL) SnapshotPath() string {
+	return w.path + ".snapshot"
+}
+
+//Replay calls apply for every record in the log after sequence number after, oldest first. Older records are
+//already part of the snapshot the queues were restored from. A torn record at the end of the log is cut off,
+//a corrupt record anywhere else is an error.
+func (w *WAL) Replay(after uint64, apply func(record walRecord) error) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.seq = after
+	w.size = 0
+
+	_, err := w.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "failed to read write-ahead log")
+	}
+
+	reader := bufio.NewReader(w.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				//The last record was not written completely.
+				return w.truncate(offset)
+			}
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read write-ahead log")
+		}
+
+		record, decodeErr := decodeRecord(line)
+		if decodeErr != nil {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				return w.truncate(offset)
+			}
+			return errors.Wrapf(decodeErr, "corrupt write-ahead log record at offset %d", offset)
+		}
+		if after == 0 || record.Seq > after {
+			if err := apply(record); err != nil {
+				return errors.Wrapf(err, "failed to replay %s of job %d", record.Op, record.JobId)
+			}
+		}
+		if record.Seq > w.seq {
+			w.seq = record.Seq
+		}
+		offset += int64(len(line))
+		w.size = offset
+	}
+
+	_, err = w.file.Seek(0, io.SeekEnd)
+	return err
+}
+
+//truncate cuts the log off at offset. Caller must hold w.mutex.
+func (w *WAL) truncate(offset int64) error {
+	err := w.file.Truncate(offset)
+	if err != nil {
+		return errors.Wrap(err, "failed to cut off torn write-ahead log record")
+	}
+	_, err = w.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+//encodeLine marshals v to JSON prefixed with its CRC32, as a single line.
+func encodeLine(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 0, len(data)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(data))...)
+	line = append(line, data...)
+	return append(line, '\n'), nil
+}
+
+//decodeLine checks the CRC32 of a line written by encodeLine and unmarshals it into v.
+func decodeLine(line []byte, v interface{}) error {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	if len(line) < 10 || line[8] != ' ' {
+		return errors.New("malformed record")
+	}
+	checksum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return errors.New("malformed checksum")
+	}
+	data := line[9:]
+	if crc32.ChecksumIEEE(data) != uint32(checksum) {
+		return errors.New("checksum mismatch")
+	}
+	return json.Unmarshal(data, v)
+}
+
+func encodeRecord(record walRecord) ([]byte, error) {
+	line, err := encodeLine(record)
+	return line, errors.Wrap(err, "failed to encode write-ahead log record")
+}
+
+func decodeRecord(line []byte) (walRecord, error) {
+	var record walRecord
+	err := decodeLine(line, &record)
+	return record, err
+}
+
+//Append numbers the record and writes it to the log, and syncs it to disk if the policy is always.
+func (w *WAL) Append(record walRecord) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	record.Seq = w.seq + 1
+	line, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "failed to write write-ahead log record")
+	}
+	w.seq = record.Seq
+	if w.limit > 0 && w.size >= w.limit {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+	if w.policy == fsyncAlways {
+		return errors.Wrap(w.file.Sync(), "failed to sync write-ahead log")
+	}
+	w.dirty = true
+	return nil
+}
+
+//NotifyAt returns a channel which receives a value whenever the log grew to at least size bytes.
+func (w *WAL) NotifyAt(size int64) <-chan struct{} {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.limit = size
+	return w.full
+}
+
+//position returns the sequence number of the last record and the size of the log.
+func (w *WAL) position() (uint64, int64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.seq, w.size
+}
+
+//Compact drops the first offset bytes of the log once a snapshot covers them. The rest of the log is copied
+//to a new file which atomically replaces the old one.
+func (w *WAL) Compact(offset int64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	compactPath := w.path + ".compact"
+	file, err := os.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to compact write-ahead log")
+	}
+	size, err := io.Copy(file, io.NewSectionReader(w.file, offset, w.size-offset))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(compactPath, w.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(compactPath)
+		return errors.Wrap(err, "failed to compact write-ahead log")
+	}
+	syncDir(w.path)
+
+	w.file.Close()
+	w.file = file
+	w.size = size
+	w.dirty = false
+	return nil
+}
+
+func (w *WAL) syncEvery(interval time.Duration) {
+	defer w.syncWaitGroup.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.mutex.Lock()
+			if w.dirty {
+				w.file.Sync()
+				w.dirty = false
+			}
+			w.mutex.Unlock()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+//Close syncs and closes the log.
+func (w *WAL) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.syncWaitGroup.Wait()
+
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		if syncErr := w.file.Sync(); syncErr != nil {
+			err = syncErr
+		}
+		if closeErr := w.file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+//syncDir syncs the directory of path, so a rename in it survives a crash.
+func syncDir(path string) {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
+
+//queueJournal tags the records of a queue with its name.
+type queueJournal struct {
+	journal journal
+	name    string
+}
+
+func (j queueJournal) Append(record walRecord) error {
+	record.Queue = j.name
+	return j.journal.Append(record)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestWAL(t *testing.T, path string) (*WAL, *Registry) {
+	wal, err := OpenWAL(path, fsyncAlways, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultQueueConfig()
+	config.ReapInterval = 0
+	registry, err := NewRegistryWithWAL(log.NewNopLogger(), config, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wal, registry
+}
+
+func TestWAL_Recovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.wal")
+
+	wal, registry := openTestWAL(t, path)
+	q := registry.Default()
+
+	ids := make([]int, 0)
+	for _, jobType := range []string{"TIME_CRITICAL", "NOT_TIME_CRITICAL", "NOT_TIME_CRITICAL", "NOT_TIME_CRITICAL", "TIME_CRITICAL"} {
+		item := job{Type: jobType}
+		id, _ := q.Enqueue(&item)
+		ids = append(ids, id)
+	}
+	q.Dequeue("cId1") //ids[0] concluded
+	assert.Nil(t, q.Conclude(ids[0], "cId1"))
+	q.Dequeue("cId2") //ids[4] failed, retry pending
+	q.Fail(ids[4], "cId2", "boom")
+	q.Dequeue("cId3") //ids[1] leased
+	assert.Nil(t, q.Cancel(ids[3]))
+
+	dead := job{Type: "TIME_CRITICAL", MaxAttempts: 1}
+	deadId, _ := q.Enqueue(&dead)
+	q.Dequeue("cId4")
+	q.Fail(deadId, "cId4", "fatal")
+
+	maxAttempts := 9
+	reports, _ := registry.Get("reports")
+	reports.Configure(queueSettings{MaxAttempts: &maxAttempts}.apply(reports.Config()))
+	report := job{Type: "REPORT", Priority: newPriority(3)}
+	reportId, _ := reports.Enqueue(&report)
+	registry.Get("scratch")
+	registry.Delete("scratch")
+
+	wantJobs, _ := q.GetJobs()
+	wantDeadLetters := q.ListDeadLetters()
+	registry.Close()
+	wal.Close()
+
+	//Rebuild everything from the log
+	wal, registry = openTestWAL(t, path)
+	defer wal.Close()
+	defer registry.Close()
+	q = registry.Default()
+
+	gotJobs, _ := q.GetJobs()
+	assert.Equal(t, len(*wantJobs), len(*gotJobs))
+	for i := range *wantJobs {
+		want, got := (*wantJobs)[i], (*gotJobs)[i]
+		assert.Equal(t, want.Id, got.Id)
+		assert.Equal(t, want.Status, got.Status)
+		assert.Equal(t, want.ConsumerId, got.ConsumerId)
+		assert.Equal(t, want.Attempts, got.Attempts)
+	}
+	assert.Equal(t, len(wantDeadLetters), len(q.ListDeadLetters()))
+	assert.Equal(t, deadId, q.ListDeadLetters()[0].Id)
+	assert.Equal(t, []string{"default", "reports"}, registry.Names())
+
+	//The lease of cId3 survived, and the only queued job is handed out next
+	assert.Nil(t, q.Conclude(ids[1], "cId3"))
+	item, err := q.Dequeue("cId5")
+	assert.Nil(t, err)
+	assert.Equal(t, ids[2], item.Id)
+
+	reports, _ = registry.Lookup("reports")
+	assert.Equal(t, 9, reports.Config().MaxAttempts)
+	item, err = reports.Dequeue("cId6")
+	assert.Nil(t, err)
+	assert.Equal(t, reportId, item.Id)
+	assert.Equal(t, newPriority(3), item.Priority)
+}
+
+func TestWAL_TornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.wal")
+
+	wal, registry := openTestWAL(t, path)
+	item := job{Type: "TIME_CRITICAL"}
+	id, _ := registry.Default().Enqueue(&item)
+	registry.Close()
+	wal.Close()
+	sizeBefore, _ := os.Stat(path)
+
+	//Simulate a crash in the middle of writing a record
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`1234abcd {"op":"enq`)
+	file.Close()
+
+	wal, registry = openTestWAL(t, path)
+	defer wal.Close()
+	defer registry.Close()
+	got, err := registry.Default().GetJob(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "QUEUED", got.Status)
+
+	sizeAfter, _ := os.Stat(path)
+	assert.Equal(t, sizeBefore.Size(), sizeAfter.Size())
+}
+
+func TestWAL_CorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.wal")
+
+	first, _ := encodeRecord(walRecord{Op: "createQueue", Queue: "a"})
+	second, _ := encodeRecord(walRecord{Op: "createQueue", Queue: "b"})
+	first[len(first)-3] = 'X'
+	ioutil.WriteFile(path, append(first, second...), 0644)
+
+	wal, err := OpenWAL(path, fsyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	_, err = NewRegistryWithWAL(log.NewNopLogger(), DefaultQueueConfig(), wal)
+	assert.NotNil(t, err)
+}
+
+func TestOpenWAL_InvalidPolicy(t *testing.T) {
+	_, err := OpenWAL(filepath.Join(os.TempDir(), "unused.wal"), "sometimes", 0)
+	assert.NotNil(t, err)
+}
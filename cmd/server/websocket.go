@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//websocketGUID is appended to the key of the client to compute the accept header of the handshake (RFC 6455).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+//maxWebSocketMessage bounds a message read from the peer. It leaves room for a result of the default size limit.
+const maxWebSocketMessage = 1 << 20
+
+//Opcodes of the WebSocket frames.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+//Status codes of a close frame.
+const (
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseTooLarge      = 1009
+	wsCloseInternalError = 1011
+)
+
+var (
+	errNotWebSocket       = errors.New("The request is not a WebSocket handshake")
+	errHijackUnsupported  = errors.New("The connection cannot be taken over for a WebSocket")
+	errWebSocketProtocol  = errors.New("WebSocket protocol error")
+	errWebSocketTooLarge  = errors.Errorf("WebSocket message exceeds %d bytes", maxWebSocketMessage)
+	errWebSocketNotServed = errors.New("Streaming is not supported by this node, connect to a server running without -shards")
+)
+
+//wsConn is a WebSocket connection. Only the parts of RFC 6455 the queue needs are implemented: no extensions and no
+//subprotocols. Messages are read by a single goroutine, writes may come from any goroutine.
+type wsConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	writer     *bufio.Writer
+	writeMutex sync.Mutex
+	//client is set on the client side of the connection, which masks the frames it sends.
+	client bool
+}
+
+//isWebSocketUpgrade reports whether the request asks to switch to the WebSocket protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, token := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+//websocketAccept returns the Sec-WebSocket-Accept answering the key of the client.
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+//upgradeWebSocket completes the handshake and takes over the connection of the request. Nothing is written to w
+//when an error is returned.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !isWebSocketUpgrade(r) || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errNotWebSocket
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errHijackUnsupported
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to take over the connection")
+	}
+	c := &wsConn{conn: conn, reader: rw.Reader, writer: rw.Writer}
+	fmt.Fprintf(c.writer, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(key))
+	if err := c.writer.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+//ReadMessage returns the next text or binary message, or wsClose once the peer closed the connection.
+//Fragmented messages are put together, pings are answered and pongs are dropped.
+func (c *wsConn) ReadMessage() (int, []byte, error) {
+	opcode := -1
+	var message []byte
+	for {
+		fin, frameOpcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOpcode {
+		case wsClose:
+			return wsClose, payload, nil
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsContinuation:
+			if opcode < 0 {
+				return 0, nil, errWebSocketProtocol
+			}
+		case wsText, wsBinary:
+			if opcode >= 0 {
+				return 0, nil, errWebSocketProtocol
+			}
+			opcode = frameOpcode
+		default:
+			return 0, nil, errWebSocketProtocol
+		}
+		if len(message)+len(payload) > maxWebSocketMessage {
+			return 0, nil, errWebSocketTooLarge
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+//readFrame reads a single frame. Frames of the client are masked, frames of the server are not.
+func (c *wsConn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0F)
+	masked := header[1]&0x80 != 0
+	if header[0]&0x70 != 0 || masked == c.client {
+		return false, 0, nil, errWebSocketProtocol
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	//Control frames are never fragmented and carry at most 125 bytes.
+	if opcode >= wsClose && (!fin || length > 125) {
+		return false, 0, nil, errWebSocketProtocol
+	}
+	if length > maxWebSocketMessage {
+		return false, 0, nil, errWebSocketTooLarge
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+//WriteMessage sends the data as a single text message.
+func (c *wsConn) WriteMessage(data []byte) error {
+	return c.writeFrame(wsText, data)
+}
+
+//writeFrame sends a single unfragmented frame.
+func (c *wsConn) writeFrame(opcode int, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	header := []byte{0x80 | byte(opcode), 0}
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		header[1] |= 0x80
+		header = append(header, mask[:]...)
+		masked := make([]byte, len(payload))
+		for i := range payload {
+			masked[i] = payload[i] ^ mask[i%4]
+		}
+		payload = masked
+	}
+	if _, err := c.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.writer.Write(payload); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+//CloseWithStatus sends a close frame with the status code and reason, then closes the connection.
+func (c *wsConn) CloseWithStatus(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	c.writeFrame(wsClose, payload)
+	return c.conn.Close()
+}
+
+//Close closes the connection without a close frame.
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}